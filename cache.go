@@ -2,14 +2,15 @@ package datamanager
 
 import (
 	"context"
-	"fmt"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/wwqdrh/datamanager/dialet"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+	"github.com/wwqdrh/datamanager/dialet/tablename"
 	"github.com/wwqdrh/logger"
 )
 
@@ -17,12 +18,53 @@ import (
 
 type Fn func() interface{}
 
+// KeyFn 模板key的数据加载函数，params为模板中的字段以及值
+type KeyFn func(params map[string]string) interface{}
+
 // 触发监听的策略
 type Policy struct {
-	Key   string // must unique
-	Table string
-	Field string // "*":全部 "a,b,c,d":指定字段
+	Key   string // must unique，可以是模板，例如 note:{id}、user:{user_id}:notes，见keytemplate.go
+	Table string // [schema.]table，不带schema时只匹配默认schema中的表，见WithDefaultSchema
+	Field string // "*":全部 "a,b,c,d":指定字段，update时只匹配值发生变化的字段
 	Call  Fn
+	Load  KeyFn         // 模板key使用，每个解析出的key单独缓存
+	Mode  CacheMode     // 事件触发时的更新方式，默认为ModeEager
+	TTL   time.Duration // 缓存的过期时间，0时使用Repo的默认值(见WithDefaultTTL)，小于0为不过期
+	Type  interface{}   // 值的类型，例如Note{}、&pb.Note{}，RedisBackend按照该类型解码
+
+	tpl *keyTemplate
+}
+
+// call 加载key的数据
+func (p *Policy) call(params map[string]string) interface{} {
+	if p.Load != nil {
+		return p.Load(params)
+	}
+	return p.Call()
+}
+
+// matchColumns Field中的任意字段发生了变化
+func (p *Policy) matchColumns(columns []string) bool {
+	for _, field := range strings.Split(p.Field, ",") {
+		for _, col := range columns {
+			if strings.TrimSpace(field) == col {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changedColumns update只包含值发生变化的列，没有修改前的数据时以及insert、delete为payload中的所有列
+func changedColumns(log dialet.ILogData) []string {
+	if d := dialet.GetDiff(log); d != nil && strings.EqualFold(log.GetLabel(), "update") {
+		return diff.Names(d)
+	}
+	columns := make([]string, 0, len(log.GetPaylod()))
+	for col := range log.GetPaylod() {
+		columns = append(columns, col)
+	}
+	return columns
 }
 
 type cacheMap struct {
@@ -70,151 +112,338 @@ func (c *cacheMap) Trigger(val dialet.ILogData) {
 }
 
 type Repo struct {
-	CacheFn  sync.Map // map[string]*Policy     //
-	ValueMap sync.Map // map[string]interface{} //
-	WaitMap  map[string]*sync.Cond
-	Chan     chan dialet.ILogData
-	client   *redis.Client
-
-	onceFlag uint32   // 用于实现安全的双检锁
-	onceMap  sync.Map //  map[string]*keyRepo // 使用map映射
+	CacheFn sync.Map // map[string]*Policy     //
+	Chan    chan dialet.ILogData
+	backend CacheBackend
+
+	// ValueMap 非模板key最近一次计算的值，删除缓存时同步删除，只用于兼容之前直接读取ValueMap的代码
+	//
+	// Deprecated: 缓存数据保存在backend中，使用GetValue读取
+	ValueMap sync.Map // map[string]interface{}
+
+	// WaitMap GenInstance创建的条件变量，key更新或者删除时Broadcast
+	//
+	// Deprecated: 使用WaitContext或者WaitForVersion
+	WaitMap map[string]*sync.Cond
+
 	lock     sync.Mutex
+	versions map[string]*keyVersion // 见wait.go
+	clock    uint64                 // 最近的版本号
+	floor    uint64                 // 已清理的版本号中最大的值
+
+	flightMu sync.Mutex
+	flights  map[string]*flight // 正在计算的key
+
+	pubsub     *redis.Client // 多实例的失效通知，见invalidation.go
+	channel    string
+	instanceID string
+
+	defaultSchema string
+	defaultTTL    time.Duration // Policy.TTL为0时使用，0为不过期
 }
 
-type keyRepo struct {
-	once uint32
+// backend的操作超时
+const backendTimeout = 5 * time.Second
+
+// 之前版本InitRedisCache以及SetValueV2写入redis的key的过期时间
+const legacyRedisTTL = 5 * time.Second
+
+type RepoOption func(*Repo)
+
+// WithBackend 缓存数据的存储，默认为不限制大小的MemoryBackend
+func WithBackend(backend CacheBackend) RepoOption {
+	return func(r *Repo) {
+		r.backend = backend
+	}
 }
 
-func NewRepo(ch chan dialet.ILogData) *Repo {
-	return &Repo{
+// WithDefaultSchema Policy.Table不带schema时匹配的schema，一般为dialet.IDefaultSchema的返回值
+// 默认匹配postgres的public、sqlite的main以及没有schema的事件，mysql需要指定为dsn中的数据库
+func WithDefaultSchema(schema string) RepoOption {
+	return func(r *Repo) {
+		r.defaultSchema = schema
+	}
+}
+
+// WithDefaultTTL Policy.TTL为0时的过期时间，默认不过期
+func WithDefaultTTL(ttl time.Duration) RepoOption {
+	return func(r *Repo) {
+		r.defaultTTL = ttl
+	}
+}
+
+func NewRepo(ch chan dialet.ILogData, opts ...RepoOption) *Repo {
+	r := &Repo{
 		CacheFn:  sync.Map{}, // map[string]*Policy{},
-		ValueMap: sync.Map{}, //map[string]interface{}{},
-		WaitMap:  map[string]*sync.Cond{},
 		Chan:     ch,
-		onceFlag: 0,
-		onceMap:  sync.Map{},
+		backend:  NewMemoryBackend(0),
 		lock:     sync.Mutex{},
+		versions: map[string]*keyVersion{},
+		WaitMap:  map[string]*sync.Cond{},
+		flights:  map[string]*flight{},
+
+		instanceID: uuid.NewString(),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if n, ok := r.backend.(EvictNotifier); ok {
+		n.OnEvict(r.forget)
+	}
+	return r
 }
 
-// 配置redis客户端作为缓存工具
+// 配置redis客户端作为缓存工具，本地缓存作为一级缓存，redis中的值使用json编码
+// 与之前的版本相同，没有设置TTL的key在5秒后过期，不过期需要将Policy.TTL设置为小于0，或者使用WithBackend
 func (r *Repo) InitRedisCache(client *redis.Client) {
-	r.client = client
+	r.backend = NewTieredBackend(NewMemoryBackend(0), NewRedisBackend(client, JSONCodec), 0)
+	r.defaultTTL = legacyRedisTTL
 }
 
-func (r *Repo) GetValue(key string) interface{} {
-	// if val, ok := r.ValueMap[key]; ok {
-	if val, ok := r.ValueMap.Load(key); ok {
+// GetValue key为模板时args为模板中的字段的值，按照在模板中的顺序，例如 GetValue("user:{user_id}:notes", 42)
+func (r *Repo) GetValue(key string, args ...interface{}) interface{} {
+	policy, cacheKey, params, ok := r.resolve(key, args)
+	if !ok {
+		return nil
+	}
+	var typ interface{}
+	if policy != nil {
+		typ = policy.Type
+	}
+	if val, ok := r.load(cacheKey, typ); ok {
 		return val
 	}
-
-	// if fn, ok := r.CacheFn[key]; !ok {
-	if fn, ok := r.CacheFn.Load(key); !ok {
+	if policy == nil {
 		return nil
-	} else {
-		v := fn.(*Policy).Call()
-		// r.ValueMap[key] = v
-		r.ValueMap.Store(key, v)
-		return v
 	}
+	// 并发的调用只计算一次
+	f := r.recompute(policy, cacheKey, params, false, false)
+	<-f.done
+	return f.value
 }
 
-// 如果配置了redis就从redis中获取数据，否则从本地缓存中获取数据，
-func (r *Repo) GetValueV2(key string) interface{} {
-	if r.client == nil {
-		return r.GetValue(key)
+// resolve 根据注册的key以及参数得到缓存中的key，没有注册的key原样返回
+func (r *Repo) resolve(key string, args []interface{}) (*Policy, string, map[string]string, bool) {
+	// if fn, ok := r.CacheFn[key]; !ok {
+	fn, ok := r.CacheFn.Load(key)
+	if !ok {
+		return nil, key, nil, len(args) == 0
+	}
+	policy := fn.(*Policy)
+	if policy.tpl.static() {
+		return policy, key, nil, len(args) == 0
 	}
+	params, ok := policy.tpl.args(args)
+	if !ok {
+		return nil, "", nil, false
+	}
+	return policy, policy.tpl.format(params), params, true
+}
 
-	var res interface{}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// load 读取backend中的值，出错时作为未缓存处理
+func (r *Repo) load(key string, typ interface{}) (interface{}, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
 	defer cancel()
-	val, err := r.client.Get(ctx, key).Result()
-	switch {
-	case err == redis.Nil:
-		res = nil
-	case err != nil:
-		res = nil
-	default:
-		res = val
-	}
-
-	if res == nil {
-		res = r.GetValue(key)
-		if err := r.SetValueV2(key, fmt.Sprint(res)); err != nil {
-			logger.DefaultLogger.Error(err.Error())
-		}
+	val, ok, err := r.backend.Get(ctx, key, typ)
+	if err != nil {
+		logger.DefaultLogger.Error(err.Error())
+		return nil, false
 	}
-	return res
+	return val, ok
+}
+
+// Deprecated: 与GetValue相同，redis通过InitRedisCache或者WithBackend配置
+func (r *Repo) GetValueV2(key string, args ...interface{}) interface{} {
+	return r.GetValue(key, args...)
 }
 
+// Deprecated: 缓存由Repo维护，直接写入backend，与之前的版本相同在5秒后过期
 func (r *Repo) SetValueV2(key, value string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
 	defer cancel()
-	err := r.client.Set(ctx, key, value, 5*time.Second).Err()
-	if err != nil {
-		return err
-	}
-	return nil
+	return r.backend.Set(ctx, key, value, legacyRedisTTL)
 }
 
 // 注册key以及处理函数(返回数据，用于更新缓存中的key)
 func (r *Repo) Register(policy *Policy) {
+	policy.tpl = parseKeyTemplate(policy.Key)
 	// r.CacheFn[policy.Key] = policy
 	r.CacheFn.Store(policy.Key, policy)
 }
 
-func (r *Repo) GenInstance(key string) {
-	if val, _ := r.onceMap.LoadOrStore(key, &keyRepo{}); atomic.LoadUint32(&val.(*keyRepo).once) == 0 {
-		r.lock.Lock()
-		if v := val.(*keyRepo); v.once == 0 {
-			r.WaitMap[key] = sync.NewCond(&sync.Mutex{})
-			atomic.StoreUint32(&v.once, 1)
-		}
-		r.lock.Unlock()
-	}
-}
-
 // 触发key相应的更新操作
 func (r *Repo) Trigger(log dialet.ILogData) {
-	r.CacheFn.Range(func(k, value interface{}) bool {
-		key := k.(string)
-		policy := value.(*Policy)
-		if policy.Table != log.GetTable() {
-			return true
-		}
+	r.trigger([]dialet.ILogData{log})
+}
+
+// action 事件影响的一个key，同一批事件中相同的key只处理一次
+type action struct {
+	policy *Policy
+	key    string
+	params map[string]string
+	cached bool // 模板key只更新已经缓存的key
+	drop   bool // 只删除缓存
+}
 
-		if policy.Field != "*" {
-			invalid := true
-			for key := range log.GetPaylod() {
-				if strings.Contains(policy.Field, key) {
-					invalid = false
-					break
-				}
+func (r *Repo) trigger(logs []dialet.ILogData) {
+	var actions []*action
+	seen := map[string]bool{}
+	add := func(a *action) {
+		if !seen[a.key] {
+			seen[a.key] = true
+			actions = append(actions, a)
+		}
+	}
+	for _, log := range logs {
+		r.CacheFn.Range(func(k, value interface{}) bool {
+			key := k.(string)
+			policy := value.(*Policy)
+			if !tablename.Match(policy.Table, r.defaultSchema, log.GetSchema(), log.GetTable()) {
+				return true
 			}
-			if invalid {
+
+			// truncate没有payload，表上的所有缓存都需要更新
+			if policy.Field != "*" && !strings.EqualFold(log.GetLabel(), "truncate") && !policy.matchColumns(changedColumns(log)) {
 				return true
 			}
-		}
 
-		// 验证通过，触发缓存执行
-		// if val, ok := r.CacheFn[key]; ok {
-		if val, ok := r.CacheFn.Load(key); ok {
-			v := val.(*Policy).Call()
-			// v := val.Call()
-			// r.ValueMap[key] = v
-			r.ValueMap.Store(key, v)
-
-			if r.client != nil {
-				if err := r.SetValueV2(key, fmt.Sprint(v)); err != nil {
-					logger.DefaultLogger.Error(err.Error())
-				}
+			// 验证通过，触发缓存执行
+			if policy.tpl.static() {
+				add(&action{policy: policy, key: key})
+			} else {
+				r.templateActions(policy, log, add)
 			}
+			return true
+		})
+	}
+
+	// eager的key全部完成后再返回，完成后通知其它实例
+	var pending []*flight
+	var keys []string
+	for _, a := range actions {
+		f := r.apply(a)
+		switch {
+		case f == nil:
+			keys = append(keys, a.key)
+		case a.policy.Mode == ModeStaleWhileRevalidate:
+			if r.pubsub != nil {
+				go r.publishAfter(f, a.key)
+			}
+		default:
+			pending = append(pending, f)
+			keys = append(keys, a.key)
+		}
+	}
+	for _, f := range pending {
+		<-f.done
+	}
+	r.publish(keys...)
+}
+
+// templateActions 事件影响的模板key
+// update修改了模板中的字段时(例如note的user_id)，修改前后的key都会更新
+func (r *Repo) templateActions(policy *Policy, log dialet.ILogData, add func(*action)) {
+	payload := log.GetPaylod()
+	// truncate或者无法解析key时清理该模板的所有缓存
+	if _, ok := policy.tpl.params(payload); !ok || strings.EqualFold(log.GetLabel(), "truncate") {
+		r.purge(policy, add)
+		return
+	}
+
+	rows := []map[string]interface{}{payload}
+	if d := dialet.GetDiff(log); len(d) > 0 {
+		previous := make(map[string]interface{}, len(payload))
+		for k, v := range payload {
+			previous[k] = v
+		}
+		for _, c := range d {
+			previous[c.Name] = c.Old
+		}
+		rows = append(rows, previous)
+	}
+	for _, row := range rows {
+		if params, ok := policy.tpl.params(row); ok {
+			add(&action{policy: policy, key: policy.tpl.format(params), params: params, cached: true})
+		}
+	}
+}
+
+// purge 删除模板的所有缓存
+func (r *Repo) purge(policy *Policy, add func(*action)) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	keys, err := r.backend.Keys(ctx, policy.tpl.glob())
+	if err != nil {
+		logger.DefaultLogger.Error(err.Error())
+		return
+	}
+	for _, key := range keys {
+		if policy.tpl.match(key) {
+			add(&action{policy: policy, key: key, drop: true})
+		}
+	}
+}
 
-			r.GenInstance(key)
-			r.WaitMap[key].Broadcast()
+// apply 按照policy的模式更新key，返回正在进行的计算
+func (r *Repo) apply(a *action) *flight {
+	if a.drop || a.policy.Mode == ModeInvalidate {
+		r.invalidate(a.key)
+		return nil
+	}
+	if a.cached {
+		if _, ok := r.load(a.key, a.policy.Type); !ok {
+			r.invalidate(a.key)
+			return nil
 		}
-		return true
-	})
+	}
+	// 其它调用方正在计算时需要等待
+	return r.recompute(a.policy, a.key, a.params, true, a.policy.Mode == ModeStaleWhileRevalidate)
+}
+
+// invalidate 删除key，下次GetValue时重新计算
+// 正在计算的key可能读到修改前的数据，标记为dirty重新计算
+func (r *Repo) invalidate(key string) {
+	r.flightMu.Lock()
+	if f, ok := r.flights[key]; ok {
+		f.dirty = true
+	}
+	r.flightMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	if err := r.backend.Delete(ctx, key); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
+	cancel()
+	r.ValueMap.Delete(key)
+	r.wake(key, false, r.stamp())
+}
+
+// ttl policy的过期时间，0为不过期
+func (r *Repo) ttl(policy *Policy) time.Duration {
+	switch {
+	case policy.TTL < 0:
+		return 0
+	case policy.TTL == 0:
+		return r.defaultTTL
+	}
+	return policy.TTL
+}
+
+// refresh 重新计算key的数据并唤醒等待的调用方
+// 计算开始时取序号，版本号只提高到该序号，计算期间的修改不会被当作已经反映在结果中
+func (r *Repo) refresh(policy *Policy, key string, params map[string]string) interface{} {
+	stamp := r.stamp()
+	v := policy.call(params)
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	if err := r.backend.Set(ctx, key, v, r.ttl(policy)); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
+	cancel()
+	if policy.tpl.static() {
+		r.ValueMap.Store(key, v)
+	}
+
+	r.wake(key, true, stamp)
+	return v
 }
 
 // 后台线程 获取操作日志
@@ -223,23 +452,30 @@ func (r *Repo) Trigger(log dialet.ILogData) {
 // 2、更新了某一条记录之后，需要去判断出这条记录如何映射到缓存函数中
 // 操作记录: table、changes、payload；缓存函数：表名、
 // 这样才知道是更新哪一块缓存
+// 已经到达的事件一起处理，写入突发时每个key只计算一次
+// 配置了WithInvalidation时同时接收其它实例的失效通知，没有事件的实例也需要调用
 func (r *Repo) Notify(ctx context.Context) {
+	if r.pubsub != nil {
+		go r.subscribe(ctx)
+	}
 	for {
 		select {
 		case item := <-r.Chan:
-			r.Trigger(item)
+			r.trigger(r.drain(item))
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// wait a cache trigger update
-// 存在多个channel进行调用的情况
-func (r *Repo) Wait(key string) {
-	r.GenInstance(key)
-
-	r.WaitMap[key].L.Lock() // wired 需要先加锁
-	r.WaitMap[key].Wait()
-	r.WaitMap[key].L.Unlock()
+func (r *Repo) drain(item dialet.ILogData) []dialet.ILogData {
+	logs := []dialet.ILogData{item}
+	for {
+		select {
+		case item := <-r.Chan:
+			logs = append(logs, item)
+		default:
+			return logs
+		}
+	}
 }
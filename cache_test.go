@@ -5,13 +5,18 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/wwqdrh/datamanager/dialet"
+	"github.com/wwqdrh/datamanager/dialet/diff"
 )
 
 type testLog struct {
 	schema  string
 	table   string
+	label   string // 默认为insert
 	payload map[string]interface{}
+	diff    []diff.Column
 }
 
 func (t *testLog) GetSchema() string {
@@ -24,7 +29,10 @@ func (t *testLog) GetType() string {
 	return "ddl"
 } // 获取日志记录类型 ddl dml
 func (t *testLog) GetLabel() string {
-	return "insert"
+	if t.label == "" {
+		return "insert"
+	}
+	return t.label
 } // 具体标签 insert update delete | alter column, table
 func (t *testLog) GetTime() time.Time {
 	return time.Now()
@@ -35,6 +43,9 @@ func (t *testLog) GetPaylod() map[string]interface{} {
 func (t *testLog) GetChange() map[string]interface{} {
 	return map[string]interface{}{}
 }
+func (t *testLog) GetDiff() []diff.Column {
+	return t.diff
+}
 
 func TestSimpleRegister(t *testing.T) {
 	ch := make(chan dialet.ILogData, 1)
@@ -142,3 +153,185 @@ func TestCacheUpdateWait(t *testing.T) {
 	cancel()
 	time.Sleep(1 * time.Second)
 }
+
+// truncate没有payload，指定了字段的缓存同样需要更新
+func TestRepoTriggerTruncate(t *testing.T) {
+	values := map[string]string{"cacheA": "a1", "cacheB": "b1", "cacheC": "c1"}
+	r := NewRepo(nil)
+	for key, table := range map[string]string{"cacheA": "table1", "cacheB": "table1", "cacheC": "table2"} {
+		key := key
+		field := "*"
+		if key == "cacheB" {
+			field = "field1"
+		}
+		r.Register(&Policy{Key: key, Table: table, Field: field, Call: func() interface{} { return values[key] }})
+		require.Equal(t, values[key], r.GetValue(key))
+	}
+
+	values = map[string]string{"cacheA": "a2", "cacheB": "b2", "cacheC": "c2"}
+	r.Trigger(&testLog{table: "table1", label: "truncate"})
+	require.Equal(t, "a2", r.GetValue("cacheA"))
+	require.Equal(t, "b2", r.GetValue("cacheB"))
+	require.Equal(t, "c1", r.GetValue("cacheC"))
+}
+
+// update只根据发生变化的列匹配Field
+func TestRepoTriggerChangedColumns(t *testing.T) {
+	calls := map[string]int{}
+	r := NewRepo(nil)
+	for key, field := range map[string]string{"cacheA": "field1", "cacheB": "field2, field3", "cacheC": "field"} {
+		key := key
+		r.Register(&Policy{Key: key, Table: "table1", Field: field, Call: func() interface{} {
+			calls[key]++
+			return calls[key]
+		}})
+	}
+	payload := map[string]interface{}{"id": 1, "field1": "a", "field2": "b"}
+
+	r.Trigger(&testLog{table: "table1", label: "update", payload: payload, diff: []diff.Column{{Name: "field2", Old: "a", New: "b"}}})
+	require.Equal(t, map[string]int{"cacheB": 1}, calls)
+
+	// 值没有变化
+	r.Trigger(&testLog{table: "table1", label: "update", payload: payload, diff: []diff.Column{}})
+	require.Equal(t, map[string]int{"cacheB": 1}, calls)
+
+	// 没有修改前的数据时按照payload匹配
+	r.Trigger(&testLog{table: "table1", label: "update", payload: payload})
+	require.Equal(t, map[string]int{"cacheA": 1, "cacheB": 2}, calls)
+
+	r.Trigger(&testLog{table: "table1", payload: payload})
+	require.Equal(t, map[string]int{"cacheA": 2, "cacheB": 3}, calls)
+}
+
+// 模板key只更新事件影响的行
+func TestRepoTemplateKeys(t *testing.T) {
+	notes := map[string]string{"1": "a", "2": "b"}
+	owners := map[string][]string{"10": {"1", "2"}}
+	loads := map[string]int{}
+	r := NewRepo(nil)
+	r.Register(&Policy{Key: "note:{id}", Table: "notes", Field: "note", Load: func(params map[string]string) interface{} {
+		loads["note:"+params["id"]]++
+		return notes[params["id"]]
+	}})
+	r.Register(&Policy{Key: "user:{user_id}:notes", Table: "notes", Field: "user_id", Load: func(params map[string]string) interface{} {
+		loads["user:"+params["user_id"]]++
+		return len(owners[params["user_id"]])
+	}})
+
+	require.Equal(t, "a", r.GetValue("note:{id}", 1))
+	require.Equal(t, "b", r.GetValue("note:{id}", "2"))
+	require.Equal(t, 2, r.GetValue("user:{user_id}:notes", 10))
+	require.Equal(t, "a", r.GetValue("note:{id}", 1))
+	require.Nil(t, r.GetValue("note:{id}"))
+	require.Equal(t, map[string]int{"note:1": 1, "note:2": 1, "user:10": 1}, loads)
+
+	// 只重新加载note:1
+	notes["1"] = "a2"
+	r.Trigger(&testLog{table: "notes", label: "update",
+		payload: map[string]interface{}{"id": float64(1), "note": "a2", "user_id": float64(10)},
+		diff:    []diff.Column{{Name: "note", Old: "a", New: "a2"}}})
+	require.Equal(t, "a2", r.GetValue("note:{id}", 1))
+	require.Equal(t, map[string]int{"note:1": 2, "note:2": 1, "user:10": 1}, loads)
+
+	// 修改user_id时修改前后的key都会更新，没有缓存的key不加载
+	owners = map[string][]string{"10": {"1"}, "11": {"2"}}
+	r.Trigger(&testLog{table: "notes", label: "update",
+		payload: map[string]interface{}{"id": float64(2), "note": "b", "user_id": float64(11)},
+		diff:    []diff.Column{{Name: "user_id", Old: float64(10), New: float64(11)}}})
+	require.Equal(t, map[string]int{"note:1": 2, "note:2": 1, "user:10": 2}, loads)
+	require.Equal(t, 1, r.GetValue("user:{user_id}:notes", 10))
+	require.Equal(t, 1, r.GetValue("user:{user_id}:notes", 11))
+
+	// truncate清理该模板的所有缓存
+	notes = map[string]string{}
+	r.Trigger(&testLog{table: "notes", label: "truncate"})
+	require.Equal(t, "", r.GetValue("note:{id}", 1))
+	require.Equal(t, 3, loads["note:1"])
+}
+
+// sqlite dialet的变更触发缓存更新
+func TestRepoTriggerWithSqlite(t *testing.T) {
+	dial := newSqliteDialet(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	ch := make(chan dialet.ILogData, 10)
+	go func() {
+		events := dial.Watch(ctx)
+		for {
+			select {
+			case item := <-events:
+				ch <- item.(dialet.ILogData)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	r := NewRepo(ch)
+	r.Register(&Policy{
+		Key:   "notescount",
+		Table: "notes",
+		Field: "*",
+		Call: func() interface{} {
+			var count int
+			if err := dial.DB().QueryRow("select count(id) from notes").Scan(&count); err != nil {
+				return -1
+			}
+			return count
+		},
+	})
+	go r.Notify(ctx)
+
+	require.Equal(t, 0, r.GetValue("notescount"))
+	require.Nil(t, dial.Exec(testSqliteInsert))
+	require.Eventually(t, func() bool {
+		return r.GetValue("notescount") == 1
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+// 策略的表名带schema时只匹配该schema
+func TestRepoTriggerSchema(t *testing.T) {
+	calls := map[string]int{}
+	r := NewRepo(nil)
+	for key, table := range map[string]string{"tenant": "tenant_1.orders", "public": "orders"} {
+		key := key
+		r.Register(&Policy{Key: key, Table: table, Field: "*", Call: func() interface{} {
+			calls[key]++
+			return calls[key]
+		}})
+	}
+	r.Trigger(&testLog{schema: "tenant_1", table: "orders"})
+	r.Trigger(&testLog{schema: "tenant_2", table: "orders"})
+	r.Trigger(&testLog{schema: "public", table: "orders"})
+	assert.Equal(t, map[string]int{"tenant": 1, "public": 1}, calls)
+
+	calls = map[string]int{}
+	r = NewRepo(nil, WithDefaultSchema("shop"))
+	r.Register(&Policy{Key: "public", Table: "orders", Field: "*", Call: func() interface{} {
+		calls["public"]++
+		return 1
+	}})
+	r.Trigger(&testLog{schema: "public", table: "orders"})
+	r.Trigger(&testLog{schema: "shop", table: "orders"})
+	assert.Equal(t, map[string]int{"public": 1}, calls)
+}
+
+// 兼容直接读取ValueMap的代码，模板key不写入
+func TestRepoValueMap(t *testing.T) {
+	r := NewRepo(nil, WithBackend(NewMemoryBackend(1)))
+	r.Register(&Policy{Key: "cacheA", Table: "table1", Field: "*", Mode: ModeInvalidate, Call: func() interface{} { return 1 }})
+	r.Register(&Policy{Key: "note:{id}", Table: "note", Field: "*", Load: func(params map[string]string) interface{} { return params["id"] }})
+
+	assert.Equal(t, 1, r.GetValue("cacheA"))
+	assert.Equal(t, "1", r.GetValue("note:{id}", 1))
+	v, ok := r.ValueMap.Load("cacheA")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	_, ok = r.ValueMap.Load("note:1")
+	assert.False(t, ok)
+
+	r.Trigger(&testLog{table: "table1"})
+	_, ok = r.ValueMap.Load("cacheA")
+	assert.False(t, ok)
+}
@@ -0,0 +1,317 @@
+package datamanager
+
+import (
+	"container/list"
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// CacheBackend Repo中缓存数据的存储
+type CacheBackend interface {
+	// Get typ为值的类型(例如Note{}、&pb.Note{})，需要解码的backend按照该类型解码
+	Get(ctx context.Context, key string, typ interface{}) (interface{}, bool, error)
+	// Set ttl为0时不过期
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// Keys pattern为redis的glob格式，支持*、?以及\转义，例如 note:*
+	Keys(ctx context.Context, pattern string) ([]string, error)
+}
+
+// EvictNotifier backend自行删除key(容量淘汰、过期)时通知，Repo使用该通知清理版本号(见wait.go)
+type EvictNotifier interface {
+	OnEvict(fn func(key string))
+}
+
+var (
+	_ EvictNotifier = &MemoryBackend{}
+	_ CacheBackend  = &MemoryBackend{}
+	_ CacheBackend  = &RedisBackend{}
+	_ CacheBackend  = &TieredBackend{}
+)
+
+// MemoryBackend 进程内的LRU缓存，值不经过编码
+type MemoryBackend struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+
+	onEvict func(key string)
+}
+
+type memoryEntry struct {
+	key    string
+	value  interface{}
+	expire time.Time // 为空时不过期
+}
+
+// NewMemoryBackend size为最多保存的key数量，超过时淘汰最久未使用的key，size<=0时不限制
+func NewMemoryBackend(size int) *MemoryBackend {
+	return &MemoryBackend{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// OnEvict 淘汰或者过期的key被删除时调用fn，Delete不会调用，fn在锁外调用
+// 一个MemoryBackend只能通知一个Repo，由NewRepo设置
+func (m *MemoryBackend) OnEvict(fn func(key string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onEvict = fn
+}
+
+func (m *MemoryBackend) Get(ctx context.Context, key string, typ interface{}) (interface{}, bool, error) {
+	m.mu.Lock()
+	el, ok := m.items[key]
+	if !ok {
+		m.mu.Unlock()
+		return nil, false, nil
+	}
+	e := el.Value.(*memoryEntry)
+	if e.expired(time.Now()) {
+		m.remove(el)
+		fn := m.onEvict
+		m.mu.Unlock()
+		if fn != nil {
+			fn(key)
+		}
+		return nil, false, nil
+	}
+	m.ll.MoveToFront(el)
+	value := e.value
+	m.mu.Unlock()
+	return value, true, nil
+}
+
+func (m *MemoryBackend) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+	m.mu.Lock()
+	if el, ok := m.items[key]; ok {
+		e := el.Value.(*memoryEntry)
+		e.value, e.expire = value, expire
+		m.ll.MoveToFront(el)
+		m.mu.Unlock()
+		return nil
+	}
+	m.items[key] = m.ll.PushFront(&memoryEntry{key: key, value: value, expire: expire})
+	var evicted []string
+	for m.size > 0 && m.ll.Len() > m.size {
+		el := m.ll.Back()
+		evicted = append(evicted, el.Value.(*memoryEntry).key)
+		m.remove(el)
+	}
+	fn := m.onEvict
+	m.mu.Unlock()
+	if fn != nil {
+		for _, k := range evicted {
+			fn(k)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := m.items[key]; ok {
+			m.remove(el)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Keys(ctx context.Context, pattern string) ([]string, error) {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	res := []string{}
+	for key, el := range m.items {
+		if !el.Value.(*memoryEntry).expired(now) && re.MatchString(key) {
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+
+// Len 当前保存的key数量，包括已经过期但还没有清理的key
+func (m *MemoryBackend) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ll.Len()
+}
+
+func (m *MemoryBackend) remove(el *list.Element) {
+	m.ll.Remove(el)
+	delete(m.items, el.Value.(*memoryEntry).key)
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && now.After(e.expire)
+}
+
+// globRegexp 将redis的glob转换为正则
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// globEscape 转义glob中的特殊字符
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// RedisBackend 值通过codec编码后保存在redis中
+type RedisBackend struct {
+	client *redis.Client
+	codec  Codec
+}
+
+// NewRedisBackend codec为nil时使用JSONCodec
+func NewRedisBackend(client *redis.Client, codec Codec) *RedisBackend {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return &RedisBackend{client: client, codec: codec}
+}
+
+func (r *RedisBackend) Get(ctx context.Context, key string, typ interface{}) (interface{}, bool, error) {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "redis get")
+	}
+	v, err := decodeValue(r.codec, data, typ)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "decode %s", key)
+	}
+	return v, true, nil
+}
+
+func (r *RedisBackend) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := r.codec.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "encode %s", key)
+	}
+	return errors.Wrap(r.client.Set(ctx, key, data, ttl).Err(), "redis set")
+}
+
+func (r *RedisBackend) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return errors.Wrap(r.client.Del(ctx, keys...).Err(), "redis del")
+}
+
+func (r *RedisBackend) Keys(ctx context.Context, pattern string) ([]string, error) {
+	res := []string{}
+	iter := r.client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		res = append(res, iter.Val())
+	}
+	return res, errors.Wrap(iter.Err(), "redis scan")
+}
+
+// TieredBackend 本地(L1)加远端(L2)两级缓存，写入时先写远端
+type TieredBackend struct {
+	local    CacheBackend
+	remote   CacheBackend
+	localTTL time.Duration
+}
+
+// NewTieredBackend localTTL>0时本地缓存最多保留localTTL，用于限制其它实例修改后本地数据的过期时间
+func NewTieredBackend(local, remote CacheBackend, localTTL time.Duration) *TieredBackend {
+	return &TieredBackend{local: local, remote: remote, localTTL: localTTL}
+}
+
+func (t *TieredBackend) Get(ctx context.Context, key string, typ interface{}) (interface{}, bool, error) {
+	if v, ok, err := t.local.Get(ctx, key, typ); err == nil && ok {
+		return v, true, nil
+	}
+	v, ok, err := t.remote.Get(ctx, key, typ)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return v, true, t.local.Set(ctx, key, v, t.localTTL)
+}
+
+func (t *TieredBackend) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := t.remote.Set(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	if t.localTTL > 0 && (ttl == 0 || t.localTTL < ttl) {
+		ttl = t.localTTL
+	}
+	return t.local.Set(ctx, key, value, ttl)
+}
+
+func (t *TieredBackend) Delete(ctx context.Context, keys ...string) error {
+	errL := t.local.Delete(ctx, keys...)
+	if err := t.remote.Delete(ctx, keys...); err != nil {
+		return err
+	}
+	return errL
+}
+
+// Keys 本地以及远端的key
+func (t *TieredBackend) Keys(ctx context.Context, pattern string) ([]string, error) {
+	local, err := t.local.Keys(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := t.remote.Keys(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(remote))
+	for _, key := range remote {
+		seen[key] = true
+	}
+	for _, key := range local {
+		if !seen[key] {
+			remote = append(remote, key)
+		}
+	}
+	return remote, nil
+}
@@ -0,0 +1,205 @@
+package datamanager
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type testNote struct {
+	ID    int
+	Title string
+	Tags  []string
+}
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func TestMemoryBackendLRU(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryBackend(2)
+	require.NoError(t, m.Set(ctx, "a", 1, 0))
+	require.NoError(t, m.Set(ctx, "b", 2, 0))
+	// 访问a之后b为最久未使用
+	_, ok, _ := m.Get(ctx, "a", nil)
+	require.True(t, ok)
+	require.NoError(t, m.Set(ctx, "c", 3, 0))
+	assert.Equal(t, 2, m.Len())
+	_, ok, _ = m.Get(ctx, "b", nil)
+	assert.False(t, ok)
+	v, ok, _ := m.Get(ctx, "a", nil)
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	require.NoError(t, m.Set(ctx, "d", 4, 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	_, ok, _ = m.Get(ctx, "d", nil)
+	assert.False(t, ok)
+
+	require.NoError(t, m.Delete(ctx, "a", "missing"))
+	_, ok, _ = m.Get(ctx, "a", nil)
+	assert.False(t, ok)
+}
+
+func TestMemoryBackendKeys(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryBackend(0)
+	for _, key := range []string{"note:1", "note:2", "note*:3", "user:1:notes"} {
+		require.NoError(t, m.Set(ctx, key, key, 0))
+	}
+	keys, err := m.Keys(ctx, "note:*")
+	require.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"note:1", "note:2"}, keys)
+
+	keys, err = m.Keys(ctx, parseKeyTemplate("note*:{id}").glob())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"note*:3"}, keys)
+
+	keys, err = m.Keys(ctx, "user:?:notes")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user:1:notes"}, keys)
+}
+
+func TestRedisBackendCodec(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	note := testNote{ID: 1, Title: "a", Tags: []string{"x", "y"}}
+
+	b := NewRedisBackend(client, JSONCodec)
+	require.NoError(t, b.Set(ctx, "json", note, 0))
+	v, ok, err := b.Get(ctx, "json", testNote{})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, note, v)
+	// 没有指定类型时为json的默认类型
+	v, _, err = b.Get(ctx, "json", nil)
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), v.(map[string]interface{})["ID"])
+
+	b = NewRedisBackend(client, GobCodec)
+	require.NoError(t, b.Set(ctx, "gob", note, 0))
+	v, ok, err = b.Get(ctx, "gob", testNote{})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, note, v)
+	v, _, err = b.Get(ctx, "gob", &testNote{})
+	require.NoError(t, err)
+	assert.Equal(t, &note, v)
+
+	b = NewRedisBackend(client, ProtoCodec)
+	msg, err := structpb.NewStruct(map[string]interface{}{"id": 1, "title": "a"})
+	require.NoError(t, err)
+	require.NoError(t, b.Set(ctx, "proto", msg, 0))
+	v, ok, err = b.Get(ctx, "proto", &structpb.Struct{})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, proto.Equal(msg, v.(*structpb.Struct)))
+	assert.Error(t, b.Set(ctx, "proto", note, 0))
+
+	_, ok, err = b.Get(ctx, "missing", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	keys, err := b.Keys(ctx, "*o*")
+	require.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"gob", "json", "proto"}, keys)
+	require.NoError(t, b.Delete(ctx, keys...))
+	keys, _ = b.Keys(ctx, "*")
+	assert.Empty(t, keys)
+}
+
+func TestTieredBackend(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	local := NewMemoryBackend(0)
+	b := NewTieredBackend(local, NewRedisBackend(client, JSONCodec), time.Minute)
+
+	require.NoError(t, b.Set(ctx, "note:1", testNote{ID: 1}, 0))
+	assert.True(t, mr.Exists("note:1"))
+	assert.Equal(t, time.Duration(0), mr.TTL("note:1"))
+	// 一级缓存中为原始的值
+	v, ok, _ := local.Get(ctx, "note:1", nil)
+	require.True(t, ok)
+	assert.Equal(t, testNote{ID: 1}, v)
+
+	// 其它实例写入的值从redis中读取后缓存到本地
+	require.NoError(t, mr.Set("note:2", `{"ID":2}`))
+	v, ok, err := b.Get(ctx, "note:2", testNote{})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, testNote{ID: 2}, v)
+	_, ok, _ = local.Get(ctx, "note:2", nil)
+	assert.True(t, ok)
+
+	keys, err := b.Keys(ctx, "note:*")
+	require.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"note:1", "note:2"}, keys)
+
+	require.NoError(t, b.Delete(ctx, "note:1"))
+	assert.False(t, mr.Exists("note:1"))
+	_, ok, _ = local.Get(ctx, "note:1", nil)
+	assert.False(t, ok)
+}
+
+func TestRepoBackendTTL(t *testing.T) {
+	mr, client := newTestRedis(t)
+	r := NewRepo(nil, WithBackend(NewRedisBackend(client, GobCodec)))
+	calls := 0
+	r.Register(&Policy{
+		Key:   "note:{id}",
+		Table: "notes",
+		Field: "*",
+		TTL:   time.Minute,
+		Type:  testNote{},
+		Load: func(params map[string]string) interface{} {
+			calls++
+			return testNote{ID: calls, Title: params["id"]}
+		},
+	})
+
+	assert.Equal(t, testNote{ID: 1, Title: "7"}, r.GetValue("note:{id}", 7))
+	assert.Equal(t, time.Minute, mr.TTL("note:7"))
+	assert.Equal(t, testNote{ID: 1, Title: "7"}, r.GetValue("note:{id}", 7))
+	assert.Equal(t, 1, calls)
+
+	mr.FastForward(2 * time.Minute)
+	assert.Equal(t, testNote{ID: 2, Title: "7"}, r.GetValue("note:{id}", 7))
+
+	// truncate清理redis中该模板的所有key
+	r.GetValue("note:{id}", 8)
+	r.Trigger(&testLog{table: "notes", label: "truncate"})
+	assert.False(t, mr.Exists("note:7"))
+	assert.False(t, mr.Exists("note:8"))
+}
+
+// InitRedisCache与之前的版本相同，没有设置TTL的key在5秒后过期
+func TestInitRedisCacheTTL(t *testing.T) {
+	mr, client := newTestRedis(t)
+	r := NewRepo(nil)
+	r.InitRedisCache(client)
+	r.Register(&Policy{Key: "notes", Table: "notes", Field: "*", Call: func() interface{} { return "a" }})
+	r.Register(&Policy{Key: "users", Table: "users", Field: "*", TTL: -1, Call: func() interface{} { return "b" }})
+
+	assert.Equal(t, "a", r.GetValue("notes"))
+	assert.Equal(t, legacyRedisTTL, mr.TTL("notes"))
+	assert.Equal(t, "b", r.GetValue("users"))
+	assert.Equal(t, time.Duration(0), mr.TTL("users"))
+
+	require.NoError(t, r.SetValueV2("legacy", "c"))
+	assert.Equal(t, legacyRedisTTL, mr.TTL("legacy"))
+}
@@ -0,0 +1,57 @@
+package datamanager
+
+// CacheMode 事件触发时缓存的更新方式
+type CacheMode int
+
+const (
+	ModeEager                CacheMode = iota // 同步重新计算，Trigger在计算完成后返回
+	ModeInvalidate                            // 删除缓存，下次GetValue时重新计算
+	ModeStaleWhileRevalidate                  // 后台重新计算，完成前GetValue返回旧值
+)
+
+// flight 一个key正在进行的计算
+// 计算期间再次触发时只标记dirty，当前计算完成后再计算一次，写入突发时每个key最多有一个排队的计算
+type flight struct {
+	dirty bool
+	value interface{}
+	done  chan struct{}
+}
+
+// recompute 计算key的数据，同一个key正在计算时合并到该次计算
+// changed为true表示数据在计算开始后发生了变化(事件触发)，需要再计算一次，GetValue只等待当前的计算
+// async为false时在调用方的goroutine中计算，返回时已经完成
+func (r *Repo) recompute(policy *Policy, key string, params map[string]string, changed, async bool) *flight {
+	r.flightMu.Lock()
+	if f, ok := r.flights[key]; ok {
+		if changed {
+			f.dirty = true
+		}
+		r.flightMu.Unlock()
+		return f
+	}
+	f := &flight{done: make(chan struct{})}
+	r.flights[key] = f
+	r.flightMu.Unlock()
+
+	run := func() {
+		for {
+			v := r.refresh(policy, key, params)
+			r.flightMu.Lock()
+			f.value = v
+			if !f.dirty {
+				delete(r.flights, key)
+				r.flightMu.Unlock()
+				close(f.done)
+				return
+			}
+			f.dirty = false
+			r.flightMu.Unlock()
+		}
+	}
+	if async {
+		go run()
+	} else {
+		run()
+	}
+	return f
+}
@@ -0,0 +1,109 @@
+package datamanager
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet"
+)
+
+func TestCacheModeInvalidate(t *testing.T) {
+	var calls int32
+	r := NewRepo(nil)
+	r.Register(&Policy{Key: "cacheA", Table: "table1", Field: "*", Mode: ModeInvalidate, Call: func() interface{} {
+		return atomic.AddInt32(&calls, 1)
+	}})
+	require.Equal(t, int32(1), r.GetValue("cacheA"))
+
+	// 触发时不计算，下次读取时计算
+	r.Trigger(&testLog{table: "table1"})
+	r.Trigger(&testLog{table: "table1"})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Equal(t, int32(2), r.GetValue("cacheA"))
+	require.Equal(t, int32(2), r.GetValue("cacheA"))
+}
+
+func TestCacheModeStaleWhileRevalidate(t *testing.T) {
+	var (
+		calls   int32
+		release = make(chan struct{})
+	)
+	r := NewRepo(nil)
+	r.Register(&Policy{Key: "cacheA", Table: "table1", Field: "*", Mode: ModeStaleWhileRevalidate, Call: func() interface{} {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			<-release
+		}
+		return n
+	}})
+	require.Equal(t, int32(1), r.GetValue("cacheA"))
+
+	// 后台计算期间返回旧值，期间的触发合并为一次计算
+	for i := 0; i < 10; i++ {
+		r.Trigger(&testLog{table: "table1"})
+	}
+	assert.Equal(t, int32(1), r.GetValue("cacheA"))
+	close(release)
+	require.Eventually(t, func() bool {
+		return r.GetValue("cacheA") == int32(3)
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+// 并发读取未缓存的key只计算一次
+func TestCacheGetValueCoalesce(t *testing.T) {
+	var (
+		calls   int32
+		release = make(chan struct{})
+	)
+	r := NewRepo(nil)
+	r.Register(&Policy{Key: "note:{id}", Table: "notes", Field: "*", Load: func(params map[string]string) interface{} {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return params["id"]
+	}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "1", r.GetValue("note:{id}", 1))
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// 已经到达的事件一起处理，每个key只计算一次
+func TestCacheNotifyBurst(t *testing.T) {
+	var calls int32
+	ch := make(chan dialet.ILogData, 100)
+	r := NewRepo(ch)
+	r.Register(&Policy{Key: "cacheA", Table: "table1", Field: "*", Call: func() interface{} {
+		return atomic.AddInt32(&calls, 1)
+	}})
+	require.Equal(t, int32(1), r.GetValue("cacheA"))
+
+	for i := 0; i < cap(ch); i++ {
+		ch <- &testLog{table: "table1"}
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go r.Notify(ctx)
+	require.Eventually(t, func() bool {
+		return len(ch) == 0 && r.GetValue("cacheA") == int32(2)
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
@@ -1,6 +1,11 @@
 package main
 
-import "github.com/gin-gonic/gin"
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wwqdrh/datamanager"
+	"github.com/wwqdrh/datamanager/dialet/postgres"
+	"github.com/wwqdrh/datamanager/feed"
+)
 
 func InitRouter(engine *gin.Engine) {
 	engine.GET("/health", func(ctx *gin.Context) {
@@ -10,6 +15,18 @@ func InitRouter(engine *gin.Engine) {
 	engine.GET("/unregister", UnRegister)
 	engine.GET("/search", Search)
 	engine.POST("/callback", AddCallback)
+	engine.GET("/callback", ListCallbacks)
+	engine.PUT("/callback", UpdateCallback)
+	engine.DELETE("/callback", DeleteCallback)
+	engine.GET("/redaction", ListRedactions)
+	engine.GET("/stream/sse", StreamSSE)
+	engine.GET("/stream/ws", StreamWS)
+	engine.POST("/redaction", SetRedaction)
+	engine.GET("/events", ListEvents)
+	engine.GET("/consumers", ListConsumers)
+	engine.POST("/consumers/rewind", RewindConsumer)
+	engine.GET("/deadletters", ListDeadLetters)
+	engine.POST("/deadletters/redrive", RedriveDeadLetter)
 }
 
 func Register(ctx *gin.Context) {
@@ -19,8 +36,14 @@ func Register(ctx *gin.Context) {
 		return
 	}
 
+	if registry == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
 	if err := dialet.Register(table); err != nil {
 		ctx.String(200, err.Error())
+	} else if err := registry.AddTable(table); err != nil {
+		ctx.String(200, err.Error())
 	} else {
 		ctx.String(200, "注册成功")
 	}
@@ -33,8 +56,14 @@ func UnRegister(ctx *gin.Context) {
 		return
 	}
 
+	if registry == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
 	if err := dialet.UnRegister(table); err != nil {
 		ctx.String(200, err.Error())
+	} else if err := registry.RemoveTable(table); err != nil {
+		ctx.String(200, err.Error())
 	} else {
 		ctx.String(200, "取消成功")
 	}
@@ -64,18 +93,250 @@ func Search(ctx *gin.Context) {
 	}
 }
 
-type AddCallbackReq struct {
-	Table string `json:"table" form:"table"`
-	Url   string `json:"url" form:"url"`
+type CallbackReq struct {
+	ID         string   `json:"id" form:"id"` // 修改时必传
+	Table      string   `json:"table" form:"table"`
+	Url        string   `json:"url" form:"url"`
+	Secret     string   `json:"secret" form:"secret"`         // 可选，非空时回调请求携带签名
+	Operations []string `json:"operations" form:"operations"` // 可选，insert update delete truncate
+	Columns    []string `json:"columns" form:"columns"`       // 可选，任意一列变化时投递
+	Where      []string `json:"where" form:"where"`           // 可选，例如 status = 'paid'
 }
 
+func (r *CallbackReq) options() []datamanager.CallbackOption {
+	opts := []datamanager.CallbackOption{
+		datamanager.WithOperations(r.Operations...),
+		datamanager.WithColumns(r.Columns...),
+		datamanager.WithWhere(r.Where...),
+	}
+	if r.Secret != "" {
+		opts = append(opts, datamanager.WithSecret(r.Secret))
+	}
+	return opts
+}
+
+// 添加回调订阅，返回订阅id
 func AddCallback(ctx *gin.Context) {
-	var r AddCallbackReq
+	var r CallbackReq
+	if err := ctx.ShouldBindJSON(&r); err != nil {
+		ctx.String(400, "请传入table以及url")
+		return
+	}
+
+	if watcher == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	id, err := watcher.Subscribe(r.Table, r.Url, r.options()...)
+	if err != nil {
+		ctx.String(400, err.Error())
+		return
+	}
+	ctx.JSON(200, gin.H{"id": id})
+}
+
+// 查看回调订阅，可以通过table过滤
+func ListCallbacks(ctx *gin.Context) {
+	if watcher == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	ctx.JSON(200, watcher.Subscriptions(ctx.Query("table")))
+}
+
+// 使用新的配置替换回调订阅
+func UpdateCallback(ctx *gin.Context) {
+	var r CallbackReq
+	if err := ctx.ShouldBindJSON(&r); err != nil || r.ID == "" {
+		ctx.String(400, "请传入id、table以及url")
+		return
+	}
+
+	if watcher == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if err := watcher.Update(r.ID, r.Table, r.Url, r.options()...); err == datamanager.ErrSubscriptionNotFound {
+		ctx.String(404, "订阅不存在")
+	} else if err != nil {
+		ctx.String(400, err.Error())
+	} else {
+		ctx.String(200, "ok")
+	}
+}
+
+func DeleteCallback(ctx *gin.Context) {
+	id := ctx.Query("id")
+	if id == "" {
+		ctx.String(400, "请传入id")
+		return
+	}
+
+	if watcher == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if err := watcher.Unsubscribe(id); err != nil {
+		ctx.String(404, "订阅不存在")
+	} else {
+		ctx.String(200, "ok")
+	}
+}
+
+type ListEventsReq struct {
+	From  int64 `json:"from" form:"from"`
+	Limit int   `json:"limit" form:"limit"`
+}
+
+// 读取事件日志中序号大于from的事件
+func ListEvents(ctx *gin.Context) {
+	r := ListEventsReq{Limit: 100}
+	if err := ctx.ShouldBindQuery(&r); err != nil {
+		ctx.String(400, "请传入from、limit")
+		return
+	}
+
+	if eventlog == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if data, err := eventlog.Read(r.From, r.Limit); err != nil {
+		ctx.String(200, err.Error())
+	} else {
+		ctx.JSON(200, data)
+	}
+}
+
+// 查看所有消费者的offset
+func ListConsumers(ctx *gin.Context) {
+	if eventlog == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if data, err := eventlog.Consumers(); err != nil {
+		ctx.String(200, err.Error())
+	} else {
+		ctx.JSON(200, data)
+	}
+}
+
+type RewindConsumerReq struct {
+	Name string `json:"name" form:"name" binding:"required"`
+	Seq  int64  `json:"seq" form:"seq"`
+}
+
+// 将消费者的offset设置为seq，之后的事件会被重新消费
+func RewindConsumer(ctx *gin.Context) {
+	var r RewindConsumerReq
+	if err := ctx.ShouldBindJSON(&r); err != nil {
+		ctx.String(400, "请传入name以及seq")
+		return
+	}
+
+	if eventlog == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if err := eventlog.Rewind(r.Name, r.Seq); err != nil {
+		ctx.String(200, err.Error())
+	} else {
+		ctx.String(200, "ok")
+	}
+}
+
+// 查看重试耗尽的回调
+func ListDeadLetters(ctx *gin.Context) {
+	if watcher == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if data, err := watcher.DeadLetters(); err != nil {
+		ctx.String(200, err.Error())
+	} else {
+		ctx.JSON(200, data)
+	}
+}
+
+type RedriveDeadLetterReq struct {
+	ID string `json:"id" form:"id" binding:"required"`
+}
+
+// 重新投递死信，成功后删除
+func RedriveDeadLetter(ctx *gin.Context) {
+	var r RedriveDeadLetterReq
+	if err := ctx.ShouldBindJSON(&r); err != nil {
+		ctx.String(400, "请传入id")
+		return
+	}
+
+	if watcher == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if err := watcher.Redrive(ctx.Request.Context(), r.ID); err != nil {
+		ctx.String(200, err.Error())
+	} else {
+		ctx.String(200, "ok")
+	}
+}
+
+// 查看脱敏规则
+func ListRedactions(ctx *gin.Context) {
+	if registry == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if data, err := registry.Redactions(); err != nil {
+		ctx.String(200, err.Error())
+	} else {
+		ctx.JSON(200, data)
+	}
+}
+
+type SetRedactionReq struct {
+	Schema string   `json:"schema" form:"schema" binding:"required"`
+	Table  string   `json:"table" form:"table" binding:"required"`
+	Fields []string `json:"fields" form:"fields"` // 为空时删除该表的规则
+}
+
+// 设置表需要脱敏的字段，立即生效并持久化
+func SetRedaction(ctx *gin.Context) {
+	var r SetRedactionReq
 	if err := ctx.ShouldBindJSON(&r); err != nil {
-		ctx.String(400, "请传入table、url以及table")
+		ctx.String(400, "请传入schema、table以及fields")
 		return
 	}
 
-	watcher.Register(r.Table, r.Url)
+	if registry == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	if err := registry.SetRedaction(r.Schema, r.Table, r.Fields); err != nil {
+		ctx.String(200, err.Error())
+		return
+	}
+	data, err := registry.Redactions()
+	if err != nil {
+		ctx.String(200, err.Error())
+		return
+	}
+	dialet.Stream().SetFieldRedactions(postgres.FieldRedactions(data))
 	ctx.String(200, "ok")
 }
+
+// 实时推送事件日志中的变更，参数见feed包
+func StreamSSE(ctx *gin.Context) {
+	if eventlog == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	feed.New(eventlog).ServeSSE(ctx.Writer, ctx.Request)
+}
+
+func StreamWS(ctx *gin.Context) {
+	if eventlog == nil {
+		ctx.String(500, "未初始化完成，稍后重试")
+		return
+	}
+	feed.New(eventlog).ServeWS(ctx.Writer, ctx.Request)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/wwqdrh/datamanager"
+	"github.com/wwqdrh/datamanager/dialet/postgres"
+	"github.com/wwqdrh/logger"
+	"google.golang.org/grpc"
+)
+
+// registrySource 通过gRPC注册的表同样写入registry，重启后恢复
+type registrySource struct {
+	*postgres.PostgresDialet
+	registry *datamanager.Registry
+}
+
+func (s *registrySource) Register(table string) error {
+	if err := s.PostgresDialet.Register(table); err != nil {
+		return err
+	}
+	return s.registry.AddTable(table)
+}
+
+func (s *registrySource) UnRegister(table string) error {
+	if err := s.PostgresDialet.UnRegister(table); err != nil {
+		return err
+	}
+	return s.registry.RemoveTable(table)
+}
+
+// grpcServer 提供Listen流式订阅以及Register/UnRegister
+func grpcServer(ctx context.Context, source postgres.Source) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *grpcPort))
+	if err != nil {
+		logger.DefaultLogger.Error(err.Error())
+		return
+	}
+	srv := grpc.NewServer()
+	postgres.RegisterPQStreamServer(srv, postgres.NewGRPCServer(source))
+
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	logger.DefaultLogger.Info(fmt.Sprintf("grpc :%d: is start", *grpcPort))
+	if err := srv.Serve(lis); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
+}
@@ -0,0 +1,144 @@
+package datamanager
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 死信存储的实现: 内存以及基于database/sql(sqlite)的持久化存储
+
+type MemoryDeadLetters struct {
+	mu   sync.RWMutex
+	data map[string]*DeadLetter
+}
+
+func NewMemoryDeadLetters() *MemoryDeadLetters {
+	return &MemoryDeadLetters{
+		data: map[string]*DeadLetter{},
+	}
+}
+
+func (m *MemoryDeadLetters) Save(dl *DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp := *dl
+	m.data[dl.ID] = &cp
+	return nil
+}
+
+func (m *MemoryDeadLetters) Get(id string) (*DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dl, ok := m.data[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	cp := *dl
+	return &cp, nil
+}
+
+func (m *MemoryDeadLetters) List() ([]*DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := make([]*DeadLetter, 0, len(m.data))
+	for _, dl := range m.data {
+		cp := *dl
+		res = append(res, &cp)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+func (m *MemoryDeadLetters) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, id)
+	return nil
+}
+
+var (
+	deadLetterCreate = `
+	CREATE TABLE IF NOT EXISTS deadletters (
+		id         TEXT PRIMARY KEY,
+		event_id   TEXT,
+		sub_id     TEXT,
+		url        TEXT,
+		tbl        TEXT,
+		body       BLOB,
+		attempts   INTEGER,
+		last_error TEXT,
+		created_at INTEGER
+	);
+	`
+
+	deadLetterSave = `
+	INSERT OR REPLACE INTO deadletters (id, event_id, sub_id, url, tbl, body, attempts, last_error, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	deadLetterColumns = `SELECT id, event_id, sub_id, url, tbl, body, attempts, last_error, created_at FROM deadletters`
+
+	deadLetterDelete = `DELETE FROM deadletters WHERE id = ?`
+)
+
+// SqlDeadLetters 持久化的死信存储，db可以通过transport/sqlite的SqliteDriver获取
+type SqlDeadLetters struct {
+	db *sql.DB
+}
+
+func NewSqlDeadLetters(db *sql.DB) (*SqlDeadLetters, error) {
+	if _, err := db.Exec(deadLetterCreate); err != nil {
+		return nil, err
+	}
+	return &SqlDeadLetters{db: db}, nil
+}
+
+func (s *SqlDeadLetters) Save(dl *DeadLetter) error {
+	_, err := s.db.Exec(deadLetterSave, dl.ID, dl.EventID, dl.Subscription, dl.URL, dl.Table, dl.Body, dl.Attempts, dl.LastError, dl.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *SqlDeadLetters) Get(id string) (*DeadLetter, error) {
+	res, err := s.query(deadLetterColumns+" WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return res[0], nil
+}
+
+func (s *SqlDeadLetters) List() ([]*DeadLetter, error) {
+	return s.query(deadLetterColumns + " ORDER BY created_at")
+}
+
+func (s *SqlDeadLetters) Delete(id string) error {
+	_, err := s.db.Exec(deadLetterDelete, id)
+	return err
+}
+
+func (s *SqlDeadLetters) query(q string, args ...interface{}) ([]*DeadLetter, error) {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*DeadLetter{}
+	for rows.Next() {
+		var (
+			dl        DeadLetter
+			createdAt int64
+		)
+		if err := rows.Scan(&dl.ID, &dl.EventID, &dl.Subscription, &dl.URL, &dl.Table, &dl.Body, &dl.Attempts, &dl.LastError, &createdAt); err != nil {
+			return nil, err
+		}
+		dl.CreatedAt = time.Unix(0, createdAt)
+		res = append(res, &dl)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,284 @@
+package datamanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/webhook"
+)
+
+// 可靠的回调投递: 超时、指数退避重试、非2xx视为失败，重试耗尽后写入死信
+
+const (
+	defaultTimeout    = 5 * time.Second
+	defaultMaxRetries = 3
+	defaultBackoff    = 500 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// Callback 一个回调订阅: 回调地址、投递配置以及过滤条件
+type Callback struct {
+	ID        string        `json:"id"`
+	Table     string        `json:"table"`
+	URL       string        `json:"url"`
+	Timeout   time.Duration `json:"timeout"` // 0使用watcher的默认超时
+	Secret    string        `json:"-"`       // 非空时对请求签名，接收方使用webhook包校验
+	Filter    Filter        `json:"filter"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+type CallbackOption func(*Callback)
+
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+func newCallback(id, table, url string, opts ...CallbackOption) (*Callback, error) {
+	if table == "" || url == "" {
+		return nil, errors.New("table and url are required")
+	}
+	cb := &Callback{ID: id, Table: table, URL: url, CreatedAt: time.Now()}
+	for _, o := range opts {
+		o(cb)
+	}
+	if err := cb.Filter.compile(); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// WithTimeout 该回调地址的请求超时
+func WithTimeout(d time.Duration) CallbackOption {
+	return func(c *Callback) {
+		c.Timeout = d
+	}
+}
+
+// WithSecret 使用secret对回调请求进行HMAC签名
+func WithSecret(secret string) CallbackOption {
+	return func(c *Callback) {
+		c.Secret = secret
+	}
+}
+
+// DeadLetter 重试耗尽的投递
+type DeadLetter struct {
+	ID           string    `json:"id"`
+	EventID      string    `json:"event_id"` // 重新投递时保持不变，接收方据此去重
+	Subscription string    `json:"subscription"`
+	URL          string    `json:"url"`
+	Table        string    `json:"table"`
+	Body         []byte    `json:"body"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"last_error"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DeadLetterStore 死信存储
+type DeadLetterStore interface {
+	Save(*DeadLetter) error
+	Get(id string) (*DeadLetter, error)
+	List() ([]*DeadLetter, error)
+	Delete(id string) error
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+type WatcherOption func(*Watcher)
+
+// WithHTTPClient 发送回调使用的http客户端
+func WithHTTPClient(client *http.Client) WatcherOption {
+	return func(w *Watcher) {
+		w.client = client
+	}
+}
+
+// WithDefaultTimeout 回调未单独配置超时时使用
+func WithDefaultTimeout(d time.Duration) WatcherOption {
+	return func(w *Watcher) {
+		w.timeout = d
+	}
+}
+
+// WithRetry 失败后最多重试maxRetries次，间隔从backoff开始翻倍，不超过maxBackoff
+func WithRetry(maxRetries int, backoff, maxBackoff time.Duration) WatcherOption {
+	return func(w *Watcher) {
+		w.maxRetries = maxRetries
+		w.backoff = backoff
+		w.maxBackoff = maxBackoff
+	}
+}
+
+// WithTransactions dialet支持时按事务投递，每个订阅在事务提交后收到一次回调，包含事务中匹配的全部事件
+func WithTransactions() WatcherOption {
+	return func(w *Watcher) {
+		w.transactions = true
+	}
+}
+
+// WithDeadLetterStore 重试耗尽的投递写入store，默认为内存存储
+func WithDeadLetterStore(store DeadLetterStore) WatcherOption {
+	return func(w *Watcher) {
+		w.deadLetters = store
+	}
+}
+
+// deliver 发送回调，失败按指数退避重试，重试耗尽后写入死信
+// 同一事件的所有尝试使用相同的事件ID
+func (w *Watcher) deliver(ctx context.Context, cb *Callback, table string, body []byte) error {
+	eventID := uuid.NewString()
+	attempts, err := w.send(ctx, cb, eventID, body)
+	if err == nil {
+		return nil
+	}
+	return w.deadLetter(cb, eventID, table, body, attempts, err)
+}
+
+// deadLetter 保存死信并返回投递的错误，eventID为空时生成新的事件ID
+func (w *Watcher) deadLetter(cb *Callback, eventID, table string, body []byte, attempts int, err error) error {
+	if eventID == "" {
+		eventID = uuid.NewString()
+	}
+	dl := &DeadLetter{
+		ID:           uuid.NewString(),
+		EventID:      eventID,
+		Subscription: cb.ID,
+		URL:          cb.URL,
+		Table:        table,
+		Body:         body,
+		Attempts:     attempts,
+		LastError:    err.Error(),
+		CreatedAt:    time.Now(),
+	}
+	if serr := w.deadLetters.Save(dl); serr != nil {
+		return saveDeadLetterError{errors.Wrap(serr, "save dead letter")}
+	}
+	return err
+}
+
+// saveDeadLetterError 投递失败且死信没有保存，事件没有任何记录
+type saveDeadLetterError struct {
+	error
+}
+
+func isSaveDeadLetter(err error) bool {
+	_, ok := err.(saveDeadLetterError)
+	return ok
+}
+
+// send 返回尝试次数以及最后一次的错误
+func (w *Watcher) send(ctx context.Context, cb *Callback, eventID string, body []byte) (int, error) {
+	backoff := w.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = w.post(ctx, cb, eventID, body); err == nil {
+			return attempt + 1, nil
+		}
+		if attempt >= w.maxRetries {
+			return attempt + 1, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt + 1, err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// post 每次请求使用当前时间重新签名
+func (w *Watcher) post(ctx context.Context, cb *Callback, eventID string, body []byte) error {
+	timeout := cb.Timeout
+	if timeout <= 0 {
+		timeout = w.timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cb.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	req.Header.Set("Content-Type", "application/json")
+	webhook.SetHeaders(req.Header, cb.Secret, time.Now(), eventID, body)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback %s response status %d", cb.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// WithRegistry 订阅的修改写入registry，通过Watcher.Restore在重启后恢复
+func WithRegistry(r *Registry) WatcherOption {
+	return func(w *Watcher) {
+		w.registry = r
+	}
+}
+
+// DeadLetters 查看所有死信
+func (w *Watcher) DeadLetters() ([]*DeadLetter, error) {
+	return w.deadLetters.List()
+}
+
+// Redrive 重新投递死信，成功后删除，失败则更新尝试次数与错误
+// 订阅已经删除时返回ErrSubscriptionNotFound，死信保留，避免丢失签名后发送未签名的请求
+func (w *Watcher) Redrive(ctx context.Context, id string) error {
+	dl, err := w.deadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+	cb, err := w.registered(dl)
+	if err != nil {
+		return err
+	}
+
+	eventID := dl.EventID
+	if eventID == "" {
+		eventID = dl.ID
+	}
+	attempts, err := w.send(ctx, cb, eventID, dl.Body)
+	if err == nil {
+		return w.deadLetters.Delete(id)
+	}
+	dl.Attempts += attempts
+	dl.LastError = err.Error()
+	if serr := w.deadLetters.Save(dl); serr != nil {
+		return errors.Wrap(serr, "save dead letter")
+	}
+	return err
+}
+
+// registered 重新投递时使用订阅当前的配置(超时、密钥)，地址已修改时发送到死信中的地址
+// 不属于订阅的死信(例如HTTPPost)没有密钥，只使用死信中的地址
+func (w *Watcher) registered(dl *DeadLetter) (*Callback, error) {
+	if dl.Subscription == "" {
+		return &Callback{Table: dl.Table, URL: dl.URL}, nil
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	cb, ok := w.cb[dl.Subscription]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	if cb.URL != dl.URL {
+		c := *cb
+		c.URL = dl.URL
+		return &c, nil
+	}
+	return cb, nil
+}
@@ -0,0 +1,296 @@
+package datamanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/transport/sqlite"
+	"github.com/wwqdrh/datamanager/webhook"
+)
+
+// flakyServer 前failures次请求返回500
+func flakyServer(failures int32) (*httptest.Server, *int32) {
+	var count int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return srv, &count
+}
+
+func newTestWatcher(opts ...WatcherOption) *Watcher {
+	return NewWatcher(nil, append([]WatcherOption{
+		WithRetry(2, time.Millisecond, 4*time.Millisecond),
+	}, opts...)...)
+}
+
+func TestDeliverRetry(t *testing.T) {
+	srv, count := flakyServer(2)
+	defer srv.Close()
+
+	w := newTestWatcher()
+	require.Nil(t, w.deliver(context.TODO(), &Callback{URL: srv.URL}, "notes", []byte(`{}`)))
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+
+	dls, err := w.DeadLetters()
+	require.Nil(t, err)
+	assert.Empty(t, dls)
+}
+
+func TestDeliverDeadLetterAndRedrive(t *testing.T) {
+	srv, count := flakyServer(3)
+	defer srv.Close()
+
+	w := newTestWatcher()
+	err := w.deliver(context.TODO(), &Callback{URL: srv.URL}, "notes", []byte(`{"table":"notes"}`))
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+
+	dls, err := w.DeadLetters()
+	require.Nil(t, err)
+	require.Len(t, dls, 1)
+	assert.Equal(t, srv.URL, dls[0].URL)
+	assert.Equal(t, 3, dls[0].Attempts)
+	assert.Contains(t, dls[0].LastError, "500")
+	assert.Equal(t, `{"table":"notes"}`, string(dls[0].Body))
+
+	// 服务恢复后重新投递
+	require.Nil(t, w.Redrive(context.TODO(), dls[0].ID))
+	dls, err = w.DeadLetters()
+	require.Nil(t, err)
+	assert.Empty(t, dls)
+	assert.Equal(t, ErrDeadLetterNotFound, w.Redrive(context.TODO(), "unknown"))
+}
+
+func TestDeliverTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	w := newTestWatcher(WithRetry(0, time.Millisecond, time.Millisecond))
+	start := time.Now()
+	err := w.deliver(context.TODO(), &Callback{URL: srv.URL, Timeout: 20 * time.Millisecond}, "notes", []byte(`{}`))
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+// 死信持久化，重启后依然可以重新投递
+func TestSqlDeadLetters(t *testing.T) {
+	driver, err := sqlite.NewDriver(filepath.Join(t.TempDir(), "deadletter.db"))
+	require.Nil(t, err)
+	defer driver.DB().Close()
+	store, err := NewSqlDeadLetters(driver.DB())
+	require.Nil(t, err)
+
+	srv, _ := flakyServer(100)
+	defer srv.Close()
+	w := newTestWatcher(WithDeadLetterStore(store))
+	assert.NotNil(t, w.deliver(context.TODO(), &Callback{URL: srv.URL}, "notes", []byte(`{}`)))
+
+	store, err = NewSqlDeadLetters(driver.DB())
+	require.Nil(t, err)
+	dls, err := store.List()
+	require.Nil(t, err)
+	require.Len(t, dls, 1)
+
+	w = newTestWatcher(WithDeadLetterStore(store))
+	assert.NotNil(t, w.Redrive(context.TODO(), dls[0].ID))
+	dl, err := store.Get(dls[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, 6, dl.Attempts)
+
+	require.Nil(t, store.Delete(dl.ID))
+	_, err = store.Get(dl.ID)
+	assert.Equal(t, ErrDeadLetterNotFound, err)
+}
+
+// 签名的回调，接收方使用webhook.Verifier校验，重试使用相同的事件ID
+func TestDeliverSigned(t *testing.T) {
+	verifier := webhook.NewVerifier("s3cret", time.Minute)
+	var (
+		count int32
+		mu    sync.Mutex
+		ids   []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.Header.Get(webhook.HeaderEventID))
+		mu.Unlock()
+		if _, err := verifier.Verify(r); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// 第一次校验通过但返回失败，重试时事件ID相同会被视为重放
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	w := newTestWatcher()
+	id, err := w.Subscribe("notes", srv.URL, WithSecret("s3cret"))
+	require.Nil(t, err)
+	cb, err := w.Subscription(id)
+	require.Nil(t, err)
+	assert.NotNil(t, w.deliver(context.TODO(), cb, "notes", []byte(`{}`)))
+	mu.Lock()
+	require.Len(t, ids, 3)
+	first := ids[0]
+	for _, id := range ids {
+		assert.Equal(t, first, id)
+	}
+	mu.Unlock()
+
+	dls, err := w.DeadLetters()
+	require.Nil(t, err)
+	require.Len(t, dls, 1)
+	assert.Equal(t, first, dls[0].EventID)
+	assert.Equal(t, id, dls[0].Subscription)
+
+	// 错误的密钥
+	require.Nil(t, w.Update(id, "notes", srv.URL, WithSecret("wrong")))
+	dls[0].EventID = "another"
+	require.Nil(t, w.deadLetters.Save(dls[0]))
+	assert.Contains(t, w.Redrive(context.TODO(), dls[0].ID).Error(), "401")
+}
+
+// 订阅删除后不能重新投递，避免发送未签名的请求
+func TestRedriveDeletedSubscription(t *testing.T) {
+	srv, count := flakyServer(100)
+	defer srv.Close()
+
+	w := newTestWatcher()
+	id, err := w.Subscribe("notes", srv.URL, WithSecret("s3cret"))
+	require.Nil(t, err)
+	cb, err := w.Subscription(id)
+	require.Nil(t, err)
+	require.NotNil(t, w.deliver(context.TODO(), cb, "notes", []byte(`{}`)))
+	dls, err := w.DeadLetters()
+	require.Nil(t, err)
+	require.Len(t, dls, 1)
+
+	require.Nil(t, w.Unsubscribe(id))
+	sent := atomic.LoadInt32(count)
+	assert.Equal(t, ErrSubscriptionNotFound, w.Redrive(context.TODO(), dls[0].ID))
+	assert.Equal(t, sent, atomic.LoadInt32(count))
+	_, err = w.deadLetters.Get(dls[0].ID)
+	assert.Nil(t, err)
+}
+
+// 慢的订阅不阻塞其它订阅，队列满时写入死信
+func TestDeliverSlowSubscription(t *testing.T) {
+	var started int32
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&started, 1)
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast, count := flakyServer(0)
+	defer fast.Close()
+
+	w := newTestWatcher(WithQueueSize(2), WithDefaultTimeout(10*time.Second))
+	_, err := w.Subscribe("notes", slow.URL)
+	require.Nil(t, err)
+	_, err = w.Subscribe("notes", fast.URL)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	ch := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		w.NotifyFrom(ctx, ch)
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		ch <- &sqlite.Entry{Table: "notes", Label: "insert", Payload: map[string]interface{}{"id": float64(i)}}
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(count) == int32(i+1) && atomic.LoadInt32(&started) == 1
+		}, 3*time.Second, time.Millisecond)
+	}
+
+	// 第一个事件正在投递，队列中两个，剩余两个写入死信
+	dls, err := w.DeadLetters()
+	require.Nil(t, err)
+	require.Len(t, dls, 2)
+	for _, dl := range dls {
+		assert.Equal(t, slow.URL, dl.URL)
+		assert.Equal(t, errQueueFull.Error(), dl.LastError)
+	}
+
+	cancel()
+	<-done
+}
+
+type ackEntry struct {
+	*sqlite.Entry
+	acked chan struct{}
+}
+
+func (e *ackEntry) Ack() { close(e.acked) }
+
+// 所有订阅投递成功或者写入死信之后才确认事件
+func TestNotifyFromAck(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	failing, _ := flakyServer(100)
+	defer failing.Close()
+
+	w := newTestWatcher()
+	_, err := w.Subscribe("notes", slow.URL)
+	require.Nil(t, err)
+	_, err = w.Subscribe("notes", failing.URL)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	ch := make(chan interface{})
+	go w.NotifyFrom(ctx, ch)
+
+	e := &ackEntry{Entry: &sqlite.Entry{Table: "notes", Label: "insert"}, acked: make(chan struct{})}
+	ch <- e
+	// 失败的订阅写入死信，慢的订阅仍在投递
+	require.Eventually(t, func() bool {
+		dls, err := w.DeadLetters()
+		return err == nil && len(dls) == 1
+	}, 3*time.Second, time.Millisecond)
+	select {
+	case <-e.acked:
+		t.Fatal("acked before delivery")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-e.acked:
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait ack timeout")
+	}
+
+	// 没有匹配的订阅时直接确认
+	e = &ackEntry{Entry: &sqlite.Entry{Table: "users", Label: "insert"}, acked: make(chan struct{})}
+	ch <- e
+	select {
+	case <-e.acked:
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait ack timeout")
+	}
+}
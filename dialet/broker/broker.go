@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// 将一个变更事件流分发给多个订阅者，每个订阅者都能收到全部事件
+// 每个订阅者有独立的缓冲区，缓冲区满时根据Policy处理慢消费者
+
+type Policy int
+
+const (
+	Block      Policy = iota // 阻塞发布者，直到订阅者有空间
+	DropOldest               // 丢弃订阅者缓冲区中最旧的事件
+	Disconnect               // 断开订阅者，关闭其channel
+)
+
+const defaultBuffer = 8
+
+type options struct {
+	buffer int
+	policy Policy
+}
+
+type Option func(*options)
+
+// WithBuffer 订阅者的缓冲区大小
+func WithBuffer(n int) Option {
+	return func(o *options) {
+		o.buffer = n
+	}
+}
+
+// WithPolicy 慢消费者的处理策略
+func WithPolicy(p Policy) Option {
+	return func(o *options) {
+		o.policy = p
+	}
+}
+
+type Broker struct {
+	opts options
+
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// New opts为订阅者的默认配置
+func New(opts ...Option) *Broker {
+	b := &Broker{
+		opts: options{buffer: defaultBuffer, policy: Block},
+		subs: map[*Subscription]struct{}{},
+	}
+	for _, o := range opts {
+		o(&b.opts)
+	}
+	return b
+}
+
+type Subscription struct {
+	b       *Broker
+	opts    options
+	ch      chan interface{}
+	done    chan struct{}
+	stopped sync.Once
+	closed  sync.Once
+	dropped uint64
+}
+
+// Subscribe 创建订阅者，opts覆盖broker的默认配置
+func (b *Broker) Subscribe(opts ...Option) *Subscription {
+	s := &Subscription{
+		b:    b,
+		opts: b.opts,
+		done: make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(&s.opts)
+	}
+	s.ch = make(chan interface{}, s.opts.buffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		s.stop()
+		s.closed.Do(func() {
+			close(s.ch)
+		})
+		return s
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// SubscribeContext ctx结束时自动取消订阅
+func (b *Broker) SubscribeContext(ctx context.Context, opts ...Option) *Subscription {
+	s := b.Subscribe(opts...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// Len 当前订阅者数量
+func (b *Broker) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+// Publish 将事件发送给所有订阅者，Block策略下会等待慢消费者直到ctx结束
+func (b *Broker) Publish(ctx context.Context, event interface{}) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs {
+		s.send(ctx, event)
+	}
+}
+
+// Close 关闭所有订阅者
+func (b *Broker) Close() {
+	b.mu.Lock()
+	b.closed = true
+	subs := b.subs
+	b.subs = map[*Subscription]struct{}{}
+	b.mu.Unlock()
+
+	for s := range subs {
+		s.stop()
+		s.closed.Do(func() {
+			close(s.ch)
+		})
+	}
+}
+
+// C 事件channel，取消订阅后会被关闭
+func (s *Subscription) C() chan interface{} {
+	return s.ch
+}
+
+// Dropped DropOldest策略下丢弃的事件数
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Done 订阅取消后关闭
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close 取消订阅
+func (s *Subscription) Close() {
+	// 先通知阻塞中的发布者退出，再在写锁下关闭channel
+	s.stop()
+	s.closed.Do(func() {
+		s.b.mu.Lock()
+		defer s.b.mu.Unlock()
+		delete(s.b.subs, s)
+		close(s.ch)
+	})
+}
+
+// stop 停止向订阅者发送事件
+func (s *Subscription) stop() {
+	s.stopped.Do(func() {
+		close(s.done)
+	})
+}
+
+// send 调用方持有broker读锁
+func (s *Subscription) send(ctx context.Context, event interface{}) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	switch s.opts.policy {
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	case Disconnect:
+		select {
+		case s.ch <- event:
+		default:
+			// 持有读锁时无法关闭channel，先停止发送再异步取消订阅
+			s.stop()
+			go s.Close()
+		}
+	default:
+		select {
+		case s.ch <- event:
+		case <-s.done:
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drain(s *Subscription) []interface{} {
+	var res []interface{}
+	for item := range s.C() {
+		res = append(res, item)
+	}
+	return res
+}
+
+func TestFanOut(t *testing.T) {
+	b := New()
+	subs := []*Subscription{b.Subscribe(), b.Subscribe(), b.Subscribe()}
+	require.Equal(t, 3, b.Len())
+
+	var wg sync.WaitGroup
+	results := make([][]interface{}, len(subs))
+	for i, s := range subs {
+		wg.Add(1)
+		go func(i int, s *Subscription) {
+			defer wg.Done()
+			results[i] = drain(s)
+		}(i, s)
+	}
+
+	for i := 0; i < 100; i++ {
+		b.Publish(context.TODO(), i)
+	}
+	b.Close()
+	wg.Wait()
+
+	for _, res := range results {
+		require.Len(t, res, 100)
+		assert.Equal(t, 0, res[0])
+		assert.Equal(t, 99, res[99])
+	}
+}
+
+func TestBlockPolicy(t *testing.T) {
+	b := New(WithBuffer(1))
+	s := b.Subscribe()
+
+	b.Publish(context.TODO(), 1)
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	b.Publish(ctx, 2) // 缓冲区已满，阻塞到ctx超时
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	assert.Equal(t, 1, <-s.C())
+	b.Publish(context.TODO(), 3)
+	assert.Equal(t, 3, <-s.C())
+}
+
+func TestDropOldestPolicy(t *testing.T) {
+	b := New(WithBuffer(2))
+	s := b.Subscribe(WithPolicy(DropOldest))
+	fast := b.Subscribe(WithBuffer(10))
+
+	for i := 0; i < 5; i++ {
+		b.Publish(context.TODO(), i)
+	}
+	assert.Equal(t, uint64(3), s.Dropped())
+	assert.Equal(t, 3, <-s.C())
+	assert.Equal(t, 4, <-s.C())
+	assert.Len(t, fast.C(), 5)
+}
+
+func TestDisconnectPolicy(t *testing.T) {
+	b := New(WithBuffer(1), WithPolicy(Disconnect))
+	s := b.Subscribe()
+	other := b.Subscribe(WithBuffer(10))
+
+	b.Publish(context.TODO(), 1)
+	b.Publish(context.TODO(), 2)
+	b.Publish(context.TODO(), 3)
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer not disconnected")
+	}
+	assert.Equal(t, []interface{}{1}, drain(s))
+	require.Eventually(t, func() bool { return b.Len() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, other.C(), 3)
+}
+
+func TestSubscribeContext(t *testing.T) {
+	b := New()
+	ctx, cancel := context.WithCancel(context.TODO())
+	s := b.SubscribeContext(ctx)
+	require.Equal(t, 1, b.Len())
+
+	cancel()
+	assert.Empty(t, drain(s))
+	assert.Equal(t, 0, b.Len())
+
+	// 关闭后再订阅得到已关闭的订阅者
+	b.Close()
+	assert.Empty(t, drain(b.Subscribe()))
+}
+
+// 阻塞中的发布者不影响取消订阅
+func TestCloseWhilePublishing(t *testing.T) {
+	b := New(WithBuffer(0))
+	s := b.Subscribe()
+
+	done := make(chan struct{})
+	go func() {
+		b.Publish(context.TODO(), 1)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish not released")
+	}
+}
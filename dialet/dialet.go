@@ -4,15 +4,38 @@ import (
 	"context"
 	"time"
 
+	"github.com/wwqdrh/datamanager/dialet/diff"
+	"github.com/wwqdrh/datamanager/dialet/mysql"
 	"github.com/wwqdrh/datamanager/dialet/postgres"
+	"github.com/wwqdrh/datamanager/dialet/sqlite"
 	// "github.com/wwqdrh/datamanager/dialet/redis"
 )
 
 var (
 	_ IDialet = &postgres.PostgresDialet{}
+	_ IDialet = &mysql.MysqlDialet{}
+	_ IDialet = &sqlite.SqliteDialet{}
 	// _ IDialet = &redis.RedisDialet{}
 
 	_ ILogData = &postgres.PostgresLog{}
+	_ ILogData = &postgres.PostgresDDL{}
+	_ ILogData = &mysql.MysqlLog{}
+	_ ILogData = &sqlite.SqliteLog{}
+
+	_ IDiff = &postgres.PostgresLog{}
+	_ IDiff = &mysql.MysqlLog{}
+	_ IDiff = &sqlite.SqliteLog{}
+
+	_ ITransactionWatcher = &postgres.PostgresDialet{}
+	_ ITransaction        = &postgres.Transaction{}
+
+	_ IRegister = &postgres.PostgresDialet{}
+	_ IRegister = &mysql.MysqlDialet{}
+	_ IRegister = &sqlite.SqliteDialet{}
+
+	_ IDefaultSchema = &postgres.PostgresDialet{}
+	_ IDefaultSchema = &mysql.MysqlDialet{}
+	_ IDefaultSchema = &sqlite.SqliteDialet{}
 )
 
 type IDialet interface {
@@ -32,3 +55,39 @@ type ILogData interface {
 	GetPaylod() map[string]interface{} // 获取具体的负载对象
 	GetChange() map[string]interface{}
 }
+
+// IDiff 能够提供修改前数据的ILogData
+type IDiff interface {
+	GetDiff() []diff.Column // update中每一列修改前后的值，没有修改前的数据时为nil
+}
+
+// GetDiff 没有实现IDiff时返回nil
+func GetDiff(log ILogData) []diff.Column {
+	if d, ok := log.(IDiff); ok {
+		return d.GetDiff()
+	}
+	return nil
+}
+
+// IRegister 按表注册监听的dialet
+type IRegister interface {
+	Register(table string) error   // 开始监听表的变更，重复注册不报错
+	UnRegister(table string) error // 停止监听表的变更
+}
+
+// ITransactionWatcher 按事务推送变更的dialet，channel中的事件为ITransaction
+type ITransactionWatcher interface {
+	WatchTransactions(ctx context.Context) chan interface{}
+}
+
+// IDefaultSchema Register的表名不带schema时使用的schema，订阅以及缓存策略按照该schema匹配事件
+type IDefaultSchema interface {
+	DefaultSchema() string
+}
+
+// ITransaction 一个已提交事务中的全部事件，事件为ILogData
+type ITransaction interface {
+	GetTxid() int64
+	GetTime() time.Time
+	GetEvents() []interface{}
+}
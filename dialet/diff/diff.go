@@ -0,0 +1,48 @@
+package diff
+
+import (
+	"reflect"
+	"sort"
+)
+
+// update事件中每一列的变化，各个dialet共用，避免与dialet包循环引用
+// 值为null时Old或者New为nil，与未发生变化的列(不在结果中)区分
+
+// Column 一列修改前后的值
+type Column struct {
+	Name string      `json:"name"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Rows 对比修改前后的行，按列名排序
+// old为nil时表示没有修改前的数据(例如复制槽模式下未设置REPLICA IDENTITY FULL)，返回nil；没有变化时返回空的切片
+func Rows(old, new map[string]interface{}) []Column {
+	if old == nil {
+		return nil
+	}
+	res := []Column{}
+	for name, v := range new {
+		if o, ok := old[name]; !ok || !reflect.DeepEqual(o, v) {
+			res = append(res, Column{Name: name, Old: o, New: v})
+		}
+	}
+	for name, o := range old {
+		if _, ok := new[name]; !ok {
+			res = append(res, Column{Name: name, Old: o})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Names 发生变化的列名
+func Names(columns []Column) []string {
+	res := make([]string, 0, len(columns))
+	for _, c := range columns {
+		res = append(res, c.Name)
+	}
+	return res
+}
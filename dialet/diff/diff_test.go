@@ -0,0 +1,22 @@
+package diff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRows(t *testing.T) {
+	old := map[string]interface{}{"id": float64(1), "note": "a", "title": nil, "tag": "x", "removed": "r"}
+	new := map[string]interface{}{"id": float64(1), "note": nil, "title": "t", "tag": "x", "added": "n"}
+	assert.Equal(t, []Column{
+		{Name: "added", New: "n"},
+		{Name: "note", Old: "a"},
+		{Name: "removed", Old: "r"},
+		{Name: "title", New: "t"},
+	}, Rows(old, new))
+
+	assert.Equal(t, []Column{}, Rows(old, old))
+	assert.Nil(t, Rows(nil, new))
+	assert.Equal(t, []string{"note", "title"}, Names([]Column{{Name: "note"}, {Name: "title"}}))
+}
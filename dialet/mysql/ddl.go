@@ -0,0 +1,123 @@
+package mysql
+
+import (
+	"regexp"
+	"strings"
+)
+
+// 根据QueryEvent中的ddl语句清理字段缓存
+// 只识别修改表结构的语句，BEGIN、COMMIT以及statement格式的dml不会清理
+
+var (
+	// 语句开头的注释，例如 /* ApplicationName=... */
+	ddlCommentRe = regexp.MustCompile(`^\s*(?:/\*.*?\*/\s*)*`)
+
+	// 修改表的ddl，第一个分组为表名开始的部分
+	ddlTableRe = regexp.MustCompile(`(?is)^(?:alter\s+(?:online\s+|ignore\s+)*table|drop\s+(?:temporary\s+)?tables?(?:\s+if\s+exists)?|create\s+(?:temporary\s+)?table(?:\s+if\s+not\s+exists)?|rename\s+tables?)\s+(.*)$`)
+
+	// 删除或者修改数据库
+	ddlSchemaRe = regexp.MustCompile("(?is)^(?:alter|drop)\\s+(?:database|schema)(?:\\s+if\\s+exists)?\\s+`?([^`\\s;]+)`?")
+
+	ddlNextRe = regexp.MustCompile(`(?is)^\s*(?:,|to\s)\s*`)
+)
+
+// ddlChange QueryEvent影响的表，schemas为整个数据库都受影响的数据库
+type ddlChange struct {
+	tables  []string // schema.table
+	schemas []string
+}
+
+// parseDDL schema为执行语句时的当前数据库，不是ddl时返回nil
+func parseDDL(schema, query string) *ddlChange {
+	query = ddlCommentRe.ReplaceAllString(query, "")
+	if m := ddlSchemaRe.FindStringSubmatch(query); m != nil {
+		return &ddlChange{schemas: []string{m[1]}}
+	}
+	m := ddlTableRe.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+	change := &ddlChange{}
+	rest := m[1]
+	for {
+		db, table, n := scanTableName(rest)
+		if n == 0 {
+			break
+		}
+		if db == "" {
+			db = schema
+		}
+		change.tables = append(change.tables, tableKey(db, table))
+		rest = rest[n:]
+		// DROP TABLE a, b 以及 RENAME TABLE a TO b, c TO d
+		next := ddlNextRe.FindString(rest)
+		if next == "" {
+			break
+		}
+		rest = rest[len(next):]
+	}
+	if len(change.tables) == 0 {
+		// 无法解析表名时清理当前数据库
+		change.schemas = []string{schema}
+	}
+	return change
+}
+
+// scanTableName 解析[schema.]table，名称可以用反引号包裹，返回去掉反引号的名称以及消耗的长度
+func scanTableName(s string) (string, string, int) {
+	name, n := scanIdent(s)
+	if n == 0 {
+		return "", "", 0
+	}
+	if n >= len(s) || s[n] != '.' {
+		return "", name, n
+	}
+	table, m := scanIdent(s[n+1:])
+	if m == 0 {
+		return "", "", 0
+	}
+	return name, table, n + 1 + m
+}
+
+func scanIdent(s string) (string, int) {
+	if strings.HasPrefix(s, "`") {
+		// ``为转义的反引号
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '`' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '`' {
+				b.WriteByte('`')
+				i++
+				continue
+			}
+			return b.String(), i + 1
+		}
+		return "", 0
+	}
+	i := 0
+	for i < len(s) && (s[i] == '_' || s[i] == '$' || s[i] >= 0x80 ||
+		('0' <= s[i] && s[i] <= '9') || ('a' <= s[i] && s[i] <= 'z') || ('A' <= s[i] && s[i] <= 'Z')) {
+		i++
+	}
+	return s[:i], i
+}
+
+// invalidateColumns 清理ddl影响的表的字段缓存
+func (m *MysqlDialet) invalidateColumns(change *ddlChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range change.tables {
+		delete(m.columns, key)
+	}
+	for _, schema := range change.schemas {
+		prefix := schema + "."
+		for key := range m.columns {
+			if strings.HasPrefix(key, prefix) {
+				delete(m.columns, key)
+			}
+		}
+	}
+}
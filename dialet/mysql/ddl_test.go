@@ -0,0 +1,61 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet/broker"
+)
+
+func TestParseDDL(t *testing.T) {
+	for _, q := range []string{"BEGIN", "COMMIT", "insert into notes values (1)", "TRUNCATE notes", "SAVEPOINT a"} {
+		assert.Nil(t, parseDDL("test", q), q)
+	}
+
+	cases := []struct {
+		query  string
+		change ddlChange
+	}{
+		{"ALTER TABLE notes ADD COLUMN x int", ddlChange{tables: []string{"test.notes"}}},
+		{"/* app */ alter table `other`.`my``notes` drop x", ddlChange{tables: []string{"other.my`notes"}}},
+		{"DROP TABLE IF EXISTS a, other.b", ddlChange{tables: []string{"test.a", "other.b"}}},
+		{"RENAME TABLE a TO b, c TO other.d", ddlChange{tables: []string{"test.a", "test.b", "test.c", "other.d"}}},
+		{"CREATE TABLE IF NOT EXISTS b LIKE a", ddlChange{tables: []string{"test.b"}}},
+		{"DROP DATABASE IF EXISTS `other`", ddlChange{schemas: []string{"other"}}},
+		{"ALTER TABLE (x)", ddlChange{schemas: []string{"test"}}},
+	}
+	for _, c := range cases {
+		change := parseDDL("test", c.query)
+		require.NotNil(t, change, c.query)
+		assert.Equal(t, c.change, *change, c.query)
+	}
+}
+
+// 只有ddl清理受影响的表的字段缓存
+func TestMysqlDialetColumnCache(t *testing.T) {
+	m := &MysqlDialet{
+		schema:  "test",
+		tables:  map[string]bool{},
+		columns: map[string][]string{"test.notes": {"id"}, "test.users": {"id"}, "other.notes": {"id"}},
+		decoder: newDecoder(testColumns),
+		broker:  broker.New(),
+	}
+	query := func(schema, q string) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.QUERY_EVENT, LogPos: 10},
+			Event:  &replication.QueryEvent{Schema: []byte(schema), Query: []byte(q)},
+		}
+	}
+	require.Nil(t, m.handleEvent(context.TODO(), query("test", "BEGIN")))
+	assert.Len(t, m.columns, 3)
+	assert.Equal(t, uint32(10), m.Position().Pos)
+
+	require.Nil(t, m.handleEvent(context.TODO(), query("test", "ALTER TABLE notes ADD COLUMN x int")))
+	assert.Equal(t, map[string][]string{"test.users": {"id"}, "other.notes": {"id"}}, m.columns)
+
+	require.Nil(t, m.handleEvent(context.TODO(), query("test", "DROP DATABASE other")))
+	assert.Equal(t, map[string][]string{"test.users": {"id"}}, m.columns)
+}
@@ -0,0 +1,130 @@
+package mysql
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+// ColumnResolver 返回数据表按ordinal_position排序的字段名
+// 只有binlog_row_metadata=FULL时binlog中才会携带字段名，其他情况需要查询information_schema
+type ColumnResolver func(schema, table string) ([]string, error)
+
+// decoder 将row-based binlog事件转换为MysqlLog
+type decoder struct {
+	columns ColumnResolver
+}
+
+func newDecoder(columns ColumnResolver) *decoder {
+	return &decoder{columns: columns}
+}
+
+// Decode 非行变更事件返回nil
+func (d *decoder) Decode(ev *replication.BinlogEvent) ([]*MysqlLog, error) {
+	if ev == nil || ev.Header == nil {
+		return nil, errors.New("got nil event")
+	}
+
+	var label string
+	switch ev.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		label = "insert"
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		label = "update"
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		label = "delete"
+	default:
+		return nil, nil
+	}
+
+	rows, ok := ev.Event.(*replication.RowsEvent)
+	if !ok || rows.Table == nil {
+		return nil, errors.New("rows event without table map")
+	}
+	schema, table := string(rows.Table.Schema), string(rows.Table.Table)
+
+	names := rows.Table.ColumnNameString()
+	if len(names) == 0 {
+		if d.columns == nil {
+			return nil, errors.Errorf("no column names for %s.%s", schema, table)
+		}
+		var err error
+		if names, err = d.columns(schema, table); err != nil {
+			return nil, errors.Wrap(err, "resolve columns")
+		}
+	}
+
+	base := MysqlLog{
+		Schema: schema,
+		Table:  table,
+		Label:  label,
+		Time:   time.Unix(int64(ev.Header.Timestamp), 0),
+	}
+
+	var res []*MysqlLog
+	if label == "update" {
+		// update事件的rows按 变更前、变更后 成对出现
+		if len(rows.Rows)%2 != 0 {
+			return nil, errors.New("update rows event with odd row count")
+		}
+		for i := 0; i < len(rows.Rows); i += 2 {
+			before, err := rowMap(names, rows.Rows[i])
+			if err != nil {
+				return nil, err
+			}
+			after, err := rowMap(names, rows.Rows[i+1])
+			if err != nil {
+				return nil, err
+			}
+			l := base
+			l.Payload, l.Previous, l.Changes = after, before, rowChanges(before, after)
+			l.Diff = diff.Rows(before, after)
+			res = append(res, &l)
+		}
+		return res, nil
+	}
+
+	for _, row := range rows.Rows {
+		payload, err := rowMap(names, row)
+		if err != nil {
+			return nil, err
+		}
+		l := base
+		l.Payload = payload
+		res = append(res, &l)
+	}
+	return res, nil
+}
+
+func rowMap(names []string, row []interface{}) (map[string]interface{}, error) {
+	if len(names) < len(row) {
+		return nil, errors.Errorf("got %d values but %d columns", len(row), len(names))
+	}
+	res := make(map[string]interface{}, len(row))
+	for i, v := range row {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		res[names[i]] = v
+	}
+	return res, nil
+}
+
+// rowChanges 返回发生变化的字段及其旧值，与postgres的changes(merge patch)语义一致
+func rowChanges(before, after map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func tableKey(schema, table string) string {
+	return fmt.Sprintf("%s.%s", schema, table)
+}
@@ -0,0 +1,145 @@
+package mysql
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet/broker"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+// testdata/binlog.json 为录制的binlog事件
+// columns不为空时模拟binlog_row_metadata=FULL，否则通过ColumnResolver获取字段
+type binlogFixture struct {
+	Type      string          `json:"type"`
+	Timestamp uint32          `json:"timestamp"`
+	Schema    string          `json:"schema"`
+	Table     string          `json:"table"`
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+}
+
+var fixtureEventTypes = map[string]replication.EventType{
+	"QUERY_EVENT":         replication.QUERY_EVENT,
+	"WRITE_ROWS_EVENTv2":  replication.WRITE_ROWS_EVENTv2,
+	"UPDATE_ROWS_EVENTv2": replication.UPDATE_ROWS_EVENTv2,
+	"DELETE_ROWS_EVENTv2": replication.DELETE_ROWS_EVENTv2,
+}
+
+func loadBinlogFixture(t *testing.T) []*replication.BinlogEvent {
+	data, err := os.ReadFile("testdata/binlog.json")
+	require.Nil(t, err)
+	var fixtures []binlogFixture
+	require.Nil(t, json.Unmarshal(data, &fixtures))
+
+	res := make([]*replication.BinlogEvent, 0, len(fixtures))
+	for _, f := range fixtures {
+		ev := &replication.BinlogEvent{
+			Header: &replication.EventHeader{Timestamp: f.Timestamp, EventType: fixtureEventTypes[f.Type]},
+		}
+		if f.Table == "" {
+			ev.Event = &replication.QueryEvent{}
+		} else {
+			tableMap := &replication.TableMapEvent{Schema: []byte(f.Schema), Table: []byte(f.Table)}
+			for _, c := range f.Columns {
+				tableMap.ColumnName = append(tableMap.ColumnName, []byte(c))
+			}
+			ev.Event = &replication.RowsEvent{Table: tableMap, Rows: f.Rows}
+		}
+		res = append(res, ev)
+	}
+	return res
+}
+
+func testColumns(schema, table string) ([]string, error) {
+	return []string{"id", "name", "note"}, nil
+}
+
+func TestDecodeBinlog(t *testing.T) {
+	d := newDecoder(testColumns)
+
+	var logs []*MysqlLog
+	for _, ev := range loadBinlogFixture(t) {
+		res, err := d.Decode(ev)
+		require.Nil(t, err)
+		logs = append(logs, res...)
+	}
+	require.Len(t, logs, 5)
+
+	assert.Equal(t, "insert", logs[0].GetLabel())
+	assert.Equal(t, "test", logs[0].GetSchema())
+	assert.Equal(t, "notes", logs[0].GetTable())
+	assert.Equal(t, "here is a sample note", logs[0].GetPaylod()["note"])
+	assert.Equal(t, time.Unix(1660000001, 0), logs[0].GetTime())
+	assert.Nil(t, logs[1].GetPaylod()["note"])
+
+	assert.Equal(t, "update", logs[2].GetLabel())
+	assert.Equal(t, "here is an updated note", logs[2].GetPaylod()["note"])
+	assert.Equal(t, "here is a sample note", logs[2].Previous["note"])
+	assert.Equal(t, map[string]interface{}{"note": "here is a sample note"}, logs[2].GetChange())
+	assert.Equal(t, []diff.Column{{Name: "note", Old: "here is a sample note", New: "here is an updated note"}}, logs[2].GetDiff())
+	assert.Nil(t, logs[3].GetDiff())
+
+	assert.Equal(t, "delete", logs[3].GetLabel())
+	assert.Equal(t, "user2", logs[3].GetPaylod()["name"])
+
+	assert.Equal(t, "users", logs[4].GetTable())
+	assert.Equal(t, map[string]interface{}{"id": float64(7), "name": "user7"}, logs[4].GetPaylod())
+}
+
+func TestDecodeBinlogInvalid(t *testing.T) {
+	d := newDecoder(nil)
+
+	_, err := d.Decode(nil)
+	assert.NotNil(t, err)
+
+	_, err = d.Decode(&replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2},
+		Event:  &replication.RowsEvent{Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("notes")}},
+	})
+	assert.NotNil(t, err, "no column resolver")
+
+	_, err = newDecoder(testColumns).Decode(&replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.UPDATE_ROWS_EVENTv2},
+		Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("notes")},
+			Rows:  [][]interface{}{{1, "user1", "note"}},
+		},
+	})
+	assert.NotNil(t, err, "odd update rows")
+}
+
+// Register/UnRegister过滤数据表
+func TestMysqlDialetFilter(t *testing.T) {
+	m := &MysqlDialet{
+		schema:  "test",
+		tables:  map[string]bool{},
+		columns: map[string][]string{},
+		decoder: newDecoder(testColumns),
+		broker:  broker.New(broker.WithBuffer(10)),
+	}
+	require.Nil(t, m.Register("notes"))
+
+	q := m.broker.Subscribe().C()
+	for _, ev := range loadBinlogFixture(t) {
+		require.Nil(t, m.handleEvent(context.TODO(), ev))
+	}
+	assert.Len(t, q, 4)
+
+	require.Nil(t, m.UnRegister("test.notes"))
+	require.Nil(t, m.Register("test.users"))
+	for len(q) > 0 {
+		<-q
+	}
+	for _, ev := range loadBinlogFixture(t) {
+		require.Nil(t, m.handleEvent(context.TODO(), ev))
+	}
+	require.Len(t, q, 1)
+	assert.Equal(t, "users", (<-q).(*MysqlLog).GetTable())
+}
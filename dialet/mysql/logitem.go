@@ -0,0 +1,64 @@
+package mysql
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+type MysqlLog struct {
+	Schema   string                 `json:"schema"`
+	Table    string                 `json:"table"`
+	Label    string                 `json:"label"` // insert update delete
+	Time     time.Time              `json:"time"`
+	Payload  map[string]interface{} `json:"payload"`  // 变更后的数据，delete时为删除前的数据
+	Previous map[string]interface{} `json:"previous"` // update时变更前的数据
+	Changes  map[string]interface{} `json:"changes"`  // update时发生变化的字段及其旧值
+	Diff     []diff.Column          `json:"diff"`     // update时发生变化的字段的旧值以及新值
+}
+
+// log unmarshal to struct
+func NewMysqlLog(log string) (*MysqlLog, error) {
+	var l *MysqlLog
+	if err := json.Unmarshal([]byte(log), &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *MysqlLog) GetSchema() string {
+	return l.Schema
+}
+
+func (l *MysqlLog) GetTable() string {
+	return l.Table
+}
+
+// 获取日志记录类型 ddl dml
+func (l *MysqlLog) GetType() string {
+	return "dml"
+}
+
+// 具体标签 insert update delete
+func (l *MysqlLog) GetLabel() string {
+	return l.Label
+}
+
+// 获取日志记录时间 binlog事件头中的时间
+func (l *MysqlLog) GetTime() time.Time {
+	return l.Time
+}
+
+// 获取具体的负载对象
+func (l *MysqlLog) GetPaylod() map[string]interface{} {
+	return l.Payload
+}
+
+func (l *MysqlLog) GetChange() map[string]interface{} {
+	return l.Changes
+}
+
+func (l *MysqlLog) GetDiff() []diff.Column {
+	return l.Diff
+}
@@ -0,0 +1,344 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/broker"
+	"github.com/wwqdrh/logger"
+)
+
+var (
+	// 获取binlog格式，只支持ROW
+	sqlBinlogFormat = `SHOW VARIABLES LIKE 'binlog_format'`
+
+	// 获取当前binlog位置
+	sqlMasterStatus = `SHOW MASTER STATUS`
+
+	// 获取数据表的字段
+	sqlQueryColumns = `
+SELECT column_name
+  FROM information_schema.columns
+ WHERE table_schema = ? AND table_name = ?
+ ORDER BY ordinal_position
+`
+)
+
+const defaultServerID = 1001
+
+type Option func(*MysqlDialet)
+
+// WithServerID 作为从库注册时使用的server id，需要在集群中唯一
+func WithServerID(id uint32) Option {
+	return func(m *MysqlDialet) {
+		m.cfg.ServerID = id
+	}
+}
+
+// WithPosition 指定开始同步的binlog位置，默认为Initial时的最新位置
+func WithPosition(name string, pos uint32) Option {
+	return func(m *MysqlDialet) {
+		m.pos = gomysql.Position{Name: name, Pos: pos}
+	}
+}
+
+// WithBrokerOptions Watch订阅者默认的缓冲区以及慢消费者策略
+func WithBrokerOptions(opts ...broker.Option) Option {
+	return func(m *MysqlDialet) {
+		m.brokerOpts = opts
+	}
+}
+
+type MysqlDialet struct {
+	dsn    string
+	schema string // dsn中的数据库，Register未指定schema时使用
+	db     *sql.DB
+	cfg    replication.BinlogSyncerConfig
+	pos    gomysql.Position // 由mu保护
+
+	decoder *decoder
+
+	// 所有订阅者共享同一个binlog同步
+	brokerOpts []broker.Option
+	broker     *broker.Broker
+	once       sync.Once
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	mu      sync.RWMutex
+	tables  map[string]bool     // schema.table
+	columns map[string][]string // schema.table => columns
+}
+
+// NewMysqlDialet dsn: [user]:[password]@tcp([host]:[port])/[db]
+func NewMysqlDialet(dsn string, opts ...Option) (*MysqlDialet, error) {
+	conf, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, errors.Wrap(err, "ping")
+	}
+
+	m := &MysqlDialet{
+		dsn:    dsn,
+		schema: conf.DBName,
+		db:     db,
+		cfg: replication.BinlogSyncerConfig{
+			ServerID: defaultServerID,
+			Flavor:   "mysql",
+			Host:     host,
+			Port:     uint16(portNum),
+			User:     conf.User,
+			Password: conf.Passwd,
+		},
+		tables:  map[string]bool{},
+		columns: map[string][]string{},
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	m.decoder = newDecoder(m.lookupColumns)
+	m.broker = broker.New(m.brokerOpts...)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m, nil
+}
+
+func (m *MysqlDialet) DB() *sql.DB {
+	return m.db
+}
+
+// Initial 检查binlog格式并确定开始同步的位置
+func (m *MysqlDialet) Initial() error {
+	var name, format string
+	if err := m.db.QueryRow(sqlBinlogFormat).Scan(&name, &format); err != nil {
+		return errors.Wrap(err, "binlog format")
+	}
+	if !strings.EqualFold(format, "ROW") {
+		return errors.Errorf("binlog_format must be ROW, got %s", format)
+	}
+
+	if m.Position().Name != "" {
+		return nil
+	}
+	rows, err := m.db.Query(sqlMasterStatus)
+	if err != nil {
+		return errors.Wrap(err, "master status")
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		return errors.New("binlog is not enabled")
+	}
+	// SHOW MASTER STATUS的列数与版本相关，只取前两列
+	dest := make([]interface{}, len(cols))
+	for i := range dest {
+		dest[i] = new(sql.RawBytes)
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	pos, err := strconv.ParseUint(string(*dest[1].(*sql.RawBytes)), 10, 32)
+	if err != nil {
+		return err
+	}
+	m.setPosition(gomysql.Position{Name: string(*dest[0].(*sql.RawBytes)), Pos: uint32(pos)})
+	return nil
+}
+
+// Position 已经处理的binlog位置，可以保存后通过WithPosition恢复
+func (m *MysqlDialet) Position() gomysql.Position {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pos
+}
+
+func (m *MysqlDialet) setPosition(pos gomysql.Position) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pos = pos
+}
+
+func (m *MysqlDialet) Close() error {
+	m.cancel()
+	m.broker.Close()
+	return m.db.Close()
+}
+
+// Register add policy for table, table: [schema.]table
+func (m *MysqlDialet) Register(table string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tables[m.qualify(table)] = true
+	return nil
+}
+
+func (m *MysqlDialet) UnRegister(table string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.qualify(table)
+	delete(m.tables, key)
+	delete(m.columns, key)
+	return nil
+}
+
+// DefaultSchema dsn中的数据库
+func (m *MysqlDialet) DefaultSchema() string {
+	return m.schema
+}
+
+func (m *MysqlDialet) isWatched(schema, table string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tables[tableKey(schema, table)]
+}
+
+func (m *MysqlDialet) qualify(table string) string {
+	if strings.Contains(table, ".") {
+		return table
+	}
+	return tableKey(m.schema, table)
+}
+
+// 修改指定数据库数据表的日志存储策略
+func (m *MysqlDialet) ModifyPolicy() error {
+	return nil
+}
+
+// 查看指定数据库的日志策略
+func (m *MysqlDialet) ListPolicy() error {
+	return nil
+}
+
+// 删除某个指定策略
+func (m *MysqlDialet) DeletePolicy() error {
+	return nil
+}
+
+// 获取监听channel，能够获取当前的日志修改记录
+// 每次调用都是一个独立的订阅者，都能收到全部事件，ctx结束后channel被关闭
+func (m *MysqlDialet) Watch(ctx context.Context) chan interface{} {
+	return m.Subscribe(ctx).C()
+}
+
+// Subscribe 与Watch相同，opts可以单独配置该订阅者的缓冲区以及慢消费者策略
+func (m *MysqlDialet) Subscribe(ctx context.Context, opts ...broker.Option) *broker.Subscription {
+	sub := m.broker.SubscribeContext(ctx, opts...)
+	m.once.Do(func() {
+		go func() {
+			if err := m.handleEvents(m.ctx); err != nil {
+				logger.DefaultLogger.Error(err.Error())
+			}
+		}()
+	})
+	return sub
+}
+
+func (m *MysqlDialet) handleEvents(ctx context.Context) error {
+	syncer := replication.NewBinlogSyncer(m.cfg)
+	defer syncer.Close()
+
+	streamer, err := syncer.StartSync(m.Position())
+	if err != nil {
+		return errors.Wrap(err, "start sync")
+	}
+	for {
+		ev, err := streamer.GetEvent(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "get event")
+		}
+		if err := m.handleEvent(ctx, ev); err != nil {
+			logger.DefaultLogger.Error(err.Error())
+		}
+	}
+}
+
+func (m *MysqlDialet) handleEvent(ctx context.Context, ev *replication.BinlogEvent) error {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		m.setPosition(gomysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)})
+		return nil
+	case *replication.QueryEvent:
+		// ddl后字段可能发生变化，每个事务开始的BEGIN也是QueryEvent，只处理ddl
+		if change := parseDDL(string(e.Schema), string(e.Query)); change != nil {
+			m.invalidateColumns(change)
+		}
+	case *replication.RowsEvent:
+		if e.Table == nil || !m.isWatched(string(e.Table.Schema), string(e.Table.Table)) {
+			return nil
+		}
+	}
+	if ev.Header != nil && ev.Header.LogPos > 0 {
+		m.mu.Lock()
+		m.pos.Pos = ev.Header.LogPos
+		m.mu.Unlock()
+	}
+
+	logs, err := m.decoder.Decode(ev)
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		m.broker.Publish(ctx, l)
+	}
+	return nil
+}
+
+// lookupColumns 查询并缓存字段名
+func (m *MysqlDialet) lookupColumns(schema, table string) ([]string, error) {
+	key := tableKey(schema, table)
+	m.mu.RLock()
+	cols, ok := m.columns[key]
+	m.mu.RUnlock()
+	if ok {
+		return cols, nil
+	}
+
+	rows, err := m.db.Query(sqlQueryColumns, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	if len(cols) == 0 {
+		return nil, errors.Errorf("table %s not found", key)
+	}
+
+	m.mu.Lock()
+	m.columns[key] = cols
+	m.mu.Unlock()
+	return cols, nil
+}
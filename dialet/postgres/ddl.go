@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+// ddl事件由ddl_end_log_function(pg_event_trigger_ddl_commands)以及ddl_drop_log_function(pg_event_trigger_dropped_objects)生成
+// payload: {"query": "...", "objects": [{"command_tag", "object_type", "schema", "name", "object_identity", "columns", "original"}]}
+
+// DDLColumn ALTER TABLE中发生变化的列
+type DDLColumn struct {
+	Action   string `json:"action"` // added dropped renamed retyped
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Previous string `json:"previous,omitempty"` // renamed为修改前的列名，retyped为修改前的类型
+}
+
+// DDLObject ddl命令影响的一个对象
+type DDLObject struct {
+	CommandTag     string      `json:"command_tag"`
+	ObjectType     string      `json:"object_type"` // table index sequence ...
+	Schema         string      `json:"schema"`
+	Name           string      `json:"name,omitempty"`  // 表名，其它对象可能为空
+	ObjectIdentity string      `json:"object_identity"` // 例如 public.notes
+	Columns        []DDLColumn `json:"columns,omitempty"`
+	Original       bool        `json:"original,omitempty"` // 删除时为false表示级联删除的对象
+}
+
+// PostgresDDL Watch推送的ddl事件，与PostgresLog(dml)区分
+type PostgresDDL struct {
+	Schema  string                 `json:"schema"`
+	Table   string                 `json:"table"` // 第一个表对象，没有表时为空
+	Tag     string                 `json:"tag"`   // 命令标签，例如ALTER TABLE
+	Query   string                 `json:"query"`
+	Objects []DDLObject            `json:"objects"`
+	Time    time.Time              `json:"time"`
+	Txid    int64                  `json:"txid"`
+	Seq     int64                  `json:"seq"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// NewPostgresDDL 解析ddl触发器的payload
+func NewPostgresDDL(l *PostgresLog) (*PostgresDDL, error) {
+	if Operation(l.Op) != Operation_DDL {
+		return nil, errors.Errorf("not a ddl event: %s", Operation(l.Op))
+	}
+	d := &PostgresDDL{
+		Schema:  l.Schema,
+		Table:   l.Table,
+		Tag:     l.Tag,
+		Time:    l.Time,
+		Txid:    l.Txid,
+		Seq:     l.Seq,
+		Payload: l.Payload,
+	}
+	if query, ok := l.Payload["query"].(string); ok {
+		d.Query = query
+	}
+	if objects, ok := l.Payload["objects"]; ok && objects != nil {
+		data, err := json.Marshal(objects)
+		if err != nil {
+			return nil, errors.Wrap(err, "ddl objects")
+		}
+		if err := json.Unmarshal(data, &d.Objects); err != nil {
+			return nil, errors.Wrap(err, "ddl objects")
+		}
+	}
+	return d, nil
+}
+
+// Columns 所有对象中指定动作的列，例如 Columns("added")
+func (d *PostgresDDL) Columns(action string) []DDLColumn {
+	var res []DDLColumn
+	for _, o := range d.Objects {
+		for _, c := range o.Columns {
+			if c.Action == action {
+				res = append(res, c)
+			}
+		}
+	}
+	return res
+}
+
+func (d *PostgresDDL) GetSchema() string {
+	return d.Schema
+}
+
+func (d *PostgresDDL) GetTable() string {
+	return d.Table
+}
+
+func (d *PostgresDDL) GetType() string {
+	return "ddl"
+}
+
+// 小写的命令标签，例如 alter table
+func (d *PostgresDDL) GetLabel() string {
+	return strings.ToLower(d.Tag)
+}
+
+func (d *PostgresDDL) GetTime() time.Time {
+	return d.Time
+}
+
+func (d *PostgresDDL) GetPaylod() map[string]interface{} {
+	return d.Payload
+}
+
+func (d *PostgresDDL) GetChange() map[string]interface{} {
+	return nil
+}
+
+func (d *PostgresDDL) GetDiff() []diff.Column {
+	return nil
+}
+
+// handleDDL 为新建的表安装触发器(需要通过WithTableRegexp或者WithSchemas指定)，删除表时清理记录
+func (s *Stream) handleDDL(d *PostgresDDL) error {
+	var errs []string
+	for _, o := range d.Objects {
+		if o.ObjectType != "table" || o.Name == "" {
+			continue
+		}
+		t := Table{Schema: o.Schema, Name: o.Name}
+		table := t.String()
+		switch o.CommandTag {
+		case "CREATE TABLE", "CREATE TABLE AS", "SELECT INTO":
+			// 没有配置表名或者schema规则时不自动注册
+			if (s.tableRe == nil && len(s.schemaInclude) == 0) || !s.managed(t) {
+				continue
+			}
+			if err := s.installTrigger(t); err != nil {
+				errs = append(errs, table+": "+err.Error())
+				continue
+			}
+			if s.onTable != nil {
+				s.onTable(table, true)
+			}
+		case "DROP TABLE", "DROP SCHEMA":
+			// 触发器随表一起删除，只需要清理记录，同名的表重新创建后主键可能不同
+			if !s.isWatched(table) {
+				continue
+			}
+			s.watchTable(table, false)
+			s.setKeyColumns(table, nil)
+			if s.onTable != nil {
+				s.onTable(table, false)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("install triggers: %v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 与ddl_end_log_function()的输出格式相同
+func TestPostgresDDLAlterTable(t *testing.T) {
+	l := handleNotification(t, `{"schema":"public","table":"notes","op":"DDL","tag":"ALTER TABLE",`+
+		`"time":"2022-08-08T12:00:00Z","txid":740,"payload":{"query":"alter table notes ...","objects":[`+
+		`{"command_tag":"ALTER TABLE","object_type":"table","schema":"public","object_identity":"public.notes","columns":[`+
+		`{"action":"added","name":"title","type":"text","previous":null},`+
+		`{"action":"dropped","name":"note","type":"text","previous":null},`+
+		`{"action":"renamed","name":"author","type":"character varying(100)","previous":"name"},`+
+		`{"action":"retyped","name":"id","type":"bigint","previous":"integer"}]},`+
+		`{"command_tag":"CREATE INDEX","object_type":"index","schema":"public","object_identity":"public.notes_title_idx","columns":null}]}}`)
+
+	d, err := NewPostgresDDL(l)
+	require.Nil(t, err)
+	assert.Equal(t, "ddl", d.GetType())
+	assert.Equal(t, "alter table", d.GetLabel())
+	assert.Equal(t, "notes", d.GetTable())
+	assert.Equal(t, int64(740), d.Txid)
+	assert.Equal(t, "alter table notes ...", d.Query)
+	assert.Nil(t, d.GetChange())
+
+	require.Len(t, d.Objects, 2)
+	assert.Equal(t, "public.notes", d.Objects[0].ObjectIdentity)
+	assert.Equal(t, "table", d.Objects[0].ObjectType)
+	assert.Equal(t, "index", d.Objects[1].ObjectType)
+	assert.Empty(t, d.Objects[1].Columns)
+
+	assert.Equal(t, []DDLColumn{{Action: "added", Name: "title", Type: "text"}}, d.Columns("added"))
+	assert.Equal(t, []DDLColumn{{Action: "dropped", Name: "note", Type: "text"}}, d.Columns("dropped"))
+	assert.Equal(t, []DDLColumn{{Action: "renamed", Name: "author", Type: "character varying(100)", Previous: "name"}}, d.Columns("renamed"))
+	assert.Equal(t, []DDLColumn{{Action: "retyped", Name: "id", Type: "bigint", Previous: "integer"}}, d.Columns("retyped"))
+}
+
+// 与ddl_drop_log_function()的输出格式相同
+func TestPostgresDDLDropTable(t *testing.T) {
+	l := handleNotification(t, `{"schema":"public","table":"notes","op":"DDL","tag":"DROP TABLE",`+
+		`"time":"2022-08-08T12:00:00Z","txid":741,"payload":{"query":"drop table notes","objects":[`+
+		`{"command_tag":"DROP TABLE","object_type":"table","schema":"public","name":"notes","object_identity":"public.notes","original":true},`+
+		`{"command_tag":"DROP TABLE","object_type":"index","schema":"public","object_identity":"public.notes_pkey","original":false}]}}`)
+
+	d, err := NewPostgresDDL(l)
+	require.Nil(t, err)
+	assert.Equal(t, "drop table", d.GetLabel())
+	assert.Equal(t, "notes", d.GetTable())
+	require.Len(t, d.Objects, 2)
+	assert.True(t, d.Objects[0].Original)
+	assert.Equal(t, "notes", d.Objects[0].Name)
+	assert.False(t, d.Objects[1].Original)
+
+	e, err := toEvent(d)
+	require.Nil(t, err)
+	assert.Equal(t, Operation_DDL, e.Op)
+	assert.Equal(t, "DROP TABLE", e.Tag)
+	assert.Equal(t, int64(741), e.Txid)
+}
+
+func TestPostgresDDLNotDDL(t *testing.T) {
+	_, err := NewPostgresDDL(&PostgresLog{Op: int(Operation_INSERT)})
+	assert.NotNil(t, err)
+}
+
+func TestHandleDDLAutoRegister(t *testing.T) {
+	type change struct {
+		table   string
+		watched bool
+	}
+	var changes []change
+	// 复制槽模式下注册只修改记录
+	s, _ := newFakeStream(t, nil)
+	s.slot = "test"
+	WithTableRegexp(regexp.MustCompile(`^(tenant_\d+\.)?orders`))(s)
+	WithSchemas(regexp.MustCompile(`^(public|tenant_\d+)$`))(s)
+	WithTableListener(func(table string, watched bool) {
+		changes = append(changes, change{table, watched})
+	})(s)
+	s.watchTable("notes", true)
+	s.setKeyColumns("notes", []string{"id"})
+
+	create := func(schema, name string) *PostgresDDL {
+		return &PostgresDDL{Tag: "CREATE TABLE", Objects: []DDLObject{
+			{CommandTag: "CREATE TABLE", ObjectType: "table", Schema: schema, Name: name},
+			{CommandTag: "CREATE INDEX", ObjectType: "index", Schema: schema, Name: name + "_pkey"},
+		}}
+	}
+	require.Nil(t, s.handleDDL(create("public", "orders")))
+	require.Nil(t, s.handleDDL(create("tenant_1", "orders")))
+	require.Nil(t, s.handleDDL(create("public", "users")))
+	assert.Equal(t, []string{"notes", "orders", "tenant_1.orders"}, s.Tables())
+
+	// 级联删除的表同样需要清理，未注册的表忽略
+	require.Nil(t, s.handleDDL(&PostgresDDL{Tag: "DROP SCHEMA", Objects: []DDLObject{
+		{CommandTag: "DROP SCHEMA", ObjectType: "schema", Name: "tenant_1", Original: true},
+		{CommandTag: "DROP SCHEMA", ObjectType: "table", Schema: "tenant_1", Name: "orders"},
+		{CommandTag: "DROP SCHEMA", ObjectType: "table", Schema: "tenant_1", Name: "audit"},
+	}}))
+	require.Nil(t, s.handleDDL(&PostgresDDL{Tag: "DROP TABLE", Objects: []DDLObject{
+		{CommandTag: "DROP TABLE", ObjectType: "table", Schema: "public", Name: "notes", Original: true},
+	}}))
+	assert.Equal(t, []string{"orders"}, s.Tables())
+	assert.Empty(t, s.keyColumns("notes"))
+	assert.Equal(t, []change{
+		{"orders", true}, {"tenant_1.orders", true}, {"tenant_1.orders", false}, {"notes", false},
+	}, changes)
+}
+
+func TestHandleDDLWithoutRegexp(t *testing.T) {
+	s, _ := newFakeStream(t, nil)
+	s.slot = "test"
+	require.Nil(t, s.handleDDL(&PostgresDDL{Tag: "CREATE TABLE", Objects: []DDLObject{
+		{CommandTag: "CREATE TABLE", ObjectType: "table", Schema: "public", Name: "orders"},
+	}}))
+	assert.Empty(t, s.Tables())
+}
@@ -0,0 +1,197 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB 只实现主键、触发器以及overflow的查询，记录执行的sql，用于不需要数据库的测试
+
+type fakeCatalog struct {
+	mu       sync.Mutex
+	keys     map[string][]string          // schema.table -> 主键列
+	triggers map[string]map[string][]byte // schema.table -> tgname -> tgargs
+	overflow map[int64][2]interface{}     // seq -> payload, previous
+	rows     map[string]string            // fetchRowQuery的sql -> 行的json
+	slot     []fakeSlotTx                 // 复制槽中的事务
+	wal      string                       // pg_current_wal_lsn
+	consumed []int                        // pg_logical_slot_get_changes消费的事务数量
+	execs    []string
+	queries  []string
+}
+
+var (
+	fakeCatalogsMu sync.Mutex
+	fakeCatalogs   = map[string]*fakeCatalog{}
+)
+
+func init() {
+	sql.Register("pqstream-fake", fakeDriver{})
+}
+
+// newFakeStream keys的键为schema.table
+func newFakeStream(t *testing.T, keys map[string][]string) (*Stream, *fakeCatalog) {
+	c := &fakeCatalog{keys: keys, triggers: map[string]map[string][]byte{}, overflow: map[int64][2]interface{}{}, rows: map[string]string{}}
+	fakeCatalogsMu.Lock()
+	fakeCatalogs[t.Name()] = c
+	fakeCatalogsMu.Unlock()
+	db, err := sql.Open("pqstream-fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Stream{db: db, tables: map[string]bool{}, keys: map[string][]string{}}, c
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeCatalogsMu.Lock()
+	defer fakeCatalogsMu.Unlock()
+	c, ok := fakeCatalogs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake catalog %s", name)
+	}
+	return &fakeConn{c: c}, nil
+}
+
+type fakeConn struct {
+	c *fakeCatalog
+}
+
+func (f *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: f.c, query: query}, nil
+}
+
+func (f *fakeConn) Close() error { return nil }
+
+func (f *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	c     *fakeCatalog
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.c.execs = append(s.c.execs, s.query)
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.c.queries = append(s.c.queries, s.query)
+	rows := &fakeRows{}
+	switch s.query {
+	case sqlPrimaryKey:
+		for _, col := range s.c.keys[fmt.Sprintf("%s.%s", args[0], args[1])] {
+			rows.values = append(rows.values, []driver.Value{col})
+		}
+	case sqlTriggerArgs:
+		for name, raw := range s.c.triggers[fmt.Sprintf("%s.%s", args[0], args[1])] {
+			rows.values = append(rows.values, []driver.Value{name, raw})
+		}
+	case sqlCurrentSchema:
+		rows.values = append(rows.values, []driver.Value{"public"})
+	case sqlCurrentWalLSN:
+		wal := s.c.wal
+		if wal == "" {
+			wal = "0/0"
+		}
+		rows.values = append(rows.values, []driver.Value{wal})
+	case sqlSlotPeekChanges:
+		for _, tx := range s.c.slot[:s.c.slotChanges(args[1], args[2])] {
+			rows.values = append(rows.values, []driver.Value{tx.lsn, tx.data})
+		}
+	case sqlSlotGetChanges:
+		n := s.c.slotChanges(args[1], args[2])
+		s.c.slot = s.c.slot[n:]
+		s.c.consumed = append(s.c.consumed, n)
+		rows.values = append(rows.values, []driver.Value{int64(n)})
+	case sqlFetchOverflow:
+		if row, ok := s.c.overflow[args[0].(int64)]; ok {
+			rows.values = append(rows.values, []driver.Value{row[0], row[1]})
+		}
+	default:
+		if row, ok := s.c.rows[s.query]; ok {
+			rows.values = append(rows.values, []driver.Value{row})
+		}
+	}
+	return rows, nil
+}
+
+type fakeSlotTx struct {
+	lsn  string // 事务开始的位置，peek返回的lsn
+	end  string // 事务提交之后的位置
+	data string
+}
+
+// slotChanges 与pg_logical_slot_*_changes相同: 只返回在upto之前提交的事务，
+// nchanges在每个事务结束后检查，0或者NULL表示不限制
+func (c *fakeCatalog) slotChanges(upto, nchanges driver.Value) int {
+	n := 0
+	for _, tx := range c.slot {
+		if upto != nil && parseLSN(tx.end) > parseLSN(upto.(string)) {
+			break
+		}
+		n++
+		if limit, ok := nchanges.(int64); ok && limit > 0 && int64(n) >= limit {
+			break
+		}
+	}
+	return n
+}
+
+// parseLSN 解析pg_lsn的文本格式 X/Y (十六进制)
+func parseLSN(lsn string) uint64 {
+	parts := strings.SplitN(lsn, "/", 2)
+	if len(parts) != 2 {
+		panic("invalid lsn " + lsn)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		panic(err)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		panic(err)
+	}
+	return hi<<32 | lo
+}
+
+type fakeRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.values) > 0 {
+		return make([]string, len(r.values[0]))
+	}
+	return []string{"value"}
+}
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
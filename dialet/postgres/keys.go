@@ -0,0 +1,161 @@
+package postgres
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	ptypes_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// 主键: 注册时从pg_index获取，触发器模式下作为触发器的参数，由pqstream_notify生成事件的key
+// 复制槽模式下根据payload生成，key的值都是文本，避免bigint、numeric等类型丢失精度
+
+// primaryKey 表的主键列，没有主键时为空
+func (s *Stream) primaryKey(t Table) ([]string, error) {
+	rows, err := s.db.Query(sqlPrimaryKey, t.Schema, t.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "query primary key")
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, errors.Wrap(err, "scan primary key")
+		}
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
+}
+
+// installedTriggers 已经安装的触发器名称以及参数
+func (s *Stream) installedTriggers(t Table) (map[string][]string, error) {
+	rows, err := s.db.Query(sqlTriggerArgs, t.Schema, t.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "query trigger")
+	}
+	defer rows.Close()
+	installed := map[string][]string{}
+	for rows.Next() {
+		var (
+			name string
+			raw  []byte
+		)
+		if err := rows.Scan(&name, &raw); err != nil {
+			return nil, errors.Wrap(err, "scan trigger")
+		}
+		installed[name] = triggerArgs(raw)
+	}
+	return installed, rows.Err()
+}
+
+// triggerArgs pg_trigger.tgargs中每个参数以\0结尾
+func triggerArgs(raw []byte) []string {
+	args := []string{}
+	for _, arg := range bytes.Split(raw, []byte{0}) {
+		args = append(args, string(arg))
+	}
+	// 最后一个\0之后为空
+	return args[:len(args)-1]
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// triggerDefinition 安装触发器的sql，主键列作为参数
+func triggerDefinition(t Table, key []string) string {
+	args := make([]string, 0, len(key))
+	for _, col := range key {
+		args = append(args, pq.QuoteLiteral(col))
+	}
+	return fmt.Sprintf(sqlInstallTrigger, t.Quote(), strings.Join(args, ", "))
+}
+
+// keyColumns 已注册的表的主键列
+func (s *Stream) keyColumns(table string) []string {
+	s.tablesMu.RLock()
+	defer s.tablesMu.RUnlock()
+	return s.keys[table]
+}
+
+func (s *Stream) setKeyColumns(table string, key []string) {
+	s.tablesMu.Lock()
+	defer s.tablesMu.Unlock()
+	if len(key) == 0 {
+		delete(s.keys, table)
+		return
+	}
+	s.keys[table] = key
+}
+
+// payloadKey 根据payload生成key，与pqstream_notify的格式相同，缺少主键列时返回nil
+func payloadKey(payload *ptypes_struct.Struct, columns []string) map[string]string {
+	if payload == nil || len(columns) == 0 {
+		return nil
+	}
+	key := make(map[string]string, len(columns))
+	for _, col := range columns {
+		v, ok := payload.Fields[col]
+		if !ok {
+			return nil
+		}
+		key[col] = keyValue(v)
+	}
+	return key
+}
+
+// keyID 与pqstream_notify相同，单列主键时为主键的值，复合主键时为空
+func keyID(key map[string]string) string {
+	if len(key) != 1 {
+		return ""
+	}
+	for _, v := range key {
+		return v
+	}
+	return ""
+}
+
+// keyValue 与json_extract_path_text的格式相同
+func keyValue(v *ptypes_struct.Value) string {
+	switch k := v.GetKind().(type) {
+	case *ptypes_struct.Value_StringValue:
+		return k.StringValue
+	case *ptypes_struct.Value_NumberValue:
+		return strconv.FormatFloat(k.NumberValue, 'f', -1, 64)
+	case *ptypes_struct.Value_BoolValue:
+		return strconv.FormatBool(k.BoolValue)
+	}
+	return ""
+}
+
+// fetchRowQuery 根据主键查询整行，columns为空时按照列名排序
+// 参数不指定类型，由数据库根据列的类型转换，uuid、bigint、text等都适用
+func fetchRowQuery(t Table, columns []string, key map[string]string) (string, []interface{}) {
+	if len(columns) == 0 {
+		for col := range key {
+			columns = append(columns, col)
+		}
+		sort.Strings(columns)
+	}
+	conds := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for i, col := range columns {
+		conds = append(conds, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(col), i+1))
+		args = append(args, key[col])
+	}
+	return fmt.Sprintf(sqlFetchRowByKey, t.Quote(), strings.Join(conds, " AND ")), args
+}
@@ -0,0 +1,186 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// 与pqstream_notify()的输出格式相同，key的值都是文本
+func TestHandleEventKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		key   map[string]string
+		id    string
+	}{
+		{
+			"uuid",
+			`{"schema":"public","table":"users","op":"INSERT","id":"8a6e0804-2bd0-4672-b79d-d97027f9071a",` +
+				`"key":{"uid":"8a6e0804-2bd0-4672-b79d-d97027f9071a"},"payload":{"uid":"8a6e0804-2bd0-4672-b79d-d97027f9071a"}}`,
+			map[string]string{"uid": "8a6e0804-2bd0-4672-b79d-d97027f9071a"},
+			"8a6e0804-2bd0-4672-b79d-d97027f9071a",
+		},
+		{
+			// 超过2^53的bigint在payload中会丢失精度，key中是准确的
+			"bigint",
+			`{"schema":"public","table":"events","op":"INSERT","id":"9007199254740993",` +
+				`"key":{"seq":"9007199254740993"},"payload":{"seq":9007199254740993}}`,
+			map[string]string{"seq": "9007199254740993"},
+			"9007199254740993",
+		},
+		{
+			"text",
+			`{"schema":"public","table":"settings","op":"DELETE","id":"site.name",` +
+				`"key":{"name":"site.name"},"payload":{"name":"site.name","value":"x"}}`,
+			map[string]string{"name": "site.name"},
+			"site.name",
+		},
+		{
+			"composite",
+			`{"schema":"tenant_1","table":"order_lines","op":"UPDATE","id":null,` +
+				`"key":{"order_id":"7","line_no":"2"},"payload":{"order_id":7,"line_no":2,"qty":3},` +
+				`"previous":{"order_id":7,"line_no":2,"qty":1}}`,
+			map[string]string{"order_id": "7", "line_no": "2"},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := handleNotification(t, tt.extra)
+			assert.Equal(t, tt.key, l.Key)
+			assert.Equal(t, tt.id, l.Id)
+		})
+	}
+}
+
+func TestInstallTriggerPrimaryKey(t *testing.T) {
+	s, c := newFakeStream(t, map[string][]string{
+		"public.users":         {"uid"},
+		"public.events":        {"seq"},
+		"public.settings":      {"name"},
+		"tenant_1.order_lines": {"order_id", "line_no"},
+	})
+
+	for table, want := range map[Table]string{
+		{Schema: "public", Name: "users"}:         `EXECUTE PROCEDURE pqstream_notify('uid');`,
+		{Schema: "public", Name: "events"}:        `EXECUTE PROCEDURE pqstream_notify('seq');`,
+		{Schema: "public", Name: "settings"}:      `EXECUTE PROCEDURE pqstream_notify('name');`,
+		{Schema: "tenant_1", Name: "order_lines"}: `EXECUTE PROCEDURE pqstream_notify('order_id', 'line_no');`,
+		{Schema: "public", Name: "logs"}:          `EXECUTE PROCEDURE pqstream_notify();`,
+	} {
+		c.execs = nil
+		require.Nil(t, s.installTrigger(table))
+		require.Len(t, c.execs, 2, table)
+		assert.Contains(t, c.execs[0], `DROP TRIGGER IF EXISTS pqstream_notify ON `+table.Quote())
+		assert.Contains(t, c.execs[1], want)
+		assert.Contains(t, c.execs[1], `AFTER TRUNCATE ON `+table.Quote())
+		assert.Contains(t, c.execs[1], `CREATE CONSTRAINT TRIGGER pqstream_commit`)
+	}
+	assert.Equal(t, []string{"order_id", "line_no"}, s.keyColumns("tenant_1.order_lines"))
+	assert.Nil(t, s.keyColumns("logs"))
+
+	// 主键相同时不重新创建
+	c.triggers["public.users"] = map[string][]byte{
+		"pqstream_notify": []byte("uid\x00"), "pqstream_notify_truncate": nil, "pqstream_commit": nil,
+	}
+	c.execs = nil
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "users"}))
+	assert.Empty(t, c.execs)
+
+	// 主键发生变化
+	c.triggers["public.users"]["pqstream_notify"] = []byte("id\x00")
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "users"}))
+	assert.Len(t, c.execs, 2)
+
+	// 之前的版本没有truncate触发器
+	c.triggers["public.users"] = map[string][]byte{"pqstream_notify": []byte("uid\x00")}
+	c.execs = nil
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "users"}))
+	assert.Len(t, c.execs, 2)
+
+	// 之前的版本没有提交触发器
+	c.triggers["public.users"] = map[string][]byte{"pqstream_notify": []byte("uid\x00"), "pqstream_notify_truncate": nil}
+	c.execs = nil
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "users"}))
+	assert.Len(t, c.execs, 2)
+
+	require.Nil(t, s.removeTrigger(Table{Schema: "tenant_1", Name: "order_lines"}))
+	assert.Nil(t, s.keyColumns("tenant_1.order_lines"))
+}
+
+func TestTriggerArgs(t *testing.T) {
+	assert.Equal(t, []string{}, triggerArgs(nil))
+	assert.Equal(t, []string{"id"}, triggerArgs([]byte("id\x00")))
+	assert.Equal(t, []string{"order_id", "line_no"}, triggerArgs([]byte("order_id\x00line_no\x00")))
+}
+
+func TestFetchRowQuery(t *testing.T) {
+	table := Table{Schema: "tenant_1", Name: "order_lines"}
+	key := map[string]string{"order_id": "7", "line_no": "2"}
+
+	q, args := fetchRowQuery(table, []string{"order_id", "line_no"}, key)
+	assert.Contains(t, q, `from "tenant_1"."order_lines" where "order_id" = $1 AND "line_no" = $2`)
+	assert.Equal(t, []interface{}{"7", "2"}, args)
+
+	// 没有记录主键时按照列名排序
+	q, args = fetchRowQuery(table, nil, key)
+	assert.Contains(t, q, `where "line_no" = $1 AND "order_id" = $2`)
+	assert.Equal(t, []interface{}{"2", "7"}, args)
+}
+
+// payload为空时根据key查询整行
+func TestPublishFallbackLookup(t *testing.T) {
+	s, c := newFakeStream(t, map[string][]string{"public.users": {"uid"}})
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "users"}))
+
+	q := make(chan string, 1)
+	require.Nil(t, s.publish(&RawEvent{
+		Schema: "public", Table: "users", Op: Operation_INSERT,
+		Key: map[string]string{"uid": "8a6e0804-2bd0-4672-b79d-d97027f9071a"},
+	}, q))
+	want, _ := fetchRowQuery(Table{Schema: "public", Name: "users"}, []string{"uid"}, nil)
+	assert.Contains(t, c.queries, want)
+
+	l, err := NewPostgresLog(<-q)
+	require.Nil(t, err)
+	assert.Equal(t, "8a6e0804-2bd0-4672-b79d-d97027f9071a", l.Key["uid"])
+}
+
+// 复制槽模式下由payload生成key
+func TestPublishPayloadKey(t *testing.T) {
+	s, _ := newFakeStream(t, map[string][]string{
+		"public.users":         {"uid"},
+		"tenant_1.order_lines": {"order_id", "line_no"},
+	})
+	s.slot = "test"
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "users"}))
+	require.Nil(t, s.installTrigger(Table{Schema: "tenant_1", Name: "order_lines"}))
+
+	payload := func(m map[string]interface{}) *structpb.Struct {
+		p, err := structpb.NewStruct(m)
+		require.Nil(t, err)
+		return p
+	}
+	q := make(chan string, 2)
+	require.Nil(t, s.publish(&RawEvent{
+		Schema: "public", Table: "users", Op: Operation_INSERT,
+		Payload: payload(map[string]interface{}{"uid": "8a6e0804-2bd0-4672-b79d-d97027f9071a", "id": 1}),
+	}, q))
+	require.Nil(t, s.publish(&RawEvent{
+		Schema: "tenant_1", Table: "order_lines", Op: Operation_INSERT, Id: "1",
+		Payload: payload(map[string]interface{}{"order_id": 1000000, "line_no": 2}),
+	}, q))
+
+	l, err := NewPostgresLog(<-q)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"uid": "8a6e0804-2bd0-4672-b79d-d97027f9071a"}, l.Key)
+	assert.Equal(t, "8a6e0804-2bd0-4672-b79d-d97027f9071a", l.Id)
+
+	l, err = NewPostgresLog(<-q)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"order_id": "1000000", "line_no": "2"}, l.Key)
+	assert.Empty(t, l.Id)
+}
@@ -2,7 +2,10 @@ package postgres
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
+
+	"github.com/wwqdrh/datamanager/dialet/diff"
 )
 
 type PostgresLog struct {
@@ -12,10 +15,40 @@ type PostgresLog struct {
 	Id      string                 `json:"id"`
 	Payload map[string]interface{} `json:"payload"`
 	Changes map[string]interface{} `json:"changes"`
+	Time    time.Time              `json:"time"` // 事务时间，复制槽模式下为提交时间
+	Txid    int64                  `json:"txid"`
+	Tag     string                 `json:"tag"`           // ddl的命令标签，例如CREATE TABLE
+	Key     map[string]string      `json:"key,omitempty"` // 主键列以及文本格式的值，没有主键时为空
+	Seq     int64                  `json:"seq,omitempty"` // 在事务中的序号，从1开始
+	Diff    []diff.Column          `json:"diff"`          // update中每一列修改前后的值，没有修改前的数据时为空
+}
+
+// newPostgresLog 由Event转换
+func newPostgresLog(e *Event) *PostgresLog {
+	l := &PostgresLog{
+		Schema: e.Schema,
+		Table:  e.Table,
+		Op:     int(e.Op),
+		Id:     e.Id,
+		Txid:   e.Txid,
+		Tag:    e.Tag,
+		Key:    e.Key,
+		Seq:    e.Seq,
+	}
+	if e.Payload != nil {
+		l.Payload = e.Payload.AsMap()
+	}
+	if e.Changes != nil {
+		l.Changes = e.Changes.AsMap()
+	}
+	if e.Time != nil {
+		l.Time = e.Time.AsTime()
+	}
+	return l
 }
 
 // log unmarshal to struct
-// example: {"schema":"public","table":"notes","op":1,"id":"14","payload":{"created_at":null,"id":14,"name":"user1","note":"here is a sample note"}}
+// example: {"schema":"public","table":"notes","op":1,"id":"14","payload":{"created_at":null,"id":14,"name":"user1","note":"here is a sample note"},"time":"2022-08-08T12:00:00.123456Z","txid":731}
 func NewPostgresLog(log string) (*PostgresLog, error) {
 	var l *PostgresLog
 	if err := json.Unmarshal([]byte(log), &l); err != nil {
@@ -34,17 +67,23 @@ func (l *PostgresLog) GetTable() string {
 
 // 获取日志记录类型 ddl dml
 func (l *PostgresLog) GetType() string {
-	return ""
+	if Operation(l.Op) == Operation_DDL {
+		return "ddl"
+	}
+	return "dml"
 }
 
-// 具体标签 insert update delete | alter column, table
+// 具体标签 insert update delete truncate | ddl为小写的命令标签，例如 create table
 func (l *PostgresLog) GetLabel() string {
-	return "insert"
+	if Operation(l.Op) == Operation_DDL {
+		return strings.ToLower(l.Tag)
+	}
+	return strings.ToLower(Operation(l.Op).String())
 }
 
 // 获取日志记录时间
 func (l *PostgresLog) GetTime() time.Time {
-	return time.Now()
+	return l.Time
 }
 
 // 获取具体的负载对象
@@ -55,3 +94,8 @@ func (l *PostgresLog) GetPaylod() map[string]interface{} {
 func (l *PostgresLog) GetChange() map[string]interface{} {
 	return l.Changes
 }
+
+// GetDiff update中发生变化的列，复制槽模式下需要REPLICA IDENTITY FULL
+func (l *PostgresLog) GetDiff() []diff.Column {
+	return l.Diff
+}
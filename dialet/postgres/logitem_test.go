@@ -1,15 +1,103 @@
 package postgres
 
 import (
-	"fmt"
 	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet/diff"
 )
 
 func TestUnmarshal(t *testing.T) {
-	log, err := NewPostgresLog(`{"schema":"public","table":"notes","op":1,"id":"14","payload":{"created_at":null,"id":14,"name":"user1","note":"here is a sample note"}}`)
-	if err != nil {
-		t.Error(err)
-	} else {
-		fmt.Println(log.Payload)
+	log, err := NewPostgresLog(`{"schema":"public","table":"notes","op":1,"id":"14","payload":{"created_at":null,"id":14,"name":"user1","note":"here is a sample note"},"time":"2022-08-08T12:00:00.123456Z","txid":731}`)
+	require.Nil(t, err)
+	assert.Equal(t, "user1", log.Payload["name"])
+	assert.Equal(t, "insert", log.GetLabel())
+	assert.Equal(t, "dml", log.GetType())
+	assert.Equal(t, int64(731), log.Txid)
+	assert.Equal(t, time.Date(2022, 8, 8, 12, 0, 0, 123456000, time.UTC), log.GetTime())
+}
+
+func TestPostgresLogLabel(t *testing.T) {
+	for op, want := range map[Operation]string{
+		Operation_INSERT:   "insert",
+		Operation_UPDATE:   "update",
+		Operation_DELETE:   "delete",
+		Operation_TRUNCATE: "truncate",
+	} {
+		l := &PostgresLog{Op: int(op)}
+		assert.Equal(t, want, l.GetLabel())
+		assert.Equal(t, "dml", l.GetType())
 	}
+
+	l := &PostgresLog{Op: int(Operation_DDL), Tag: "ALTER TABLE"}
+	assert.Equal(t, "alter table", l.GetLabel())
+	assert.Equal(t, "ddl", l.GetType())
+}
+
+// handleNotification 将触发器的通知转换为PostgresLog
+func handleNotification(t *testing.T, extra string) *PostgresLog {
+	s := &Stream{}
+	q := make(chan string, 1)
+	require.Nil(t, s.handleEvent(&pq.Notification{Channel: channel, Extra: extra}, q))
+	l, err := NewPostgresLog(<-q)
+	require.Nil(t, err)
+	return l
+}
+
+// 与pqstream_notify()的输出格式相同
+func TestHandleEventTrigger(t *testing.T) {
+	l := handleNotification(t, `{"schema":"public","table":"notes","op":"UPDATE","id":"1",`+
+		`"payload":{"id":1,"note":"b"},"previous":{"id":1,"note":"a"},`+
+		`"time":"2022-08-08T12:00:00.123456Z","txid":731}`)
+
+	assert.Equal(t, "update", l.GetLabel())
+	assert.Equal(t, "dml", l.GetType())
+	assert.Equal(t, int64(731), l.Txid)
+	assert.Equal(t, time.Date(2022, 8, 8, 12, 0, 0, 123456000, time.UTC), l.GetTime())
+	// changes记录的是修改前的值
+	assert.Equal(t, map[string]interface{}{"note": "a"}, l.GetChange())
+	assert.Equal(t, []diff.Column{{Name: "note", Old: "a", New: "b"}}, l.GetDiff())
+
+	// 设置为null与未变化的列区分
+	l = handleNotification(t, `{"schema":"public","table":"notes","op":"UPDATE","id":"1",`+
+		`"payload":{"id":1,"note":null,"title":"t"},"previous":{"id":1,"note":"a","title":"t"},"txid":731}`)
+	assert.Equal(t, []diff.Column{{Name: "note", Old: "a", New: nil}}, l.GetDiff())
+
+	// insert没有diff
+	l = handleNotification(t, `{"schema":"public","table":"notes","op":"INSERT","id":"1","payload":{"id":1},"txid":731}`)
+	assert.Nil(t, l.GetDiff())
+}
+
+// 与pqstream_notify()中truncate的输出格式相同，没有payload
+func TestHandleEventTruncate(t *testing.T) {
+	l := handleNotification(t, `{"schema":"public","table":"notes","op":"TRUNCATE",`+
+		`"time":"2022-08-08T12:00:00Z","txid":760}`)
+	assert.Equal(t, "truncate", l.GetLabel())
+	assert.Equal(t, "dml", l.GetType())
+	assert.Equal(t, "notes", l.GetTable())
+	assert.Nil(t, l.GetPaylod())
+	assert.Empty(t, l.Key)
+}
+
+// 与ddl_end_log_function()的输出格式相同
+func TestHandleEventDDL(t *testing.T) {
+	l := handleNotification(t, `{"schema":"public","table":"notes","op":"DDL","tag":"ALTER TABLE",`+
+		`"time":"2022-08-08T12:00:00.5Z","txid":732,`+
+		`"payload":{"query":"alter table notes add column title text"}}`)
+
+	assert.Equal(t, "ddl", l.GetType())
+	assert.Equal(t, "alter table", l.GetLabel())
+	assert.Equal(t, "notes", l.GetTable())
+	assert.Equal(t, "ALTER TABLE", l.Tag)
+	assert.Equal(t, int64(732), l.Txid)
+	assert.Equal(t, "alter table notes add column title text", l.GetPaylod()["query"])
+
+	// 没有表对象时表信息为空
+	l = handleNotification(t, `{"schema":null,"table":null,"op":"DDL","tag":"DROP SCHEMA",`+
+		`"time":"2022-08-08T12:00:00Z","txid":733,"payload":{"query":"drop schema empty"}}`)
+	assert.Equal(t, "drop schema", l.GetLabel())
+	assert.Empty(t, l.GetTable())
 }
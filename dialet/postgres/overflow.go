@@ -0,0 +1,67 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	ptypes_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// 超过NOTIFY限制(8000字节)的事件: pqstream_notify将整行写入dbnotify_overflow，通知中只有key以及overflow序号
+// handleEvent根据序号取回payload以及previous，delete事件同样适用
+// 多个实例可能监听同一个数据库，读取后不删除，超过保留时间后由HandleEvents清理
+
+const defaultOverflowRetention = time.Hour
+
+var (
+	sqlFetchOverflow = `
+SELECT row_payload::text, row_previous::text FROM dbnotify_overflow WHERE seq = $1
+`
+	sqlPurgeOverflow = `
+DELETE FROM dbnotify_overflow WHERE created_at < now() - $1 * interval '1 second'
+`
+)
+
+// WithOverflowRetention controls how long oversized rows are kept in dbnotify_overflow.
+func WithOverflowRetention(d time.Duration) ServerOption {
+	return func(s *Stream) {
+		s.overflowRetention = d
+	}
+}
+
+// rehydrate 取回写入dbnotify_overflow的payload以及previous
+func (s *Stream) rehydrate(re *RawEvent) error {
+	var payload, previous sql.NullString
+	err := s.db.QueryRow(sqlFetchOverflow, re.Overflow).Scan(&payload, &previous)
+	if err == sql.ErrNoRows {
+		return errors.Errorf("overflow %d not found", re.Overflow)
+	}
+	if err != nil {
+		return errors.Wrap(err, "overflow query")
+	}
+	if payload.Valid {
+		re.Payload = &ptypes_struct.Struct{}
+		if err := protojson.Unmarshal([]byte(payload.String), re.Payload); err != nil {
+			return errors.Wrap(err, "overflow payload")
+		}
+	}
+	if previous.Valid {
+		re.Previous = &ptypes_struct.Struct{}
+		if err := protojson.Unmarshal([]byte(previous.String), re.Previous); err != nil {
+			return errors.Wrap(err, "overflow previous")
+		}
+	}
+	return nil
+}
+
+func (s *Stream) purgeOverflow() {
+	if s.slot != "" {
+		return
+	}
+	if _, err := s.db.Exec(sqlPurgeOverflow, s.overflowRetention.Seconds()); err != nil {
+		fmt.Println("overflow " + err.Error() + "purge failed")
+	}
+}
@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 与pqstream_notify()超过限制时的输出格式相同，没有payload以及previous
+func overflowNotification(s *Stream, t *testing.T, extra string) *PostgresLog {
+	q := make(chan string, 1)
+	require.Nil(t, s.handleEvent(&pq.Notification{Channel: channel, Extra: extra}, q))
+	l, err := NewPostgresLog(<-q)
+	require.Nil(t, err)
+	return l
+}
+
+func TestHandleEventOverflow(t *testing.T) {
+	s, c := newFakeStream(t, map[string][]string{"public.notes": {"id"}})
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "notes"}))
+	c.overflow[3] = [2]interface{}{`{"id":1,"note":"b"}`, `{"id":1,"note":"a"}`}
+	c.overflow[4] = [2]interface{}{`{"id":2,"note":"deleted"}`, nil}
+
+	l := overflowNotification(s, t, `{"schema":"public","table":"notes","op":"UPDATE","id":"1","key":{"id":"1"},`+
+		`"overflow":3,"time":"2022-08-08T12:00:00Z","txid":750}`)
+	assert.Equal(t, "b", l.Payload["note"])
+	assert.Equal(t, map[string]interface{}{"note": "a"}, l.GetChange())
+	assert.Equal(t, int64(750), l.Txid)
+
+	// 行已经删除，只能通过写入的副本取回
+	l = overflowNotification(s, t, `{"schema":"public","table":"notes","op":"DELETE","id":"2","key":{"id":"2"},`+
+		`"overflow":4,"time":"2022-08-08T12:00:00Z","txid":751}`)
+	assert.Equal(t, "delete", l.GetLabel())
+	assert.Equal(t, "deleted", l.Payload["note"])
+	assert.Empty(t, l.GetChange())
+}
+
+// 副本已经被清理时根据key查询当前的行
+func TestHandleEventOverflowMissing(t *testing.T) {
+	s, c := newFakeStream(t, map[string][]string{"public.notes": {"id"}})
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "notes"}))
+
+	overflowNotification(s, t, `{"schema":"public","table":"notes","op":"INSERT","id":"1","key":{"id":"1"},"overflow":9}`)
+	want, _ := fetchRowQuery(Table{Schema: "public", Name: "notes"}, []string{"id"}, nil)
+	assert.Contains(t, c.queries, sqlFetchOverflow)
+	assert.Contains(t, c.queries, want)
+
+	// delete不查询
+	c.queries = nil
+	overflowNotification(s, t, `{"schema":"public","table":"notes","op":"DELETE","id":"1","key":{"id":"1"},"overflow":10}`)
+	assert.Equal(t, []string{sqlFetchOverflow}, c.queries)
+}
+
+// 查询回来的行同样脱敏
+func TestHandleEventOverflowRedact(t *testing.T) {
+	s, c := newFakeStream(t, map[string][]string{"public.notes": {"id"}})
+	require.Nil(t, s.installTrigger(Table{Schema: "public", Name: "notes"}))
+	s.redactions = FieldRedactions{"public": {"notes": {"secret"}}}
+	query, _ := fetchRowQuery(Table{Schema: "public", Name: "notes"}, []string{"id"}, nil)
+	c.rows[query] = `{"id":1,"note":"a","secret":"s"}`
+
+	l := overflowNotification(s, t, `{"schema":"public","table":"notes","op":"INSERT","id":"1","key":{"id":"1"},"overflow":9}`)
+	assert.Equal(t, map[string]interface{}{"id": float64(1), "note": "a"}, l.Payload)
+}
+
+func TestPurgeOverflow(t *testing.T) {
+	s, c := newFakeStream(t, nil)
+	s.overflowRetention = defaultOverflowRetention
+	s.purgeOverflow()
+	assert.Equal(t, []string{sqlPurgeOverflow}, c.execs)
+
+	// 复制槽模式没有overflow
+	c.execs = nil
+	s.slot = "test"
+	s.purgeOverflow()
+	assert.Empty(t, c.execs)
+}
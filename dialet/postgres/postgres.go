@@ -3,30 +3,75 @@ package postgres
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"sync"
 
+	"github.com/wwqdrh/datamanager/dialet/broker"
 	"github.com/wwqdrh/logger"
 )
 
 var (
 	// 获取当前的所有数据表名
 	sqlQueryTables = `
-SELECT table_name
+SELECT table_schema, table_name
   FROM information_schema.tables
- WHERE table_schema='public'
+ WHERE table_schema NOT IN ('pg_catalog', 'information_schema')
    AND table_type='BASE TABLE'
+ ORDER BY table_schema, table_name
+`
+
+	// 当前连接的schema，触发器函数以及dbnotify_*表安装在该schema中
+	sqlCurrentSchema = `SELECT current_schema()`
+
+	// 以下函数的sql中%[1]s为安装的schema(见installSchema)，函数以及表的引用都带有schema
+	// 触发器函数使用SECURITY DEFINER并固定search_path，与执行dml、ddl的会话的search_path以及权限无关
+
+	// 事务内的事件序号，保存在事务级的配置中，事务结束后失效，回滚到保存点时一起回滚
+	// dml以及ddl的通知共用一个序号
+	sqlSeqFunction = `
+CREATE OR REPLACE FUNCTION %[1]s.dbnotify_next_seq() RETURNS bigint AS $$
+    DECLARE
+        seq bigint;
+    BEGIN
+        seq = COALESCE(NULLIF(current_setting('dbnotify.seq', true), '')::bigint, 0) + 1;
+        PERFORM set_config('dbnotify.seq', seq::text, true);
+        RETURN seq;
+    END;
+$$ LANGUAGE plpgsql;
 `
 
 	// 创建dml notify函数
-	sqlTriggerFunction = `
-CREATE EXTENSION IF NOT EXISTS hstore;
-CREATE OR REPLACE FUNCTION pqstream_notify() RETURNS TRIGGER AS $$
+	sqlTriggerFunction = sqlSeqFunction + `
+CREATE TABLE IF NOT EXISTS %[1]s.dbnotify_overflow (
+    seq          bigserial PRIMARY KEY,
+    row_payload  json,
+    row_previous json,
+    created_at   timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS dbnotify_overflow_created_at ON %[1]s.dbnotify_overflow (created_at);
+CREATE OR REPLACE FUNCTION %[1]s.pqstream_notify() RETURNS TRIGGER AS $$
     DECLARE 
         payload json;
         previous json;
+        key jsonb;
+        id text;
+        overflow bigint;
         notification json;
     BEGIN
+        -- 语句级触发器，没有行数据
+        IF (TG_OP = 'TRUNCATE') THEN
+            notification = json_build_object(
+                              'schema', TG_TABLE_SCHEMA,
+                              'table', TG_TABLE_NAME,
+                              'op', TG_OP,
+                              'time', to_char(transaction_timestamp() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+                              'txid', txid_current(),
+                              'seq', %[1]s.dbnotify_next_seq());
+            PERFORM %[1]s.dbnotify_mark_commit();
+            PERFORM pg_notify('pqstream_notify', notification::text);
+            RETURN NULL;
+        END IF;
+
         IF (TG_OP = 'DELETE') THEN
             payload = row_to_json(OLD);
         ELSE
@@ -36,37 +81,239 @@ CREATE OR REPLACE FUNCTION pqstream_notify() RETURNS TRIGGER AS $$
         IF (TG_OP = 'UPDATE') THEN
             previous = row_to_json(OLD);
         END IF;
+
+        -- 触发器参数为主键列，值统一转换为文本，避免bigint等类型丢失精度
+        IF TG_NARGS > 0 THEN
+            key = '{}'::jsonb;
+            FOR i IN 0 .. TG_NARGS - 1 LOOP
+                key = key || jsonb_build_object(TG_ARGV[i], json_extract_path_text(payload, TG_ARGV[i]));
+            END LOOP;
+        END IF;
+        -- 复合主键时id为空
+        IF TG_NARGS = 0 THEN
+            id = json_extract_path_text(payload, 'id');
+        ELSIF TG_NARGS = 1 THEN
+            id = json_extract_path_text(payload, TG_ARGV[0]);
+        END IF;
         
         notification = json_build_object(
                           'schema', TG_TABLE_SCHEMA,
                           'table', TG_TABLE_NAME,
                           'op', TG_OP,
-						  'id', json_extract_path(payload, 'id')::text,
+						  'id', id,
+						  'key', key,
                           'payload', payload,
-						  'previous', previous);
+						  'previous', previous,
+						  'time', to_char(transaction_timestamp() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+						  'txid', txid_current(),
+						  'seq', %[1]s.dbnotify_next_seq());
+        -- pg_notify的负载需要小于8000字节，超过时整行写入dbnotify_overflow，通知中只保留key以及overflow的序号
+        IF octet_length(notification::text) >= 8000 THEN
+            INSERT INTO %[1]s.dbnotify_overflow (row_payload, row_previous) VALUES (payload, previous)
+              RETURNING seq INTO overflow;
+            notification = (notification::jsonb - 'payload' - 'previous'
+                            || jsonb_build_object('overflow', overflow))::json;
+        END IF;
         PERFORM pg_notify('pqstream_notify', notification::text);
         RETURN NULL; 
     END;
-$$ LANGUAGE plpgsql;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = %[1]s, pg_temp;
+
+-- 延迟到提交时执行，每个事务只发送一次提交标记，seq为事务中最后一个事件的序号
+CREATE OR REPLACE FUNCTION %[1]s.pqstream_commit() RETURNS TRIGGER AS $$
+    BEGIN
+        -- dbnotify_commit_marker中的行只用于触发提交标记
+        IF TG_TABLE_SCHEMA = current_schema() AND TG_TABLE_NAME = 'dbnotify_commit_marker' THEN
+            DELETE FROM %[1]s.dbnotify_commit_marker WHERE txid = NEW.txid;
+        END IF;
+        IF current_setting('dbnotify.committed', true) = 'on' THEN
+            RETURN NULL;
+        END IF;
+        PERFORM set_config('dbnotify.committed', 'on', true);
+        PERFORM pg_notify('pqstream_notify', json_build_object(
+                          'op', 'COMMIT',
+                          'time', to_char(transaction_timestamp() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+                          'txid', txid_current(),
+                          'seq', COALESCE(NULLIF(current_setting('dbnotify.seq', true), '')::bigint, 0))::text);
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = %[1]s, pg_temp;
+
+-- 只有truncate或者ddl的事务没有行级的提交触发器，写入一行由dbnotify_commit_marker上的触发器发送提交标记
+CREATE TABLE IF NOT EXISTS %[1]s.dbnotify_commit_marker (txid bigint);
+CREATE OR REPLACE FUNCTION %[1]s.dbnotify_mark_commit() RETURNS void AS $$
+    BEGIN
+        IF current_setting('dbnotify.marked', true) = 'on' THEN
+            RETURN;
+        END IF;
+        PERFORM set_config('dbnotify.marked', 'on', true);
+        INSERT INTO %[1]s.dbnotify_commit_marker VALUES (txid_current());
+    END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = %[1]s, pg_temp;
+DROP TRIGGER IF EXISTS pqstream_commit ON %[1]s.dbnotify_commit_marker;
+CREATE CONSTRAINT TRIGGER pqstream_commit
+AFTER INSERT ON %[1]s.dbnotify_commit_marker
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE %[1]s.pqstream_commit();
 `
 
-	// 创建ddl notify函数
-	sqlDDLTriggerFunction = `
-	CREATE EXTENSION IF NOT EXISTS hstore;
-	CREATE OR REPLACE FUNCTION ddl_end_log_function() RETURNS event_trigger AS $$  
+	// 创建ddl notify函数，%[2]s为触发器模式下发送提交标记的语句(见ddlCommitMarker)
+	// dbnotify_columns保存表结构的快照，ALTER TABLE之后与pg_attribute对比得到新增、删除、改名以及修改类型的列
+	sqlDDLTriggerFunction = sqlSeqFunction + `
+	CREATE TABLE IF NOT EXISTS %[1]s.dbnotify_columns (
+		relid   oid,
+		attnum  int2,
+		attname name,
+		atttype text,
+		PRIMARY KEY (relid, attnum)
+	);
+
+	CREATE OR REPLACE FUNCTION %[1]s.dbnotify_snapshot_columns(rel oid) RETURNS void AS $$
+		DELETE FROM %[1]s.dbnotify_columns WHERE relid = rel;
+		INSERT INTO %[1]s.dbnotify_columns (relid, attnum, attname, atttype)
+		SELECT attrelid, attnum, attname, format_type(atttypid, atttypmod)
+		  FROM pg_attribute
+		 WHERE attrelid = rel AND attnum > 0 AND NOT attisdropped;
+	$$ LANGUAGE sql;
+
+	CREATE OR REPLACE FUNCTION %[1]s.dbnotify_column_changes(rel oid) RETURNS json AS $$
+		SELECT json_agg(json_build_object(
+				'action', c.action, 'name', c.name, 'type', c.type, 'previous', c.previous) ORDER BY c.attnum)
+		  FROM (
+			SELECT a.attnum, 'added' AS action, a.attname::text AS name,
+			       format_type(a.atttypid, a.atttypmod) AS type, NULL::text AS previous
+			  FROM pg_attribute a
+			 WHERE a.attrelid = rel AND a.attnum > 0 AND NOT a.attisdropped
+			   AND NOT EXISTS (SELECT 1 FROM %[1]s.dbnotify_columns s WHERE s.relid = rel AND s.attnum = a.attnum)
+			UNION ALL
+			SELECT s.attnum, 'dropped', s.attname::text, s.atttype, NULL
+			  FROM %[1]s.dbnotify_columns s
+			 WHERE s.relid = rel
+			   AND NOT EXISTS (SELECT 1 FROM pg_attribute a
+			                    WHERE a.attrelid = rel AND a.attnum = s.attnum AND NOT a.attisdropped)
+			UNION ALL
+			SELECT a.attnum, 'renamed', a.attname::text, format_type(a.atttypid, a.atttypmod), s.attname::text
+			  FROM pg_attribute a
+			  JOIN %[1]s.dbnotify_columns s ON s.relid = rel AND s.attnum = a.attnum
+			 WHERE a.attrelid = rel AND NOT a.attisdropped AND a.attname <> s.attname
+			UNION ALL
+			SELECT a.attnum, 'retyped', a.attname::text, format_type(a.atttypid, a.atttypmod), s.atttype
+			  FROM pg_attribute a
+			  JOIN %[1]s.dbnotify_columns s ON s.relid = rel AND s.attnum = a.attnum
+			 WHERE a.attrelid = rel AND NOT a.attisdropped AND format_type(a.atttypid, a.atttypmod) <> s.atttype
+		  ) c;
+	$$ LANGUAGE sql;
+
+	CREATE OR REPLACE FUNCTION %[1]s.ddl_end_log_function() RETURNS event_trigger AS $$
+		DECLARE
+			cmd record;
+			columns json;
+			rel_name text;
+			objects json[] := '{}';
+			ddl_schema text;
+			ddl_table text;
+			notification json;
+		BEGIN
+			FOR cmd IN SELECT * FROM pg_event_trigger_ddl_commands() LOOP
+				columns := NULL;
+				rel_name := NULL;
+				IF cmd.object_type = 'table' THEN
+					SELECT relname INTO rel_name FROM pg_class WHERE oid = cmd.objid;
+					-- 新建的表所有列都是新增的，没有快照的表无法得到变化的列
+					IF cmd.command_tag IN ('CREATE TABLE', 'CREATE TABLE AS', 'SELECT INTO')
+					   OR EXISTS (SELECT 1 FROM %[1]s.dbnotify_columns WHERE relid = cmd.objid) THEN
+						columns := %[1]s.dbnotify_column_changes(cmd.objid);
+					END IF;
+					PERFORM %[1]s.dbnotify_snapshot_columns(cmd.objid);
+					IF ddl_table IS NULL THEN
+						ddl_schema := cmd.schema_name;
+						ddl_table := rel_name;
+					END IF;
+				END IF;
+				objects := objects || json_build_object(
+					'command_tag', cmd.command_tag,
+					'object_type', cmd.object_type,
+					'schema', cmd.schema_name,
+					'name', rel_name,
+					'object_identity', cmd.object_identity,
+					'columns', columns);
+			END LOOP;
+			IF array_length(objects, 1) IS NULL THEN
+				RETURN;
+			END IF;
+			notification = json_build_object(
+				'schema', ddl_schema,
+				'table', ddl_table,
+				'op', 'DDL',
+				'tag', TG_TAG,
+				'time', to_char(transaction_timestamp() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				'txid', txid_current(),
+				'seq', %[1]s.dbnotify_next_seq(),
+				'payload', json_build_object(
+					'query', current_query(),
+					'objects', array_to_json(objects)));
+			%[2]s
+			PERFORM pg_notify('pqstream_notify', notification::text);
+		END;
+	$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = %[1]s, pg_temp;
+
+	CREATE OR REPLACE FUNCTION %[1]s.ddl_drop_log_function() RETURNS event_trigger AS $$
 		DECLARE
-			rec hstore;  
+			obj record;
+			objects json[] := '{}';
+			ddl_schema text;
+			ddl_table text;
 			notification json;
-		BEGIN   
-	  		select hstore(pg_stat_activity.*) into rec from pg_stat_activity where pid=pg_backend_pid();
+		BEGIN
+			FOR obj IN SELECT * FROM pg_event_trigger_dropped_objects() LOOP
+				IF obj.object_type = 'table' THEN
+					DELETE FROM %[1]s.dbnotify_columns WHERE relid = obj.objid;
+					IF ddl_table IS NULL AND obj.original THEN
+						ddl_schema := obj.schema_name;
+						ddl_table := obj.object_name;
+					END IF;
+				END IF;
+				-- original为false的是级联删除的对象，例如表上的索引、序列
+				objects := objects || json_build_object(
+					'command_tag', TG_TAG,
+					'object_type', obj.object_type,
+					'schema', obj.schema_name,
+					'name', obj.object_name,
+					'object_identity', obj.object_identity,
+					'original', obj.original);
+			END LOOP;
+			IF array_length(objects, 1) IS NULL THEN
+				RETURN;
+			END IF;
 			notification = json_build_object(
+				'schema', ddl_schema,
+				'table', ddl_table,
+				'op', 'DDL',
+				'tag', TG_TAG,
+				'time', to_char(transaction_timestamp() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				'txid', txid_current(),
+				'seq', %[1]s.dbnotify_next_seq(),
 				'payload', json_build_object(
-					 'query', rec->'query'
-					)
-				);
+					'query', current_query(),
+					'objects', array_to_json(objects)));
+			%[2]s
 			PERFORM pg_notify('pqstream_notify', notification::text);
-	 	END;  
-	$$ LANGUAGE plpgsql;`
+		END;
+	$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = %[1]s, pg_temp;`
+
+	// 重新生成所有表的结构快照，未运行期间的表结构变更无法上报
+	sqlSnapshotColumns = `
+DELETE FROM %[1]s.dbnotify_columns;
+INSERT INTO %[1]s.dbnotify_columns (relid, attnum, attname, atttype)
+SELECT a.attrelid, a.attnum, a.attname, format_type(a.atttypid, a.atttypmod)
+  FROM pg_attribute a
+  JOIN pg_class c ON c.oid = a.attrelid
+  JOIN pg_namespace n ON n.oid = c.relnamespace
+ WHERE c.relkind IN ('r', 'p')
+   AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+   AND n.nspname NOT LIKE 'pg_toast%%'
+   AND a.attnum > 0 AND NOT a.attisdropped;
+`
 
 	// insert into %s ("table_name", "log", "action", "time")
 	// values (SELECT
@@ -82,46 +329,97 @@ $$ LANGUAGE plpgsql;
 	// 	FROM pg_event_trigger_ddl_commands() left join select(rec,rec->'query',tg_tag,tg_event));
 	// 删除触发器
 	sqlRemoveTrigger = `
-DROP TRIGGER IF EXISTS pqstream_notify ON %s
+DROP TRIGGER IF EXISTS pqstream_notify ON %[1]s;
+DROP TRIGGER IF EXISTS pqstream_notify_truncate ON %[1]s;
+DROP TRIGGER IF EXISTS pqstream_commit ON %[1]s;
 `
 
 	sqlDDLRemoteTrigger = `
-DROP TRIGGER IF EXISTS ddl_end_log_trigger
-	`
+DROP EVENT TRIGGER IF EXISTS ddl_end_log_trigger;
+DROP EVENT TRIGGER IF EXISTS ddl_drop_log_trigger;
+`
 
 	// 安装触发器
+	// 已经安装的触发器以及参数(行级触发器的参数为主键列)
+	sqlTriggerArgs = `
+SELECT t.tgname, t.tgargs
+  FROM pg_trigger t
+  JOIN pg_class c ON c.oid = t.tgrelid
+  JOIN pg_namespace n ON n.oid = c.relnamespace
+ WHERE t.tgname IN ('pqstream_notify', 'pqstream_notify_truncate', 'pqstream_commit') AND n.nspname = $1 AND c.relname = $2
+`
+	// 行级触发器的参数为主键列，truncate为语句级触发器，pqstream_commit在提交时发送事务结束的标记
 	sqlInstallTrigger = `
 CREATE TRIGGER pqstream_notify
-AFTER INSERT OR UPDATE OR DELETE ON %s
-    FOR EACH ROW EXECUTE PROCEDURE pqstream_notify();
+AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+    FOR EACH ROW EXECUTE PROCEDURE pqstream_notify(%[2]s);
+CREATE TRIGGER pqstream_notify_truncate
+AFTER TRUNCATE ON %[1]s
+    FOR EACH STATEMENT EXECUTE PROCEDURE pqstream_notify();
+CREATE CONSTRAINT TRIGGER pqstream_commit
+AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE pqstream_commit();
+`
+	// 主键列，按照主键中的顺序
+	sqlPrimaryKey = `
+SELECT a.attname
+  FROM pg_index i
+  JOIN pg_class c ON c.oid = i.indrelid
+  JOIN pg_namespace n ON n.oid = c.relnamespace
+  JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+ WHERE i.indisprimary AND n.nspname = $1 AND c.relname = $2
+ ORDER BY array_position(i.indkey::int2[], a.attnum)
 `
 	sqlDDLInstallTrigger = `
 CREATE EVENT TRIGGER ddl_end_log_trigger
-ON ddl_command_end when TAG IN ('CREATE TABLE', 'DROP TABLE', 'ALTER TABLE')
-EXECUTE PROCEDURE ddl_end_log_function();
+ON ddl_command_end WHEN TAG IN ('CREATE TABLE', 'CREATE TABLE AS', 'SELECT INTO', 'ALTER TABLE')
+EXECUTE PROCEDURE %[1]s.ddl_end_log_function();
+CREATE EVENT TRIGGER ddl_drop_log_trigger
+ON sql_drop WHEN TAG IN ('DROP TABLE', 'DROP SCHEMA')
+EXECUTE PROCEDURE %[1]s.ddl_drop_log_function();
 `
 
-	// 根据rowid获取数据
-	sqlFetchRowByID = `
-	SELECT row_to_json(r)::text from (select * from %s where id = $1::%s) r;
+	// 根据主键获取数据，条件见fetchRowQuery
+	sqlFetchRowByKey = `
+	SELECT row_to_json(r)::text from (select * from %s where %s) r;
 `
 )
 
 type PostgresDialet struct {
 	dsn    string
 	stream *Stream
+
+	// 所有订阅者共享同一个事件流
+	broker *broker.Broker
+	// WatchTransactions的订阅者，按事务分组推送
+	txBroker *broker.Broker
+	batcher  *txBatcher
+	once     sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
-func NewPostgresDialet(dsn string) (*PostgresDialet, error) {
-	stream, err := NewServer(dsn)
+// NewPostgresDialet opts控制捕获方式，默认为触发器模式，WithLogicalReplication切换为复制槽模式
+func NewPostgresDialet(dsn string, opts ...ServerOption) (*PostgresDialet, error) {
+	stream, err := NewServer(dsn, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &PostgresDialet{
-		dsn:    dsn,
-		stream: stream,
-	}, nil
+	ctx, cancel := context.WithCancel(stream.ctx)
+	p := &PostgresDialet{
+		dsn:      dsn,
+		stream:   stream,
+		broker:   broker.New(stream.brokerOpts...),
+		txBroker: broker.New(stream.brokerOpts...),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	p.batcher = newTxBatcher(stream.txTimeout, func(tx *Transaction) {
+		p.txBroker.Publish(p.ctx, tx)
+	})
+	return p, nil
 }
 
 func (p *PostgresDialet) Stream() *Stream {
@@ -130,31 +428,62 @@ func (p *PostgresDialet) Stream() *Stream {
 
 // Initial
 func (p *PostgresDialet) Initial() error {
-	// p.stream.installTrigger()
-	if _, err := p.stream.db.Exec(sqlDDLTriggerFunction); err != nil {
+	schema, err := p.stream.installSchema()
+	if err != nil {
+		return err
+	}
+	// dml notify函数，Register安装的触发器依赖该函数
+	if p.stream.slot == "" {
+		if _, err := p.stream.db.Exec(fmt.Sprintf(sqlTriggerFunction, schema)); err != nil {
+			return err
+		}
+	}
+	if _, err := p.stream.db.Exec(fmt.Sprintf(sqlDDLTriggerFunction, schema, p.stream.ddlCommitMarker(schema))); err != nil {
+		return err
+	}
+	if _, err := p.stream.db.Exec(fmt.Sprintf(sqlSnapshotColumns, schema)); err != nil {
+		return err
+	}
+	// enable ddl，先删除上次运行残留的触发器
+	if _, err := p.stream.db.Exec(sqlDDLRemoteTrigger); err != nil {
 		return err
 	}
-	// enable ddl
-	if _, err := p.stream.db.Exec(sqlDDLInstallTrigger); err != nil {
+	if _, err := p.stream.db.Exec(fmt.Sprintf(sqlDDLInstallTrigger, schema)); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (p *PostgresDialet) Close() error {
+	p.cancel()
+	p.broker.Close()
+	p.txBroker.Close()
 	if _, err := p.stream.db.Exec(sqlDDLRemoteTrigger); err != nil {
 		return err
 	}
 	return p.stream.Close()
 }
 
-// Register add policy for table
+// Register add policy for table, table为[schema.]table，见ParseTable
 func (p *PostgresDialet) Register(table string) error {
-	return p.stream.installTrigger(table)
+	t, err := ParseTable(table)
+	if err != nil {
+		return err
+	}
+	return p.stream.installTrigger(t)
 }
 
 func (p *PostgresDialet) UnRegister(table string) error {
-	return p.stream.removeTrigger(table)
+	t, err := ParseTable(table)
+	if err != nil {
+		return err
+	}
+	return p.stream.removeTrigger(t)
+}
+
+// DefaultSchema 不带schema的表名在public中
+func (p *PostgresDialet) DefaultSchema() string {
+	return defaultSchema
 }
 
 // 修改指定数据库数据表的日志存储策略
@@ -173,26 +502,61 @@ func (p *PostgresDialet) DeletePolicy() error {
 }
 
 // 获取监听channel，能够获取当前的日志修改记录 日志记录格式需要
+// 每次调用都是一个独立的订阅者，都能收到全部事件，ctx结束后channel被关闭
 func (p *PostgresDialet) Watch(ctx context.Context) chan interface{} {
-	res := make(chan interface{}, 8)
+	return p.Subscribe(ctx).C()
+}
+
+// Subscribe 与Watch相同，opts可以单独配置该订阅者的缓冲区以及慢消费者策略
+func (p *PostgresDialet) Subscribe(ctx context.Context, opts ...broker.Option) *broker.Subscription {
+	sub := p.broker.SubscribeContext(ctx, opts...)
+	p.once.Do(func() {
+		go p.handleEvents()
+	})
+	return sub
+}
 
+// handleEvents 将stream的事件发布到broker，整个dialet只有一个
+func (p *PostgresDialet) handleEvents() {
 	q := make(chan string, 8)
 	go func() {
-		var r *PostgresLog
-		for item := range q {
-			if err := json.Unmarshal([]byte(item), &r); err != nil {
-				fmt.Println(err)
-				continue
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case item := <-q:
+				l, err := NewPostgresLog(item)
+				if err != nil {
+					logger.DefaultLogger.Error(err.Error())
+					continue
+				}
+				// 提交标记只用于事务分组，不推送
+				if Operation(l.Op) == Operation_COMMIT {
+					p.batcher.commit(l)
+					continue
+				}
+				// ddl作为单独的事件类型推送
+				if Operation(l.Op) == Operation_DDL {
+					ddl, err := NewPostgresDDL(l)
+					if err != nil {
+						logger.DefaultLogger.Error(err.Error())
+						continue
+					}
+					if err := p.stream.handleDDL(ddl); err != nil {
+						logger.DefaultLogger.Error(err.Error())
+					}
+					p.broker.Publish(p.ctx, ddl)
+					p.batcher.add(l, ddl)
+					continue
+				}
+				p.broker.Publish(p.ctx, l)
+				p.batcher.add(l, l)
 			}
-			res <- r
 		}
 	}()
-	go func() {
-		if err := p.stream.HandleEvents(ctx, q); err != nil {
-			logger.DefaultLogger.Error(err.Error())
-		}
-	}()
-	return res
+	if err := p.stream.HandleEvents(p.ctx, q); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
 }
 
 func (p *PostgresDialet) Exec(sql string, args ...interface{}) error {
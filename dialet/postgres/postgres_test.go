@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -101,3 +103,70 @@ func (s *PostgresSuite) TestAddTableAndInsertAndNotify() {
 	}
 	time.Sleep(5 * time.Second) // wait the event done
 }
+
+// 触发器函数中的函数以及表都带有schema，与执行dml、ddl的会话的search_path无关
+func TestFunctionSchemaQualified(t *testing.T) {
+	bare := regexp.MustCompile(`(^|[^.\w])(dbnotify_next_seq|dbnotify_overflow|dbnotify_columns|dbnotify_snapshot_columns|dbnotify_column_changes|ddl_end_log_function|ddl_drop_log_function)\b`)
+	comment := regexp.MustCompile(`--.*`)
+	for name, tpl := range map[string]string{
+		"trigger":  sqlTriggerFunction,
+		"ddl":      sqlDDLTriggerFunction,
+		"snapshot": sqlSnapshotColumns,
+		"install":  sqlDDLInstallTrigger,
+	} {
+		q := fmt.Sprintf(tpl, `"dbnotify"`, "")
+		assert.NotContains(t, q, "%!", name)
+		assert.Empty(t, bare.FindAllString(comment.ReplaceAllString(q, ""), -1), name)
+		assert.NotContains(t, q, "hstore", name)
+	}
+	assert.Contains(t, fmt.Sprintf(sqlTriggerFunction, `"dbnotify"`), `SECURITY DEFINER SET search_path = "dbnotify", pg_temp`)
+	// 事件触发器函数
+	assert.Equal(t, 2, strings.Count(fmt.Sprintf(sqlDDLTriggerFunction, `"dbnotify"`, ""), `SECURITY DEFINER SET search_path = "dbnotify", pg_temp`))
+}
+
+// 只有truncate或者ddl的事务通过dbnotify_commit_marker发送提交标记，复制槽模式下由pollReplication生成
+func TestCommitMarker(t *testing.T) {
+	q := fmt.Sprintf(sqlTriggerFunction, `"dbnotify"`)
+	assert.Contains(t, q, `PERFORM "dbnotify".dbnotify_mark_commit();`)
+	assert.Contains(t, q, `AFTER INSERT ON "dbnotify".dbnotify_commit_marker`)
+
+	s := &Stream{}
+	ddl := fmt.Sprintf(sqlDDLTriggerFunction, `"dbnotify"`, s.ddlCommitMarker(`"dbnotify"`))
+	assert.Equal(t, 2, strings.Count(ddl, `PERFORM "dbnotify".dbnotify_mark_commit();`))
+	s.slot = "dbnotify"
+	ddl = fmt.Sprintf(sqlDDLTriggerFunction, `"dbnotify"`, s.ddlCommitMarker(`"dbnotify"`))
+	assert.NotContains(t, ddl, "dbnotify_mark_commit")
+
+	// 触发器函数使用的表不自动监听
+	assert.False(t, (&Stream{}).managed(Table{Schema: "public", Name: "dbnotify_commit_marker"}))
+	assert.True(t, (&Stream{}).managed(Table{Schema: "public", Name: "notes"}))
+}
+
+// 租户schema中的会话(search_path不包含安装的schema)执行dml以及ddl
+func (s *PostgresSuite) TestTenantSearchPath() {
+	ctx := context.Background()
+	db := s.dial.stream.DB()
+	_, err := db.Exec(`create schema if not exists tenant_1; create table if not exists tenant_1.orders (id serial primary key, note text)`)
+	require.Nil(s.T(), err)
+	defer db.Exec(`drop schema tenant_1 cascade`) //nolint:errcheck
+	require.Nil(s.T(), s.dial.Initial())
+	require.Nil(s.T(), s.dial.Register("tenant_1.orders"))
+
+	conn, err := db.Conn(ctx)
+	require.Nil(s.T(), err)
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `SET search_path TO tenant_1`)
+	require.Nil(s.T(), err)
+	defer conn.ExecContext(ctx, `RESET search_path`) //nolint:errcheck
+	for _, q := range []string{
+		`insert into orders (note) values ('a')`,
+		`update orders set note = 'b'`,
+		`alter table orders add column extra text`,
+		`insert into orders (note) values (repeat('x', 9000))`, // dbnotify_overflow
+		`truncate orders`,
+		`delete from orders`,
+	} {
+		_, err := conn.ExecContext(ctx, q)
+		assert.Nil(s.T(), err, q)
+	}
+}
@@ -0,0 +1,211 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.19.4
+// source: pqstream.proto
+
+package postgres
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// PQStreamClient is the client API for PQStream service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PQStreamClient interface {
+	// Listen responds with a stream of database operations.
+	Listen(ctx context.Context, in *ListenRequest, opts ...grpc.CallOption) (PQStream_ListenClient, error)
+	// Register starts watching a table.
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	// UnRegister stops watching a table.
+	UnRegister(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+}
+
+type pQStreamClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPQStreamClient(cc grpc.ClientConnInterface) PQStreamClient {
+	return &pQStreamClient{cc}
+}
+
+func (c *pQStreamClient) Listen(ctx context.Context, in *ListenRequest, opts ...grpc.CallOption) (PQStream_ListenClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PQStream_ServiceDesc.Streams[0], "/proto.PQStream/Listen", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pQStreamListenClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PQStream_ListenClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type pQStreamListenClient struct {
+	grpc.ClientStream
+}
+
+func (x *pQStreamListenClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pQStreamClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, "/proto.PQStream/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pQStreamClient) UnRegister(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, "/proto.PQStream/UnRegister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PQStreamServer is the server API for PQStream service.
+// All implementations must embed UnimplementedPQStreamServer
+// for forward compatibility
+type PQStreamServer interface {
+	// Listen responds with a stream of database operations.
+	Listen(*ListenRequest, PQStream_ListenServer) error
+	// Register starts watching a table.
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	// UnRegister stops watching a table.
+	UnRegister(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	mustEmbedUnimplementedPQStreamServer()
+}
+
+// UnimplementedPQStreamServer must be embedded to have forward compatible implementations.
+type UnimplementedPQStreamServer struct {
+}
+
+func (UnimplementedPQStreamServer) Listen(*ListenRequest, PQStream_ListenServer) error {
+	return status.Errorf(codes.Unimplemented, "method Listen not implemented")
+}
+func (UnimplementedPQStreamServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedPQStreamServer) UnRegister(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnRegister not implemented")
+}
+func (UnimplementedPQStreamServer) mustEmbedUnimplementedPQStreamServer() {}
+
+// UnsafePQStreamServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PQStreamServer will
+// result in compilation errors.
+type UnsafePQStreamServer interface {
+	mustEmbedUnimplementedPQStreamServer()
+}
+
+func RegisterPQStreamServer(s grpc.ServiceRegistrar, srv PQStreamServer) {
+	s.RegisterService(&PQStream_ServiceDesc, srv)
+}
+
+func _PQStream_Listen_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListenRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PQStreamServer).Listen(m, &pQStreamListenServer{stream})
+}
+
+type PQStream_ListenServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type pQStreamListenServer struct {
+	grpc.ServerStream
+}
+
+func (x *pQStreamListenServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PQStream_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PQStreamServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.PQStream/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PQStreamServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PQStream_UnRegister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PQStreamServer).UnRegister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.PQStream/UnRegister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PQStreamServer).UnRegister(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PQStream_ServiceDesc is the grpc.ServiceDesc for PQStream service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PQStream_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "proto.PQStream",
+	HandlerType: (*PQStreamServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _PQStream_Register_Handler,
+		},
+		{
+			MethodName: "UnRegister",
+			Handler:    _PQStream_UnRegister_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Listen",
+			Handler:       _PQStream_Listen_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pqstream.proto",
+}
@@ -0,0 +1,273 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	ptypes_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// 基于逻辑复制槽(wal2json)的数据变更捕获
+// 与触发器+pg_notify的方式相比，复制槽在监听断开期间会保留变更，且没有8000字节的负载限制
+
+const defaultPollInterval = time.Second
+
+// 每次轮询最多读取的事务数量，积压的事务分多次处理
+var replicationBatchSize = 1000
+
+var (
+	// 创建逻辑复制槽(已存在则跳过)
+	sqlCreateReplicationSlot = `
+SELECT pg_create_logical_replication_slot($1, 'wal2json')
+ WHERE NOT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)
+`
+
+	// 当前wal的位置，本次轮询只处理在该位置之前提交的事务
+	sqlCurrentWalLSN = `SELECT pg_current_wal_lsn()::text`
+
+	// 读取复制槽中已提交的事务(不消费)，每一行为一个事务，最多读取$3个事务
+	sqlSlotPeekChanges = `
+SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, $2::pg_lsn, $3, 'format-version', '1', 'include-xids', '1', 'include-timestamp', '1')
+`
+
+	// 消费已经推送的前$3个事务，format-version 1每个事务一行，upto_nchanges在事务结束时检查，与peek的结果一致
+	// 不使用pg_replication_slot_advance: 返回的lsn不一定是事务提交之后的位置
+	sqlSlotGetChanges = `
+SELECT count(*) FROM pg_logical_slot_get_changes($1, $2::pg_lsn, $3, 'format-version', '1', 'include-xids', '1', 'include-timestamp', '1')
+`
+)
+
+// WithLogicalReplication switches the capture mode from per-table triggers to the
+// wal2json replication slot named slot. The slot is created if it does not exist.
+func WithLogicalReplication(slot string) ServerOption {
+	return func(s *Stream) {
+		s.slot = slot
+	}
+}
+
+// WithPollInterval controls how often the replication slot is polled.
+func WithPollInterval(d time.Duration) ServerOption {
+	return func(s *Stream) {
+		s.pollInterval = d
+	}
+}
+
+// wal2json format-version 1
+type walTransaction struct {
+	Xid       int64       `json:"xid"`
+	Timestamp string      `json:"timestamp"` // 提交时间，例如 2022-08-08 12:00:00.123456+00
+	Change    []walChange `json:"change"`
+}
+
+var walTimestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+}
+
+func walTime(ts string) (*timestamppb.Timestamp, error) {
+	if ts == "" {
+		return nil, nil
+	}
+	for _, layout := range walTimestampLayouts {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return timestamppb.New(t), nil
+		}
+	}
+	return nil, errors.Errorf("invalid wal2json timestamp %q", ts)
+}
+
+type walChange struct {
+	Kind         string        `json:"kind"`
+	Schema       string        `json:"schema"`
+	Table        string        `json:"table"`
+	ColumnNames  []string      `json:"columnnames"`
+	ColumnTypes  []string      `json:"columntypes"`
+	ColumnValues []interface{} `json:"columnvalues"`
+	OldKeys      *walOldKeys   `json:"oldkeys"`
+}
+
+type walOldKeys struct {
+	KeyNames  []string      `json:"keynames"`
+	KeyTypes  []string      `json:"keytypes"`
+	KeyValues []interface{} `json:"keyvalues"`
+}
+
+var walOperations = map[string]Operation{
+	"insert":   Operation_INSERT,
+	"update":   Operation_UPDATE,
+	"delete":   Operation_DELETE,
+	"truncate": Operation_TRUNCATE,
+}
+
+// watchTable marks table as (un)registered, only registered tables are emitted in replication mode.
+// In trigger mode it is bookkeeping only, see Stream.Tables.
+func (s *Stream) watchTable(table string, watch bool) {
+	s.tablesMu.Lock()
+	defer s.tablesMu.Unlock()
+	if watch {
+		s.tables[table] = true
+	} else {
+		delete(s.tables, table)
+	}
+}
+
+// Tables returns the registered tables in sorted order.
+func (s *Stream) Tables() []string {
+	s.tablesMu.RLock()
+	defer s.tablesMu.RUnlock()
+	tables := make([]string, 0, len(s.tables))
+	for t := range s.tables {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func (s *Stream) isWatched(table string) bool {
+	s.tablesMu.RLock()
+	defer s.tablesMu.RUnlock()
+	return s.tables[table]
+}
+
+// pollReplication pushes the pending transactions of the replication slot to q.
+// The slot is only advanced past the transactions that were published, so a crash or
+// an error leaves the remaining transactions in the slot for the next poll.
+func (s *Stream) pollReplication(ctx context.Context, q chan string) error {
+	var upto string
+	if err := s.db.QueryRowContext(ctx, sqlCurrentWalLSN).Scan(&upto); err != nil {
+		return errors.Wrap(err, "current wal lsn")
+	}
+	published, err := s.peekReplication(ctx, q, upto)
+	if published > 0 {
+		// ctx结束时仍然需要确认已经推送的事务
+		var consumed int
+		if cerr := s.db.QueryRowContext(context.Background(), sqlSlotGetChanges, s.slot, upto, published).Scan(&consumed); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "slot get changes")
+		} else if cerr == nil && consumed != published && err == nil {
+			err = errors.Errorf("slot consumed %d transactions, published %d", consumed, published)
+		}
+	}
+	return err
+}
+
+// peekReplication 返回推送完成的事务数量，只读取在upto之前提交的事务
+func (s *Stream) peekReplication(ctx context.Context, q chan string, upto string) (int, error) {
+	rows, err := s.db.QueryContext(ctx, sqlSlotPeekChanges, s.slot, upto, replicationBatchSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "slot peek changes")
+	}
+	defer rows.Close()
+
+	var published int
+	for rows.Next() {
+		var lsn, data string
+		if err := rows.Scan(&lsn, &data); err != nil {
+			return published, errors.Wrap(err, "slot scan")
+		}
+		// 无法解析的事务保留在复制槽中
+		events, err := decodeWal2JSON([]byte(data))
+		if err != nil {
+			return published, errors.Wrapf(err, "decode wal2json at %s", lsn)
+		}
+		// wal2json每行是一个完整的事务，seq为已注册的表的事件在事务中的序号，最后发送提交标记
+		var seq int64
+		for _, re := range events {
+			if !s.isWatched(tableName(re.Schema, re.Table)) {
+				continue
+			}
+			seq++
+			re.Seq = seq
+			if err := s.publish(re, q); err != nil {
+				return published, err
+			}
+		}
+		if seq > 0 {
+			commit := &RawEvent{Op: Operation_COMMIT, Time: events[0].Time, Txid: events[0].Txid, Seq: seq}
+			if err := s.publish(commit, q); err != nil {
+				return published, err
+			}
+		}
+		published++
+	}
+	return published, errors.Wrap(rows.Err(), "slot rows")
+}
+
+// decodeWal2JSON converts a wal2json transaction into raw events.
+// oldkeys only carries the replica identity, so the previous image of an update
+// is only set when the table uses REPLICA IDENTITY FULL.
+func decodeWal2JSON(data []byte) ([]*RawEvent, error) {
+	var tx walTransaction
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return nil, errors.Wrap(err, "wal2json unmarshal")
+	}
+
+	commitTime, err := walTime(tx.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*RawEvent, 0, len(tx.Change))
+	for _, c := range tx.Change {
+		op, ok := walOperations[c.Kind]
+		if !ok {
+			continue
+		}
+		re := &RawEvent{
+			Schema: c.Schema,
+			Table:  c.Table,
+			Op:     op,
+			Time:   commitTime,
+			Txid:   tx.Xid,
+		}
+
+		payload, err := walStruct(c.ColumnNames, c.ColumnValues)
+		if err != nil {
+			return nil, err
+		}
+		var oldkeys *ptypes_struct.Struct
+		if c.OldKeys != nil {
+			if oldkeys, err = walStruct(c.OldKeys.KeyNames, c.OldKeys.KeyValues); err != nil {
+				return nil, err
+			}
+		}
+
+		switch op {
+		case Operation_INSERT:
+			re.Payload = payload
+		case Operation_UPDATE:
+			re.Payload = payload
+			if c.OldKeys != nil && len(c.OldKeys.KeyNames) == len(c.ColumnNames) {
+				re.Previous = oldkeys
+			}
+		case Operation_DELETE:
+			re.Payload = oldkeys
+		}
+
+		if re.Payload != nil {
+			if id, ok := re.Payload.Fields["id"]; ok {
+				re.Id = keyValue(id)
+			}
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func walStruct(names []string, values []interface{}) (*ptypes_struct.Struct, error) {
+	if names == nil {
+		return nil, nil
+	}
+	if len(names) != len(values) {
+		return nil, errors.New("wal2json columns and values mismatch")
+	}
+	m := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		m[name] = values[i]
+	}
+	return structpb.NewStruct(m)
+}
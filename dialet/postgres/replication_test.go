@@ -0,0 +1,196 @@
+package postgres
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testdata/wal2json.jsonl 为pg_logical_slot_get_changes录制的结果，每行一个事务
+func loadWalFixture(t *testing.T) [][]byte {
+	f, err := os.Open("testdata/wal2json.jsonl")
+	require.Nil(t, err)
+	defer f.Close()
+
+	var res [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		res = append(res, []byte(scanner.Text()))
+	}
+	require.Nil(t, scanner.Err())
+	return res
+}
+
+func TestDecodeWal2JSON(t *testing.T) {
+	var events []*RawEvent
+	for _, tx := range loadWalFixture(t) {
+		res, err := decodeWal2JSON(tx)
+		require.Nil(t, err)
+		events = append(events, res...)
+	}
+	require.Len(t, events, 4)
+
+	assert.Equal(t, Operation_INSERT, events[0].Op)
+	assert.Equal(t, "1", events[0].Id)
+	assert.Equal(t, "here is a sample note", events[0].Payload.Fields["note"].GetStringValue())
+	assert.Nil(t, events[0].Previous)
+	assert.Equal(t, int64(731), events[0].Txid)
+	assert.Equal(t, time.Date(2022, 8, 8, 12, 0, 0, 123456000, time.UTC), events[0].Time.AsTime())
+
+	assert.Equal(t, Operation_UPDATE, events[1].Op)
+	assert.Equal(t, "here is an updated note", events[1].Payload.Fields["note"].GetStringValue())
+	assert.Equal(t, "here is a sample note", events[1].Previous.Fields["note"].GetStringValue())
+
+	assert.Equal(t, "users", events[2].Table)
+
+	assert.Equal(t, Operation_DELETE, events[3].Op)
+	assert.Equal(t, time.Date(2022, 8, 8, 6, 30, 3, 1000, time.UTC), events[3].Time.AsTime())
+	assert.Equal(t, "1", events[3].Id)
+	assert.Len(t, events[3].Payload.Fields, 1)
+}
+
+func TestDecodeWal2JSONInvalid(t *testing.T) {
+	_, err := decodeWal2JSON([]byte(`{"change":[{"kind":"insert","columnnames":["id"],"columnvalues":[]}]}`))
+	assert.NotNil(t, err)
+	_, err = decodeWal2JSON([]byte(`{"timestamp":"yesterday","change":[]}`))
+	assert.NotNil(t, err)
+	_, err = decodeWal2JSON([]byte(`not json`))
+	assert.NotNil(t, err)
+}
+
+// 复制槽的事件与触发器模式输出相同的PostgresLog
+func TestReplicationPublish(t *testing.T) {
+	s := &Stream{tables: map[string]bool{}}
+	s.watchTable("notes", true)
+
+	q := make(chan string, 10)
+	for _, tx := range loadWalFixture(t) {
+		events, err := decodeWal2JSON(tx)
+		require.Nil(t, err)
+		for _, re := range events {
+			if s.isWatched(re.Table) {
+				require.Nil(t, s.publish(re, q))
+			}
+		}
+	}
+	close(q)
+
+	var logs []*PostgresLog
+	for item := range q {
+		l, err := NewPostgresLog(item)
+		require.Nil(t, err)
+		logs = append(logs, l)
+	}
+	require.Len(t, logs, 3)
+	assert.Equal(t, "notes", logs[0].GetTable())
+	assert.Equal(t, "here is a sample note", logs[0].GetPaylod()["note"])
+	assert.Equal(t, map[string]interface{}{"note": "here is a sample note"}, logs[1].GetChange())
+	assert.Equal(t, float64(1), logs[2].GetPaylod()["id"])
+
+	assert.Equal(t, []string{"insert", "update", "delete"}, []string{logs[0].GetLabel(), logs[1].GetLabel(), logs[2].GetLabel()})
+	assert.Equal(t, "dml", logs[2].GetType())
+	assert.Equal(t, int64(732), logs[1].Txid)
+	assert.True(t, time.Date(2022, 8, 8, 4, 0, 1, 5e8, time.UTC).Equal(logs[1].GetTime()))
+}
+
+// 事务的lsn为十六进制，例如0/8、0/10，字符串比较的顺序与实际顺序不同
+func newFakeSlot(t *testing.T, txs ...string) (*Stream, *fakeCatalog) {
+	s, c := newFakeStream(t, nil)
+	s.slot = "dbnotify"
+	s.watchTable("notes", true)
+	for _, tx := range txs {
+		addFakeSlotTx(c, tx)
+	}
+	return s, c
+}
+
+// addFakeSlotTx 写入一个事务，wal位置移动到事务提交之后
+func addFakeSlotTx(c *fakeCatalog, tx string) {
+	begin := uint64(len(c.slot)+1) * 8
+	c.slot = append(c.slot, fakeSlotTx{lsn: fmt.Sprintf("0/%X", begin), end: fmt.Sprintf("0/%X", begin+4), data: tx})
+	c.wal = fmt.Sprintf("0/%X", begin+4)
+}
+
+func walFixtureStrings(t *testing.T) []string {
+	var txs []string
+	for _, tx := range loadWalFixture(t) {
+		txs = append(txs, string(tx))
+	}
+	return txs
+}
+
+// 推送之后才消费，消费之后的事务不再读取
+func TestPollReplicationConsume(t *testing.T) {
+	s, c := newFakeSlot(t, walFixtureStrings(t)...)
+	q := make(chan string, 20)
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	assert.Equal(t, []int{4}, c.consumed)
+	assert.Empty(t, c.slot)
+	// 3个事件以及每个事务的提交标记
+	assert.Len(t, q, 6)
+
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	assert.Len(t, q, 6)
+	assert.Equal(t, []int{4}, c.consumed)
+}
+
+// 积压的事务分批读取，lsn按数值比较(0/8 < 0/10)
+func TestPollReplicationBatch(t *testing.T) {
+	defer func(n int) { replicationBatchSize = n }(replicationBatchSize)
+	replicationBatchSize = 3
+
+	txs := walFixtureStrings(t)
+	s, c := newFakeSlot(t, append(txs, txs...)...)
+	q := make(chan string, 20)
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	assert.Equal(t, []int{3}, c.consumed)
+	assert.Equal(t, "0/20", c.slot[0].lsn)
+
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	assert.Equal(t, []int{3, 3, 2}, c.consumed)
+	assert.Len(t, q, 12)
+}
+
+// 读取wal位置之后提交的事务留到下一次轮询
+func TestPollReplicationUptoLSN(t *testing.T) {
+	txs := walFixtureStrings(t)
+	s, c := newFakeSlot(t, txs[0])
+	wal := c.wal
+	addFakeSlotTx(c, txs[1])
+	c.wal = wal
+
+	q := make(chan string, 20)
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	assert.Equal(t, []int{1}, c.consumed)
+	assert.Len(t, q, 2)
+	require.Len(t, c.slot, 1)
+
+	addFakeSlotTx(c, txs[2])
+	require.Nil(t, s.pollReplication(context.Background(), q))
+	assert.Equal(t, []int{1, 2}, c.consumed)
+	assert.Len(t, q, 4)
+}
+
+// 无法解析的事务以及之后的事务保留在复制槽中
+func TestPollReplicationDecodeError(t *testing.T) {
+	txs := loadWalFixture(t)
+	s, c := newFakeSlot(t, string(txs[0]), "not json", string(txs[1]))
+	q := make(chan string, 20)
+	err := s.pollReplication(context.Background(), q)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "0/10")
+	assert.Equal(t, []int{1}, c.consumed)
+	assert.Len(t, q, 2)
+	assert.Len(t, c.slot, 2)
+
+	// 出错的事务之前没有推送的事务时不消费
+	require.NotNil(t, s.pollReplication(context.Background(), q))
+	assert.Equal(t, []int{1}, c.consumed)
+}
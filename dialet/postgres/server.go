@@ -0,0 +1,180 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+	"github.com/wwqdrh/logger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gRPC服务: Listen按表名正则以及操作类型过滤推送变更事件，Register/UnRegister管理监听的表
+
+// Source 事件来源，PostgresDialet以及其它dialet都满足该接口
+type Source interface {
+	Watch(ctx context.Context) chan interface{}
+	Register(table string) error
+	UnRegister(table string) error
+}
+
+type GRPCServer struct {
+	UnimplementedPQStreamServer
+
+	source Source
+}
+
+var _ PQStreamServer = &GRPCServer{}
+
+func NewGRPCServer(source Source) *GRPCServer {
+	return &GRPCServer{source: source}
+}
+
+// Listen 每个调用都是一个独立的订阅者，客户端断开后结束
+func (s *GRPCServer) Listen(r *ListenRequest, srv PQStream_ListenServer) error {
+	var tableRe *regexp.Regexp
+	if r.TableRegexp != "" {
+		re, err := regexp.Compile(r.TableRegexp)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid table_regexp: %v", err)
+		}
+		tableRe = re
+	}
+	ops := map[Operation]bool{}
+	for _, op := range r.Operations {
+		ops[op] = true
+	}
+
+	ctx := srv.Context()
+	events := s.source.Watch(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case item, ok := <-events:
+			if !ok {
+				return status.Error(codes.Unavailable, "event stream closed")
+			}
+			// 无法转换的事件(例如事务)跳过，不结束订阅
+			e, err := toEvent(item)
+			if err != nil {
+				logger.DefaultLogger.Error(err.Error())
+				continue
+			}
+			if tableRe != nil && !tableRe.MatchString(e.Table) && !tableRe.MatchString(e.Schema+"."+e.Table) {
+				continue
+			}
+			if len(ops) > 0 && !ops[e.Op] {
+				continue
+			}
+			if err := srv.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *GRPCServer) Register(ctx context.Context, r *RegisterRequest) (*RegisterResponse, error) {
+	if r.Table == "" {
+		return nil, status.Error(codes.InvalidArgument, "table is required")
+	}
+	if err := s.source.Register(r.Table); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &RegisterResponse{}, nil
+}
+
+func (s *GRPCServer) UnRegister(ctx context.Context, r *RegisterRequest) (*RegisterResponse, error) {
+	if r.Table == "" {
+		return nil, status.Error(codes.InvalidArgument, "table is required")
+	}
+	if err := s.source.UnRegister(r.Table); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &RegisterResponse{}, nil
+}
+
+// logData 与dialet.ILogData相同，避免循环引用
+type logData interface {
+	GetSchema() string
+	GetTable() string
+	GetLabel() string
+	GetTime() time.Time
+	GetPaylod() map[string]interface{}
+	GetChange() map[string]interface{}
+}
+
+// toEvent 将dialet的事件转换为protobuf的Event
+func toEvent(item interface{}) (*Event, error) {
+	l, ok := item.(logData)
+	if !ok {
+		return nil, errors.Errorf("unexpected event %T", item)
+	}
+	e := &Event{
+		Schema: l.GetSchema(),
+		Table:  l.GetTable(),
+		Op:     Operation(Operation_value[strings.ToUpper(l.GetLabel())]),
+	}
+	if t := l.GetTime(); !t.IsZero() {
+		e.Time = timestamppb.New(t)
+	}
+	switch pl := item.(type) {
+	case *PostgresLog:
+		e.Op, e.Id, e.Txid, e.Tag, e.Key, e.Seq = Operation(pl.Op), pl.Id, pl.Txid, pl.Tag, pl.Key, pl.Seq
+		for _, c := range pl.Diff {
+			d, err := toColumnDiff(c)
+			if err != nil {
+				return nil, errors.Wrap(err, "diff")
+			}
+			e.Diff = append(e.Diff, d)
+		}
+	case *PostgresDDL:
+		e.Op, e.Txid, e.Tag, e.Seq = Operation_DDL, pl.Txid, pl.Tag, pl.Seq
+	}
+
+	var err error
+	if payload := l.GetPaylod(); payload != nil {
+		if e.Payload, err = toStruct(payload); err != nil {
+			return nil, errors.Wrap(err, "payload")
+		}
+	}
+	if changes := l.GetChange(); len(changes) > 0 {
+		if e.Changes, err = toStruct(changes); err != nil {
+			return nil, errors.Wrap(err, "changes")
+		}
+	}
+	return e, nil
+}
+
+func toColumnDiff(c diff.Column) (*ColumnDiff, error) {
+	old, err := structpb.NewValue(c.Old)
+	if err != nil {
+		return nil, err
+	}
+	new, err := structpb.NewValue(c.New)
+	if err != nil {
+		return nil, err
+	}
+	return &ColumnDiff{Name: c.Name, Old: old, New: new}, nil
+}
+
+// toStruct structpb不支持的类型(例如time.Time)通过json转换
+func toStruct(m map[string]interface{}) (*structpb.Struct, error) {
+	if s, err := structpb.NewStruct(m); err == nil {
+		return s, nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	s := &structpb.Struct{}
+	return s, protojson.Unmarshal(data, s)
+}
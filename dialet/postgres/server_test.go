@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet/broker"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeSource 通过broker分发事件，记录注册的表
+type fakeSource struct {
+	broker  *broker.Broker
+	tables  chan string
+	removed chan string
+}
+
+func (f *fakeSource) Watch(ctx context.Context) chan interface{} {
+	return f.broker.SubscribeContext(ctx).C()
+}
+
+func (f *fakeSource) Register(table string) error {
+	f.tables <- table
+	return nil
+}
+
+func (f *fakeSource) UnRegister(table string) error {
+	f.removed <- table
+	return nil
+}
+
+func newTestGRPC(t *testing.T) (*fakeSource, PQStreamClient) {
+	source := &fakeSource{broker: broker.New(), tables: make(chan string, 1), removed: make(chan string, 1)}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	RegisterPQStreamServer(srv, NewGRPCServer(source))
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+		source.broker.Close()
+	})
+	return source, NewPQStreamClient(conn)
+}
+
+func TestGRPCListen(t *testing.T) {
+	source, client := newTestGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Listen(ctx, &ListenRequest{
+		TableRegexp: "^public.notes$",
+		Operations:  []Operation{Operation_UPDATE},
+	})
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return source.broker.Len() == 1
+	}, time.Second, time.Millisecond)
+
+	for _, l := range []*PostgresLog{
+		{Schema: "public", Table: "notes", Op: int(Operation_INSERT), Id: "1", Payload: map[string]interface{}{"note": "a"}},
+		{Schema: "public", Table: "users", Op: int(Operation_UPDATE), Id: "1", Payload: map[string]interface{}{"name": "a"}},
+		{Schema: "public", Table: "notes", Op: int(Operation_UPDATE), Id: "1",
+			Payload: map[string]interface{}{"note": "b", "created_at": time.Unix(0, 0).UTC()},
+			Changes: map[string]interface{}{"note": "b"},
+			Diff:    []diff.Column{{Name: "note", Old: nil, New: "b"}}},
+	} {
+		source.broker.Publish(ctx, l)
+	}
+
+	e, err := stream.Recv()
+	require.Nil(t, err)
+	assert.Equal(t, "notes", e.Table)
+	assert.Equal(t, Operation_UPDATE, e.Op)
+	assert.Equal(t, "1", e.Id)
+	assert.Equal(t, "b", e.Payload.Fields["note"].GetStringValue())
+	assert.Equal(t, "1970-01-01T00:00:00Z", e.Payload.Fields["created_at"].GetStringValue())
+	assert.Equal(t, "b", e.Changes.Fields["note"].GetStringValue())
+	require.Len(t, e.Diff, 1)
+	assert.Equal(t, "note", e.Diff[0].Name)
+	assert.Equal(t, structpb.NullValue_NULL_VALUE, e.Diff[0].Old.GetNullValue())
+	assert.Equal(t, "b", e.Diff[0].New.GetStringValue())
+
+	// 客户端断开后服务端取消订阅
+	cancel()
+	require.Eventually(t, func() bool {
+		return source.broker.Len() == 0
+	}, time.Second, time.Millisecond)
+}
+
+// 无法转换的事件跳过，之后的事件正常推送
+func TestGRPCListenSkipUnknown(t *testing.T) {
+	source, client := newTestGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Listen(ctx, &ListenRequest{})
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return source.broker.Len() == 1
+	}, time.Second, time.Millisecond)
+
+	source.broker.Publish(ctx, &Transaction{Txid: 1})
+	source.broker.Publish(ctx, &PostgresLog{Schema: "public", Table: "notes", Op: int(Operation_INSERT), Id: "1"})
+
+	e, err := stream.Recv()
+	require.Nil(t, err)
+	assert.Equal(t, "notes", e.Table)
+	assert.Equal(t, Operation_INSERT, e.Op)
+}
+
+func TestGRPCListenInvalidRegexp(t *testing.T) {
+	_, client := newTestGRPC(t)
+	stream, err := client.Listen(context.Background(), &ListenRequest{TableRegexp: "("})
+	require.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCRegister(t *testing.T) {
+	source, client := newTestGRPC(t)
+	ctx := context.Background()
+
+	_, err := client.Register(ctx, &RegisterRequest{Table: "notes"})
+	require.Nil(t, err)
+	assert.Equal(t, "notes", <-source.tables)
+	_, err = client.UnRegister(ctx, &RegisterRequest{Table: "notes"})
+	require.Nil(t, err)
+	assert.Equal(t, "notes", <-source.removed)
+
+	_, err = client.Register(ctx, &RegisterRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
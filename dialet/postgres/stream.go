@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/protobuf/encoding/protojson"
@@ -15,6 +16,8 @@ import (
 
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/broker"
+	"github.com/wwqdrh/datamanager/dialet/diff"
 
 	jsonpatch "github.com/evanphx/json-patch"
 
@@ -26,8 +29,6 @@ const (
 	maxReconnectInterval = 10 * time.Second
 	defaultPingInterval  = 9 * time.Second
 	channel              = "pqstream_notify"
-
-	fallbackIDColumnType = "integer" // TODO(tmc) parameterize
 )
 
 type Stream struct {
@@ -35,11 +36,31 @@ type Stream struct {
 	db  *sql.DB
 	ctx context.Context
 
-	tableRe *regexp.Regexp
+	tableRe       *regexp.Regexp
+	schemaInclude []*regexp.Regexp
+	schemaExclude []*regexp.Regexp
 
 	listenerPingInterval time.Duration
 	// subscribe            chan *subscription
-	redactions FieldRedactions
+	redactionsMu sync.RWMutex
+	redactions   FieldRedactions
+
+	// logical replication mode, see replication.go
+	slot         string
+	pollInterval time.Duration
+	tablesMu     sync.RWMutex
+	tables       map[string]bool     // 已注册的表，两种模式下都会记录
+	keys         map[string][]string // 已注册的表的主键列
+
+	// dbnotify_overflow中的行的保留时间
+	overflowRetention time.Duration
+	// 等待事务提交标记的时间，见transaction.go
+	txTimeout time.Duration
+
+	// 自动注册或者删除表后的回调
+	onTable func(table string, watched bool)
+
+	brokerOpts []broker.Option
 }
 
 type ServerOption func(*Stream)
@@ -51,6 +72,21 @@ func WithTableRegexp(re *regexp.Regexp) ServerOption {
 	}
 }
 
+// WithTableListener fn is invoked after a table is registered for a CREATE TABLE or forgotten for a DROP TABLE,
+// so that callers can keep their own bookkeeping (e.g. a persisted registry) in sync.
+func WithTableListener(fn func(table string, watched bool)) ServerOption {
+	return func(s *Stream) {
+		s.onTable = fn
+	}
+}
+
+// WithBrokerOptions configures the default buffer and slow consumer policy of PostgresDialet.Watch subscribers.
+func WithBrokerOptions(opts ...broker.Option) ServerOption {
+	return func(s *Stream) {
+		s.brokerOpts = opts
+	}
+}
+
 // WithContext allows supplying a custom context.
 func WithContext(ctx context.Context) ServerOption {
 	return func(s *Stream) {
@@ -121,9 +157,18 @@ func WithFieldRedactions(r FieldRedactions) ServerOption {
 	}
 }
 
+// SetFieldRedactions replaces the redaction rules of a running server.
+func (s *Stream) SetFieldRedactions(r FieldRedactions) {
+	s.redactionsMu.Lock()
+	defer s.redactionsMu.Unlock()
+	s.redactions = r
+}
+
 // redactFields search through redactionMap if there's any redacted fields
 // specified that match the fields of the current event.
 func (s *Stream) redactFields(e *RawEvent) {
+	s.redactionsMu.RLock()
+	defer s.redactionsMu.RUnlock()
 	if tables, ok := s.redactions[e.GetSchema()]; ok {
 		if fields, ok := tables[e.GetTable()]; ok {
 			for _, rf := range fields {
@@ -144,6 +189,11 @@ func NewServer(connectionString string, opts ...ServerOption) (*Stream, error) {
 		redactions:           make(FieldRedactions),
 		ctx:                  context.Background(),
 		listenerPingInterval: defaultPingInterval,
+		pollInterval:         defaultPollInterval,
+		overflowRetention:    defaultOverflowRetention,
+		txTimeout:            defaultTransactionTimeout,
+		tables:               map[string]bool{},
+		keys:                 map[string][]string{},
 	}
 	for _, o := range opts {
 		o(s)
@@ -155,6 +205,11 @@ func NewServer(connectionString string, opts ...ServerOption) (*Stream, error) {
 	if err := db.Ping(); err != nil {
 		return nil, errors.Wrap(err, "ping")
 	}
+	if s.slot != "" {
+		if _, err := db.Exec(sqlCreateReplicationSlot, s.slot); err != nil {
+			return nil, errors.Wrap(err, "create replication slot")
+		}
+	}
 	s.l = pq.NewListener(connectionString, minReconnectInterval, maxReconnectInterval, func(ev pq.ListenerEventType, err error) {
 		fmt.Printf("listener-event %v, got listener event\n", ev)
 		if err != nil {
@@ -190,58 +245,123 @@ func (s *Stream) DB() *sql.DB {
 
 // InstallTriggers sets up triggers to start observing changes for the set of tables in the database.
 func (s *Stream) InstallTriggers() error {
-	_, err := s.db.Exec(sqlTriggerFunction)
-	if err != nil {
-		return err
+	if s.slot == "" {
+		schema, err := s.installSchema()
+		if err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(fmt.Sprintf(sqlTriggerFunction, schema)); err != nil {
+			return err
+		}
 	}
-	// TODO(tmc): watch for new tables
-	tableNames, err := s.tableNames()
+	// 之后新建的表由PostgresDialet根据CREATE TABLE事件注册
+	tables, err := s.tableNames()
 	if err != nil {
 		return err
 	}
-	for _, t := range tableNames {
+	for _, t := range tables {
 		if err := s.installTrigger(t); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("installTrigger table %s", t))
 		}
 	}
-	if len(tableNames) == 0 {
+	if len(tables) == 0 {
 		return errors.New("no tables found")
 	}
 	return nil
 }
 
-func (s *Stream) tableNames() ([]string, error) {
+// installSchema 触发器函数以及dbnotify_*表所在的schema(当前连接的current_schema)，已经quote
+func (s *Stream) installSchema() (string, error) {
+	var schema sql.NullString
+	if err := s.db.QueryRow(sqlCurrentSchema).Scan(&schema); err != nil {
+		return "", errors.Wrap(err, "current_schema")
+	}
+	if !schema.Valid {
+		return "", errors.New("current_schema为空，search_path中没有可用的schema")
+	}
+	return pq.QuoteIdentifier(schema.String), nil
+}
+
+// ddlCommitMarker 触发器模式下ddl事务的提交标记，复制槽模式下由pollReplication生成
+func (s *Stream) ddlCommitMarker(schema string) string {
+	if s.slot != "" {
+		return ""
+	}
+	return fmt.Sprintf("PERFORM %s.dbnotify_mark_commit();", schema)
+}
+
+// tableNames 根据WithSchemas、WithExcludeSchemas以及WithTableRegexp过滤的表
+func (s *Stream) tableNames() ([]Table, error) {
 	rows, err := s.db.Query(sqlQueryTables)
 	if err != nil {
 		return nil, err
 	}
-	var tableNames []string
+	defer rows.Close()
+	var tables []Table
 	for rows.Next() {
-		var t string
-		if err := rows.Scan(&t); err != nil {
-			return nil, errors.Wrap(err, fmt.Sprintln("tableNames scan, after", len(tableNames)))
+		var t Table
+		if err := rows.Scan(&t.Schema, &t.Name); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintln("tableNames scan, after", len(tables)))
 		}
-		if s.tableRe != nil && !s.tableRe.MatchString(t) {
+		if !s.managed(t) {
 			continue
 		}
-		tableNames = append(tableNames, t)
+		tables = append(tables, t)
 	}
-	return tableNames, nil
+	return tables, rows.Err()
+}
+
+// installTrigger is idempotent, an existing trigger is only replaced when the primary key changed.
+func (s *Stream) installTrigger(t Table) error {
+	key, err := s.primaryKey(t)
+	if err != nil {
+		return err
+	}
+	if s.slot == "" {
+		if err := s.replaceTrigger(t, key); err != nil {
+			return err
+		}
+	}
+	s.watchTable(t.String(), true)
+	s.setKeyColumns(t.String(), key)
+	return nil
 }
 
-func (s *Stream) installTrigger(table string) error {
-	q := fmt.Sprintf(sqlInstallTrigger, table)
-	_, err := s.db.Exec(q)
-	return err
+// replaceTrigger 安装触发器，缺少触发器或者参数与主键不同时重新创建
+func (s *Stream) replaceTrigger(t Table, key []string) error {
+	installed, err := s.installedTriggers(t)
+	if err != nil {
+		return err
+	}
+	if args, ok := installed["pqstream_notify"]; ok && equalStrings(args, key) {
+		_, truncate := installed["pqstream_notify_truncate"]
+		_, commit := installed["pqstream_commit"]
+		if truncate && commit {
+			return nil
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+	if _, err := tx.Exec(fmt.Sprintf(sqlRemoveTrigger, t.Quote())); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(triggerDefinition(t, key)); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // RemoveTriggers removes triggers from the database.
 func (s *Stream) RemoveTriggers() error {
-	tableNames, err := s.tableNames()
+	tables, err := s.tableNames()
 	if err != nil {
 		return err
 	}
-	for _, t := range tableNames {
+	for _, t := range tables {
 		if err := s.removeTrigger(t); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("removeTrigger table:%s", t))
 		}
@@ -249,15 +369,30 @@ func (s *Stream) RemoveTriggers() error {
 	return nil
 }
 
-func (s *Stream) removeTrigger(table string) error {
-	q := fmt.Sprintf(sqlRemoveTrigger, table)
-	_, err := s.db.Exec(q)
-	return err
+func (s *Stream) removeTrigger(t Table) error {
+	if s.slot != "" {
+		s.watchTable(t.String(), false)
+		s.setKeyColumns(t.String(), nil)
+		return nil
+	}
+	q := fmt.Sprintf(sqlRemoveTrigger, t.Quote())
+	if _, err := s.db.Exec(q); err != nil {
+		return err
+	}
+	s.watchTable(t.String(), false)
+	s.setKeyColumns(t.String(), nil)
+	return nil
 }
 
-// fallbackLookup will be invoked if we have apparently exceeded the 8000 byte notify limit.
-func (s *Stream) fallbackLookup(e *Event) error {
-	rows, err := s.db.Query(fmt.Sprintf(sqlFetchRowByID, e.Table, fallbackIDColumnType), e.Id)
+// fallbackLookup will be invoked if the oversized row could not be read back from dbnotify_overflow,
+// the current row is used instead (not available for deletes).
+func (s *Stream) fallbackLookup(e *RawEvent) error {
+	t := Table{Schema: e.Schema, Name: e.Table}
+	if t.Schema == "" {
+		t.Schema = defaultSchema
+	}
+	query, args := fetchRowQuery(t, s.keyColumns(t.String()), e.Key)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return errors.Wrap(err, "fallback query")
 	}
@@ -284,8 +419,31 @@ func (s *Stream) handleEvent(ev *pq.Notification, q chan string) error {
 	if err := protojson.Unmarshal([]byte(ev.Extra), re); err != nil {
 		return errors.Wrap(err, "jsonpb unmarshal")
 	}
+	// 超过NOTIFY限制的事件，取不到时publish根据key查询当前的行
+	if re.Overflow != 0 {
+		if err := s.rehydrate(re); err != nil {
+			fmt.Println("event " + err.Error() + "rehydrate failed")
+		}
+	}
+	return s.publish(re, q)
+}
+
+// publish converts a raw event into an Event and pushes it to q.
+func (s *Stream) publish(re *RawEvent, q chan string) error {
+	// 复制槽模式下由payload生成key，需要在脱敏之前
+	if len(re.Key) == 0 {
+		if re.Key = payloadKey(re.Payload, s.keyColumns(tableName(re.Schema, re.Table))); re.Key != nil {
+			re.Id = keyID(re.Key)
+		}
+	}
 
-	// perform field redactions
+	if re.Payload == nil && len(re.Key) > 0 && re.Op != Operation_DELETE {
+		if err := s.fallbackLookup(re); err != nil {
+			fmt.Println("event " + err.Error() + "fallback lookup failed")
+		}
+	}
+
+	// perform field redactions，查询回来的payload同样需要脱敏
 	s.redactFields(re)
 
 	e := &Event{
@@ -294,6 +452,11 @@ func (s *Stream) handleEvent(ev *pq.Notification, q chan string) error {
 		Op:      re.Op,
 		Id:      re.Id,
 		Payload: re.Payload,
+		Time:    re.Time,
+		Txid:    re.Txid,
+		Tag:     re.Tag,
+		Key:     re.Key,
+		Seq:     re.Seq,
 	}
 
 	if re.Op == Operation_UPDATE {
@@ -304,17 +467,16 @@ func (s *Stream) handleEvent(ev *pq.Notification, q chan string) error {
 		}
 	}
 
-	if e.Payload == nil && e.Id != "" {
-		if err := s.fallbackLookup(e); err != nil {
-			fmt.Println("event " + err.Error() + "fallback lookup failed")
-		}
-
-	}
 	if q == nil {
 		return nil
 	}
 
-	data, err := json.Marshal(e)
+	l := newPostgresLog(e)
+	// 复制槽模式下只有REPLICA IDENTITY FULL才有修改前的数据
+	if re.Op == Operation_UPDATE && re.Previous != nil {
+		l.Diff = diff.Rows(re.Previous.AsMap(), e.Payload.AsMap())
+	}
+	data, err := json.Marshal(l)
 	if err == nil {
 		q <- string(data)
 	}
@@ -325,6 +487,14 @@ func (s *Stream) handleEvent(ev *pq.Notification, q chan string) error {
 func (s *Stream) HandleEvents(ctx context.Context, q chan string) error {
 	// subscribers := map[*subscription]bool{}
 	events := s.l.NotificationChannel()
+	ping := time.NewTicker(s.listenerPingInterval)
+	defer ping.Stop()
+	var poll <-chan time.Time
+	if s.slot != "" {
+		t := time.NewTicker(s.pollInterval)
+		defer t.Stop()
+		poll = t.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -335,11 +505,16 @@ func (s *Stream) HandleEvents(ctx context.Context, q chan string) error {
 			if err := s.handleEvent(ev, q); err != nil {
 				return err
 			}
-		case <-time.After(s.listenerPingInterval):
+		case <-poll:
+			if err := s.pollReplication(ctx, q); err != nil {
+				return err
+			}
+		case <-ping.C:
 			// fmt.Println("interval " + s.listenerPingInterval.String() + "pinging")
 			if err := s.l.Ping(); err != nil {
 				return errors.Wrap(err, "Ping")
 			}
+			s.purgeOverflow()
 		}
 	}
 }
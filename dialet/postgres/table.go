@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/tablename"
+)
+
+// 表名: [schema.]table，schema默认为public
+// 名称区分大小写，与information_schema中的一致，包含点或者双引号的名称需要用双引号包裹，例如 "tenant.1"."Orders"
+
+const defaultSchema = "public"
+
+// Table schema限定的表名
+type Table struct {
+	Schema string
+	Name   string
+}
+
+// ParseTable 解析Register等接口中的表名
+func ParseTable(s string) (Table, error) {
+	parts, err := tablename.Split(s)
+	if err != nil {
+		return Table{}, err
+	}
+	switch len(parts) {
+	case 1:
+		return Table{Schema: defaultSchema, Name: parts[0]}, nil
+	case 2:
+		return Table{Schema: parts[0], Name: parts[1]}, nil
+	}
+	return Table{}, errors.Errorf("invalid table name %q", s)
+}
+
+// Quote 用于拼接sql
+func (t Table) Quote() string {
+	return pq.QuoteIdentifier(t.Schema) + "." + pq.QuoteIdentifier(t.Name)
+}
+
+// String 注册记录以及WithTableRegexp匹配使用的名称，public下的表不带schema
+func (t Table) String() string {
+	return tableName(t.Schema, t.Name)
+}
+
+// tableName public下的表不带schema，与Register的参数保持一致，包含点或者双引号的名称带有双引号，能够由ParseTable解析
+func tableName(schema, name string) string {
+	if schema == "" || schema == defaultSchema {
+		return tablename.Quote(name)
+	}
+	return tablename.Join(schema, name)
+}
+
+// WithSchemas 自动发现(InstallTriggers以及新建的表)时包含的schema，默认只包含public
+func WithSchemas(include ...*regexp.Regexp) ServerOption {
+	return func(s *Stream) {
+		s.schemaInclude = include
+	}
+}
+
+// WithExcludeSchemas 自动发现时排除的schema，优先于WithSchemas
+func WithExcludeSchemas(exclude ...*regexp.Regexp) ServerOption {
+	return func(s *Stream) {
+		s.schemaExclude = exclude
+	}
+}
+
+// managed 表是否需要自动监听，Register显式注册的表不受该限制
+// dbnotify_*为触发器函数使用的表，不监听
+func (s *Stream) managed(t Table) bool {
+	if strings.HasPrefix(t.Name, "dbnotify_") {
+		return false
+	}
+	for _, re := range s.schemaExclude {
+		if re.MatchString(t.Schema) {
+			return false
+		}
+	}
+	if len(s.schemaInclude) == 0 {
+		if t.Schema != defaultSchema {
+			return false
+		}
+	} else {
+		included := false
+		for _, re := range s.schemaInclude {
+			if re.MatchString(t.Schema) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	return s.tableRe == nil || s.tableRe.MatchString(t.String())
+}
@@ -0,0 +1,68 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTable(t *testing.T) {
+	for in, want := range map[string]Table{
+		"notes":                {Schema: "public", Name: "notes"},
+		"tenant_1.orders":      {Schema: "tenant_1", Name: "orders"},
+		"Orders":               {Schema: "public", Name: "Orders"},
+		`"Tenant"."Orders"`:    {Schema: "Tenant", Name: "Orders"},
+		`"tenant.1".orders`:    {Schema: "tenant.1", Name: "orders"},
+		`public."say ""hi"""`:  {Schema: "public", Name: `say "hi"`},
+		`"weird;drop table x"`: {Schema: "public", Name: "weird;drop table x"},
+	} {
+		got, err := ParseTable(in)
+		require.Nil(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, in := range []string{"", ".", "a.", ".a", "a.b.c", `"a`, `"a"b`, `a"b"`} {
+		_, err := ParseTable(in)
+		assert.NotNil(t, err, in)
+	}
+}
+
+func TestTableQuote(t *testing.T) {
+	assert.Equal(t, `"public"."notes"`, Table{Schema: "public", Name: "notes"}.Quote())
+	assert.Equal(t, `"Tenant"."say ""hi"""`, Table{Schema: "Tenant", Name: `say "hi"`}.Quote())
+
+	assert.Equal(t, "notes", Table{Schema: "public", Name: "notes"}.String())
+	assert.Equal(t, "tenant_1.Orders", Table{Schema: "tenant_1", Name: "Orders"}.String())
+
+	// 注册记录保存String()，重新注册时由ParseTable解析
+	for _, tbl := range []Table{
+		{Schema: "public", Name: "notes"},
+		{Schema: "tenant.1", Name: "orders"},
+		{Schema: "public", Name: "a.b"},
+		{Schema: "Tenant", Name: `say "hi"`},
+	} {
+		got, err := ParseTable(tbl.String())
+		require.Nil(t, err, tbl.String())
+		assert.Equal(t, tbl, got)
+	}
+	assert.Equal(t, `"tenant.1".orders`, Table{Schema: "tenant.1", Name: "orders"}.String())
+}
+
+func TestStreamManaged(t *testing.T) {
+	s := &Stream{}
+	assert.True(t, s.managed(Table{Schema: "public", Name: "notes"}))
+	assert.False(t, s.managed(Table{Schema: "tenant_1", Name: "orders"}))
+
+	WithSchemas(regexp.MustCompile(`^tenant_`), regexp.MustCompile(`^public$`))(s)
+	WithExcludeSchemas(regexp.MustCompile(`^tenant_test`))(s)
+	assert.True(t, s.managed(Table{Schema: "public", Name: "notes"}))
+	assert.True(t, s.managed(Table{Schema: "tenant_1", Name: "orders"}))
+	assert.False(t, s.managed(Table{Schema: "tenant_test", Name: "orders"}))
+	assert.False(t, s.managed(Table{Schema: "audit", Name: "orders"}))
+
+	WithTableRegexp(regexp.MustCompile(`orders$`))(s)
+	assert.True(t, s.managed(Table{Schema: "tenant_1", Name: "orders"}))
+	assert.False(t, s.managed(Table{Schema: "public", Name: "notes"}))
+}
@@ -0,0 +1,161 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 事务分组: 每个事件带有txid以及在事务中的序号seq
+// 触发器模式下pqstream_commit在提交时发送提交标记(op为COMMIT，seq为最后一个事件的序号)，只有truncate或者ddl的事务通过dbnotify_commit_marker发送
+// 复制槽模式下由pollReplication生成
+// 同一个事务的通知在提交后连续到达，收到提交标记并且收齐seq之前的事件后作为一个Transaction推送
+// 没有提交标记的事务(复制槽模式下只有ddl的事务，或者事件解析失败)在txid变化或者超时后推送，超时从最后一个事件开始计算
+
+const defaultTransactionTimeout = time.Second
+
+// WithTransactionTimeout controls how long WatchTransactions waits for the commit marker of a transaction.
+func WithTransactionTimeout(d time.Duration) ServerOption {
+	return func(s *Stream) {
+		s.txTimeout = d
+	}
+}
+
+// Transaction 一个事务中的全部事件，按照发生的顺序
+type Transaction struct {
+	Txid   int64         `json:"txid"`
+	Time   time.Time     `json:"time"`
+	Events []interface{} `json:"events"` // *PostgresLog 或者 *PostgresDDL
+}
+
+func (t *Transaction) GetTxid() int64 {
+	return t.Txid
+}
+
+func (t *Transaction) GetTime() time.Time {
+	return t.Time
+}
+
+func (t *Transaction) GetEvents() []interface{} {
+	return t.Events
+}
+
+// txBatcher 按照txid分组事件，没有订阅者时不缓存
+// 推送(flushFn可能阻塞)在释放mu之后进行，fmu保证事务按照完成的顺序推送
+type txBatcher struct {
+	mu       sync.Mutex
+	fmu      sync.Mutex
+	enabled  bool
+	timeout  time.Duration
+	pending  *Transaction
+	last     time.Time // 最后一个事件的到达时间
+	maxSeq   int64
+	expected int64 // 提交标记中的seq，0表示还没有收到
+	timer    *time.Timer
+	flushFn  func(*Transaction)
+}
+
+func newTxBatcher(timeout time.Duration, flushFn func(*Transaction)) *txBatcher {
+	return &txBatcher{timeout: timeout, flushFn: flushFn}
+}
+
+func (b *txBatcher) enable() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.enabled = true
+}
+
+// add item为l转换后推送的事件
+func (b *txBatcher) add(l *PostgresLog, item interface{}) {
+	b.mu.Lock()
+	if !b.enabled {
+		b.mu.Unlock()
+		return
+	}
+	var done []*Transaction
+	if b.pending != nil && b.pending.Txid != l.Txid {
+		done = append(done, b.take())
+	}
+	if b.pending == nil {
+		tx := &Transaction{Txid: l.Txid, Time: l.Time}
+		b.pending = tx
+		b.timer = time.AfterFunc(b.timeout, func() { b.expire(tx) })
+	}
+	b.pending.Events = append(b.pending.Events, item)
+	b.last = time.Now()
+	if l.Seq > b.maxSeq {
+		b.maxSeq = l.Seq
+	}
+	if b.expected > 0 && b.maxSeq >= b.expected {
+		done = append(done, b.take())
+	}
+	b.flush(done...)
+}
+
+// commit 提交标记，l.Seq为事务中最后一个事件的序号
+func (b *txBatcher) commit(l *PostgresLog) {
+	b.mu.Lock()
+	var done *Transaction
+	if b.pending != nil && b.pending.Txid != l.Txid {
+		done = b.take()
+	} else if b.pending != nil {
+		b.expected = l.Seq
+		if b.maxSeq >= b.expected {
+			done = b.take()
+		}
+	}
+	b.flush(done)
+}
+
+// expire 超时推送，tx已经推送时忽略，之后又收到事件时重新计时
+func (b *txBatcher) expire(tx *Transaction) {
+	b.mu.Lock()
+	if b.pending != tx {
+		b.mu.Unlock()
+		return
+	}
+	if wait := b.timeout - time.Since(b.last); wait > 0 {
+		b.timer = time.AfterFunc(wait, func() { b.expire(tx) })
+		b.mu.Unlock()
+		return
+	}
+	b.flush(b.take())
+}
+
+// take 取出当前的事务，调用方持有mu
+func (b *txBatcher) take() *Transaction {
+	b.timer.Stop()
+	tx := b.pending
+	b.pending, b.maxSeq, b.expected, b.timer = nil, 0, 0, nil
+	return tx
+}
+
+// flush 调用方持有mu，在释放mu之后推送txs
+func (b *txBatcher) flush(txs ...*Transaction) {
+	var done []*Transaction
+	for _, tx := range txs {
+		if tx != nil {
+			done = append(done, tx)
+		}
+	}
+	if len(done) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.fmu.Lock()
+	defer b.fmu.Unlock()
+	b.mu.Unlock()
+	for _, tx := range done {
+		b.flushFn(tx)
+	}
+}
+
+// WatchTransactions 与Watch相同，每个事务提交后作为一个*Transaction推送，事务中的事件仍然会通过Watch推送
+func (p *PostgresDialet) WatchTransactions(ctx context.Context) chan interface{} {
+	p.batcher.enable()
+	sub := p.txBroker.SubscribeContext(ctx)
+	p.once.Do(func() {
+		go p.handleEvents()
+	})
+	return sub.C()
+}
@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 与pqstream_notify()以及pqstream_commit()的输出格式相同
+func TestHandleEventSeq(t *testing.T) {
+	l := handleNotification(t, `{"schema":"public","table":"notes","op":"INSERT","id":"1",`+
+		`"payload":{"id":1},"time":"2022-08-08T12:00:00Z","txid":731,"seq":2}`)
+	assert.Equal(t, int64(731), l.Txid)
+	assert.Equal(t, int64(2), l.Seq)
+
+	l = handleNotification(t, `{"op":"COMMIT","time":"2022-08-08T12:00:00Z","txid":731,"seq":2}`)
+	assert.Equal(t, Operation_COMMIT, Operation(l.Op))
+	assert.Equal(t, int64(731), l.Txid)
+	assert.Equal(t, int64(2), l.Seq)
+}
+
+func newTestBatcher(timeout time.Duration) (*txBatcher, chan *Transaction) {
+	ch := make(chan *Transaction, 8)
+	b := newTxBatcher(timeout, func(tx *Transaction) { ch <- tx })
+	b.enable()
+	return b, ch
+}
+
+func testLog(txid, seq int64) *PostgresLog {
+	return &PostgresLog{Table: "notes", Op: int(Operation_INSERT), Txid: txid, Seq: seq}
+}
+
+func TestTxBatcherCommit(t *testing.T) {
+	b, ch := newTestBatcher(time.Hour)
+
+	for seq := int64(1); seq <= 3; seq++ {
+		l := testLog(731, seq)
+		b.add(l, l)
+	}
+	assert.Len(t, ch, 0)
+	b.commit(&PostgresLog{Op: int(Operation_COMMIT), Txid: 731, Seq: 3})
+	require.Len(t, ch, 1)
+	tx := <-ch
+	assert.Equal(t, int64(731), tx.GetTxid())
+	require.Len(t, tx.GetEvents(), 3)
+	for i, e := range tx.GetEvents() {
+		assert.Equal(t, int64(i+1), e.(*PostgresLog).Seq)
+	}
+
+	// 提交标记早于事件到达(复制槽模式下ddl与行事件分开到达)
+	b.add(testLog(732, 1), testLog(732, 1))
+	b.commit(&PostgresLog{Op: int(Operation_COMMIT), Txid: 732, Seq: 2})
+	assert.Len(t, ch, 0)
+	b.add(testLog(732, 2), testLog(732, 2))
+	require.Len(t, ch, 1)
+	assert.Len(t, (<-ch).Events, 2)
+
+	// 没有事件的提交标记被忽略
+	b.commit(&PostgresLog{Op: int(Operation_COMMIT), Txid: 733, Seq: 1})
+	assert.Len(t, ch, 0)
+}
+
+// 没有提交标记的事务(复制槽模式下只有ddl的事务)
+func TestTxBatcherBoundary(t *testing.T) {
+	b, ch := newTestBatcher(time.Hour)
+	b.add(testLog(731, 1), testLog(731, 1))
+	b.add(testLog(732, 1), testLog(732, 1))
+	require.Len(t, ch, 1)
+	assert.Equal(t, int64(731), (<-ch).Txid)
+
+	b, ch = newTestBatcher(10 * time.Millisecond)
+	b.add(testLog(740, 1), testLog(740, 1))
+	select {
+	case tx := <-ch:
+		assert.Equal(t, int64(740), tx.Txid)
+	case <-time.After(time.Second):
+		t.Fatal("transaction not flushed after timeout")
+	}
+}
+
+// 超时从最后一个事件开始计算，事件持续到达的事务不会被拆分
+func TestTxBatcherSlowEvents(t *testing.T) {
+	b, ch := newTestBatcher(50 * time.Millisecond)
+	for seq := int64(1); seq <= 5; seq++ {
+		l := testLog(731, seq)
+		b.add(l, l)
+		time.Sleep(30 * time.Millisecond)
+	}
+	assert.Len(t, ch, 0)
+	b.commit(&PostgresLog{Op: int(Operation_COMMIT), Txid: 731, Seq: 5})
+	require.Len(t, ch, 1)
+	assert.Len(t, (<-ch).Events, 5)
+}
+
+// 没有WatchTransactions的订阅者时不缓存事件
+func TestTxBatcherDisabled(t *testing.T) {
+	ch := make(chan *Transaction, 1)
+	b := newTxBatcher(time.Hour, func(tx *Transaction) { ch <- tx })
+	b.add(testLog(731, 1), testLog(731, 1))
+	b.commit(&PostgresLog{Op: int(Operation_COMMIT), Txid: 731, Seq: 1})
+	assert.Len(t, ch, 0)
+	assert.Nil(t, b.pending)
+}
+
+// 推送阻塞时不持有锁，之后的事件仍然可以缓存，并且按顺序推送
+func TestTxBatcherFlushBlocking(t *testing.T) {
+	ch := make(chan *Transaction)
+	b := newTxBatcher(10*time.Millisecond, func(tx *Transaction) { ch <- tx })
+	b.enable()
+	b.add(testLog(731, 1), testLog(731, 1))
+
+	// 等待超时推送阻塞在ch
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.pending == nil
+	}, time.Second, time.Millisecond)
+
+	added := make(chan struct{})
+	go func() {
+		b.add(testLog(732, 1), testLog(732, 1))
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("add blocked by flush")
+	}
+
+	assert.Equal(t, int64(731), (<-ch).Txid)
+	assert.Equal(t, int64(732), (<-ch).Txid)
+}
@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+type SqliteLog struct {
+	Schema  string                 `json:"schema"` // 数据库名 main、temp或attach的名称
+	Table   string                 `json:"table"`
+	Label   string                 `json:"label"` // insert update delete
+	Rowid   int64                  `json:"rowid"`
+	Time    time.Time              `json:"time"` // 事务提交时间
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// log unmarshal to struct
+func NewSqliteLog(log string) (*SqliteLog, error) {
+	var l *SqliteLog
+	if err := json.Unmarshal([]byte(log), &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *SqliteLog) GetSchema() string {
+	return l.Schema
+}
+
+func (l *SqliteLog) GetTable() string {
+	return l.Table
+}
+
+// 获取日志记录类型 ddl dml
+func (l *SqliteLog) GetType() string {
+	return "dml"
+}
+
+// 具体标签 insert update delete
+func (l *SqliteLog) GetLabel() string {
+	return l.Label
+}
+
+// 获取日志记录时间
+func (l *SqliteLog) GetTime() time.Time {
+	return l.Time
+}
+
+// 获取具体的负载对象
+func (l *SqliteLog) GetPaylod() map[string]interface{} {
+	return l.Payload
+}
+
+// update hook不提供变更前的数据
+func (l *SqliteLog) GetChange() map[string]interface{} {
+	return nil
+}
+
+// GetDiff 提交后才查询数据，没有修改前的值
+func (l *SqliteLog) GetDiff() []diff.Column {
+	return nil
+}
@@ -0,0 +1,342 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/broker"
+	"github.com/wwqdrh/datamanager/dialet/tablename"
+	"github.com/wwqdrh/logger"
+)
+
+// 基于sqlite update/commit hook的数据变更捕获，主要用于本地开发以及测试
+// 注意:
+// 1、只有通过SqliteDialet.DB()执行的修改才会被捕获(hook是连接级别的)
+// 2、WITHOUT ROWID的表不会触发update hook
+// 3、update hook只提供rowid，数据在事务提交后查询，delete只能获取到rowid
+
+var (
+	driverSeq uint32
+
+	// 根据rowid获取数据
+	sqlFetchRowByRowid = `SELECT * FROM %s.%s WHERE rowid = ?`
+)
+
+var labels = map[int]string{
+	sqlite3.SQLITE_INSERT: "insert",
+	sqlite3.SQLITE_UPDATE: "update",
+	sqlite3.SQLITE_DELETE: "delete",
+}
+
+type change struct {
+	op     int
+	schema string
+	table  string
+	rowid  int64
+	time   time.Time
+}
+
+type SqliteDialet struct {
+	dsn    string
+	db     *sql.DB // 注册了hook的连接池，业务通过该连接池修改数据
+	reader *sql.DB // 用于查询变更后的数据
+
+	mu     sync.Mutex
+	tables map[string]bool // schema.table，见qualify
+	ready  []change        // 已提交的变更
+	notify chan struct{}   // ready有新数据
+
+	// 所有订阅者共享同一个事件流
+	broker *broker.Broker
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewSqliteDialet dsn: sqlite文件路径，不支持:memory:(hook连接与查询连接需要共享数据)
+func NewSqliteDialet(dsn string) (*SqliteDialet, error) {
+	d := &SqliteDialet{
+		dsn:    dsn,
+		tables: map[string]bool{},
+		notify: make(chan struct{}, 1),
+		broker: broker.New(),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	driverName := fmt.Sprintf("sqlite3_dbnotify_%d", atomic.AddUint32(&driverSeq, 1))
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: d.connectHook,
+	})
+
+	db, err := sql.Open(driverName, dsnWithParams(dsn, "_busy_timeout=5000"))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, errors.Wrap(err, "ping")
+	}
+	// 通过immediate事务等待写事务完成之后再读取数据
+	reader, err := sql.Open("sqlite3", dsnWithParams(dsn, "_busy_timeout=5000&_txlock=immediate"))
+	if err != nil {
+		return nil, err
+	}
+	d.db, d.reader = db, reader
+	return d, nil
+}
+
+func dsnWithParams(dsn, params string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + params
+	}
+	return "file:" + dsn + "?" + params
+}
+
+// connectHook 每个连接维护自己未提交的变更，提交后转移到ready中
+func (d *SqliteDialet) connectHook(conn *sqlite3.SQLiteConn) error {
+	var pending []change
+	conn.RegisterUpdateHook(func(op int, schema, table string, rowid int64) {
+		if !d.isWatched(schema, table) {
+			return
+		}
+		pending = append(pending, change{op: op, schema: schema, table: table, rowid: rowid})
+	})
+	conn.RegisterCommitHook(func() int {
+		if len(pending) > 0 {
+			d.commit(pending)
+			pending = nil
+		}
+		return 0
+	})
+	conn.RegisterRollbackHook(func() {
+		pending = nil
+	})
+	return nil
+}
+
+func (d *SqliteDialet) commit(changes []change) {
+	now := time.Now()
+	d.mu.Lock()
+	for _, c := range changes {
+		c.time = now
+		d.ready = append(d.ready, c)
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (d *SqliteDialet) DB() *sql.DB {
+	return d.db
+}
+
+func (d *SqliteDialet) Exec(sql string, args ...interface{}) error {
+	_, err := d.db.Exec(sql, args...)
+	return err
+}
+
+// Initial
+func (d *SqliteDialet) Initial() error {
+	return nil
+}
+
+func (d *SqliteDialet) Close() error {
+	d.cancel()
+	d.broker.Close()
+	errR := d.reader.Close()
+	errDB := d.db.Close()
+	if errR != nil {
+		return errors.Wrap(errR, "reader")
+	}
+	if errDB != nil {
+		return errors.Wrap(errDB, "DB")
+	}
+	return nil
+}
+
+// Register add policy for table，table为[schema.]table，不带schema时为main
+func (d *SqliteDialet) Register(table string) error {
+	key, err := qualify(table)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tables[key] = true
+	return nil
+}
+
+func (d *SqliteDialet) UnRegister(table string) error {
+	key, err := qualify(table)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tables, key)
+	return nil
+}
+
+// DefaultSchema 主数据库
+func (d *SqliteDialet) DefaultSchema() string {
+	return "main"
+}
+
+func (d *SqliteDialet) isWatched(schema, table string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tables[tablename.Join(schema, table)]
+}
+
+// qualify 统一为schema.table，与update hook中的数据库名以及表名对应
+func qualify(table string) (string, error) {
+	parts, err := tablename.Split(table)
+	if err != nil {
+		return "", err
+	}
+	switch len(parts) {
+	case 1:
+		return tablename.Join("main", parts[0]), nil
+	case 2:
+		return tablename.Join(parts[0], parts[1]), nil
+	}
+	return "", errors.Errorf("invalid table name %q", table)
+}
+
+// 修改指定数据库数据表的日志存储策略
+func (d *SqliteDialet) ModifyPolicy() error {
+	return nil
+}
+
+// 查看指定数据库的日志策略
+func (d *SqliteDialet) ListPolicy() error {
+	return nil
+}
+
+// 删除某个指定策略
+func (d *SqliteDialet) DeletePolicy() error {
+	return nil
+}
+
+// 获取监听channel，能够获取当前的日志修改记录
+// 每次调用都是一个独立的订阅者，都能收到全部事件，ctx结束后channel被关闭
+func (d *SqliteDialet) Watch(ctx context.Context) chan interface{} {
+	return d.Subscribe(ctx).C()
+}
+
+// Subscribe 与Watch相同，opts可以单独配置该订阅者的缓冲区以及慢消费者策略
+func (d *SqliteDialet) Subscribe(ctx context.Context, opts ...broker.Option) *broker.Subscription {
+	sub := d.broker.SubscribeContext(ctx, opts...)
+	d.once.Do(func() {
+		go d.handleEvents(d.ctx)
+	})
+	return sub
+}
+
+func (d *SqliteDialet) handleEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.notify:
+		}
+
+		d.mu.Lock()
+		changes := d.ready
+		d.ready = nil
+		d.mu.Unlock()
+
+		logs, err := d.lookup(ctx, changes)
+		if err != nil {
+			logger.DefaultLogger.Error(err.Error())
+		}
+		for _, l := range logs {
+			d.broker.Publish(ctx, l)
+		}
+	}
+}
+
+// lookup 查询变更后的数据
+func (d *SqliteDialet) lookup(ctx context.Context, changes []change) ([]*SqliteLog, error) {
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	tx, err := d.reader.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "begin")
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res := make([]*SqliteLog, 0, len(changes))
+	for _, c := range changes {
+		l := &SqliteLog{
+			Schema:  c.schema,
+			Table:   c.table,
+			Label:   labels[c.op],
+			Rowid:   c.rowid,
+			Time:    c.time,
+			Payload: map[string]interface{}{"rowid": c.rowid},
+		}
+		// 查询失败时只推送rowid，不影响同一批的其它变更
+		if c.op != sqlite3.SQLITE_DELETE {
+			payload, err := fetchRow(tx, c)
+			if err != nil {
+				logger.DefaultLogger.Error(err.Error())
+			} else if payload != nil {
+				l.Payload = payload
+			}
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
+
+func fetchRow(tx *sql.Tx, c change) (map[string]interface{}, error) {
+	rows, err := tx.Query(fmt.Sprintf(sqlFetchRowByRowid, quoteIdent(c.schema), quoteIdent(c.table)), c.rowid)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch row")
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		// 提交后又被删除
+		return nil, rows.Err()
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, errors.Wrap(err, "fetch row scan")
+	}
+
+	res := make(map[string]interface{}, len(cols))
+	for i, col := range cols {
+		if b, ok := values[i].([]byte); ok {
+			res[col] = string(b)
+		} else {
+			res[col] = values[i]
+		}
+	}
+	return res, nil
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,162 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testDatabaseDDL = `create table notes (id integer primary key, name text, note text)`
+	testOtherDDL    = `create table others (id integer primary key, name text)`
+	testInsert      = `insert into notes (name, note) values ('user1', 'here is a sample note')`
+	testUpdate      = `update notes set note = 'here is an updated note' where id = 1`
+	testDelete      = `delete from notes where id = 1`
+	testOtherInsert = `insert into others (name) values ('user1')`
+)
+
+func newTestDialet(t *testing.T) *SqliteDialet {
+	d, err := NewSqliteDialet(filepath.Join(t.TempDir(), "test.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, d.Close())
+	})
+	require.Nil(t, d.Initial())
+	require.Nil(t, d.Exec(testDatabaseDDL))
+	require.Nil(t, d.Exec(testOtherDDL))
+	return d
+}
+
+func receive(t *testing.T, ch chan interface{}) *SqliteLog {
+	select {
+	case item := <-ch:
+		l, ok := item.(*SqliteLog)
+		require.True(t, ok)
+		return l
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait event timeout")
+	}
+	return nil
+}
+
+func TestSqliteWatch(t *testing.T) {
+	d := newTestDialet(t)
+	require.Nil(t, d.Register("notes"))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	ch := d.Watch(ctx)
+
+	require.Nil(t, d.Exec(testOtherInsert)) // 未注册
+	require.Nil(t, d.Exec(testInsert))
+	l := receive(t, ch)
+	assert.Equal(t, "main", l.GetSchema())
+	assert.Equal(t, "notes", l.GetTable())
+	assert.Equal(t, "insert", l.GetLabel())
+	assert.Equal(t, "here is a sample note", l.GetPaylod()["note"])
+
+	require.Nil(t, d.Exec(testUpdate))
+	l = receive(t, ch)
+	assert.Equal(t, "update", l.GetLabel())
+	assert.Equal(t, "here is an updated note", l.GetPaylod()["note"])
+
+	require.Nil(t, d.Exec(testDelete))
+	l = receive(t, ch)
+	assert.Equal(t, "delete", l.GetLabel())
+	assert.Equal(t, map[string]interface{}{"rowid": int64(1)}, l.GetPaylod())
+}
+
+func TestSqliteTransaction(t *testing.T) {
+	d := newTestDialet(t)
+	require.Nil(t, d.Register("notes"))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	ch := d.Watch(ctx)
+
+	// 回滚的事务不会产生事件
+	tx, err := d.DB().Begin()
+	require.Nil(t, err)
+	_, err = tx.Exec(testInsert)
+	require.Nil(t, err)
+	require.Nil(t, tx.Rollback())
+
+	tx, err = d.DB().Begin()
+	require.Nil(t, err)
+	_, err = tx.Exec(testInsert)
+	require.Nil(t, err)
+	_, err = tx.Exec(testInsert)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	first, second := receive(t, ch), receive(t, ch)
+	assert.Equal(t, int64(1), first.Rowid) // 回滚的rowid会被复用
+	assert.Equal(t, int64(1), first.GetPaylod()["id"])
+	assert.Equal(t, int64(2), second.Rowid)
+
+	require.Nil(t, d.UnRegister("notes"))
+	require.Nil(t, d.Exec(testInsert))
+	select {
+	case item := <-ch:
+		t.Errorf("unexpected event %v", item)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// 多个订阅者都能收到全部事件
+func TestSqliteMultiWatch(t *testing.T) {
+	d := newTestDialet(t)
+	require.Nil(t, d.Register("notes"))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	first, second := d.Watch(ctx), d.Watch(ctx)
+
+	require.Nil(t, d.Exec(testInsert))
+	assert.Equal(t, "insert", receive(t, first).GetLabel())
+	assert.Equal(t, "insert", receive(t, second).GetLabel())
+
+	cancel()
+	_, ok := <-first
+	assert.False(t, ok)
+}
+
+// 带schema的表名以及双引号包裹的表名
+func TestSqliteRegisterSchema(t *testing.T) {
+	d := newTestDialet(t)
+	require.Nil(t, d.Register("main.notes"))
+	require.Nil(t, d.Register(`"main"."others"`))
+	assert.True(t, d.isWatched("main", "notes"))
+	assert.True(t, d.isWatched("main", "others"))
+	assert.False(t, d.isWatched("temp", "notes"))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	ch := d.Watch(ctx)
+	require.Nil(t, d.Exec(testInsert))
+	assert.Equal(t, "notes", receive(t, ch).GetTable())
+
+	require.Nil(t, d.UnRegister("notes"))
+	assert.False(t, d.isWatched("main", "notes"))
+	assert.NotNil(t, d.Register(`"notes`))
+}
+
+// 查询失败的变更只推送rowid，之后的变更正常查询
+func TestSqliteLookupError(t *testing.T) {
+	d := newTestDialet(t)
+	require.Nil(t, d.Exec(testInsert))
+
+	logs, err := d.lookup(context.TODO(), []change{
+		{op: sqlite3.SQLITE_INSERT, schema: "main", table: "missing", rowid: 1},
+		{op: sqlite3.SQLITE_INSERT, schema: "main", table: "notes", rowid: 1},
+	})
+	require.Nil(t, err)
+	require.Len(t, logs, 2)
+	assert.Equal(t, map[string]interface{}{"rowid": int64(1)}, logs[0].GetPaylod())
+	assert.Equal(t, "here is a sample note", logs[1].GetPaylod()["note"])
+}
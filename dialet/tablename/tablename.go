@@ -0,0 +1,102 @@
+package tablename
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 表名: [schema.]table，订阅、缓存策略以及dialet的Register共用，避免与dialet包循环引用
+// 名称区分大小写，包含点或者双引号的名称需要用双引号包裹，例如 "tenant.1"."Orders"
+
+// defaultSchemas dialet没有指定默认schema时，不带schema的表名匹配的schema(postgres、sqlite)
+var defaultSchemas = map[string]bool{"": true, "public": true, "main": true}
+
+// Split 按照不在双引号中的点分割，双引号中的""表示一个双引号
+func Split(s string) ([]string, error) {
+	var (
+		parts  []string
+		cur    strings.Builder
+		quoted bool // 当前部分是否以双引号开始
+		inside bool // 是否在双引号中
+	)
+	flush := func() error {
+		if cur.Len() == 0 && !quoted {
+			return errors.Errorf("invalid table name %q", s)
+		}
+		parts = append(parts, cur.String())
+		cur.Reset()
+		quoted = false
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inside && c == '"':
+			if i+1 < len(s) && s[i+1] == '"' {
+				cur.WriteByte('"')
+				i++
+				continue
+			}
+			inside = false
+			if i+1 < len(s) && s[i+1] != '.' {
+				return nil, errors.Errorf("invalid table name %q", s)
+			}
+		case inside:
+			cur.WriteByte(c)
+		case c == '"':
+			if cur.Len() > 0 {
+				return nil, errors.Errorf("invalid table name %q", s)
+			}
+			quoted, inside = true, true
+		case c == '.':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if inside {
+		return nil, errors.Errorf("unterminated quote in table name %q", s)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// Quote 名称中包含点或者双引号时用双引号包裹，与Split互逆
+func Quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, `."`) {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// Join schema为空时只有表名
+func Join(schema, name string) string {
+	if schema == "" {
+		return Quote(name)
+	}
+	return Quote(schema) + "." + Quote(name)
+}
+
+// Match table(订阅或者缓存策略中的表名)是否为schema.name
+// table不带schema时只匹配defaultSchema中的表，defaultSchema为空时匹配public、main以及没有schema的事件
+func Match(table, defaultSchema, schema, name string) bool {
+	parts, err := Split(table)
+	if err != nil {
+		return table == name
+	}
+	if len(parts) == 2 {
+		return parts[0] == schema && parts[1] == name
+	}
+	if len(parts) != 1 || parts[0] != name {
+		return false
+	}
+	if defaultSchema != "" {
+		return schema == defaultSchema || schema == ""
+	}
+	return defaultSchemas[schema]
+}
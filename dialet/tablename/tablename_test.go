@@ -0,0 +1,40 @@
+package tablename
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuoteSplit(t *testing.T) {
+	for _, c := range [][2]string{
+		{"public", "notes"},
+		{"tenant.1", "orders"},
+		{"Tenant", `say "hi"`},
+		{"a", ""},
+	} {
+		parts, err := Split(Join(c[0], c[1]))
+		require.Nil(t, err, c)
+		assert.Equal(t, []string{c[0], c[1]}, parts)
+	}
+	assert.Equal(t, "tenant_1.orders", Join("tenant_1", "orders"))
+	assert.Equal(t, `"tenant.1".orders`, Join("tenant.1", "orders"))
+	assert.Equal(t, "orders", Join("", "orders"))
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match("tenant_1.orders", "", "tenant_1", "orders"))
+	assert.False(t, Match("tenant_1.orders", "", "tenant_2", "orders"))
+	assert.False(t, Match("tenant_1.orders", "", "", "orders"))
+	assert.True(t, Match(`"tenant.1".orders`, "", "tenant.1", "orders"))
+
+	// 不带schema时只匹配默认的schema
+	assert.True(t, Match("orders", "", "public", "orders"))
+	assert.True(t, Match("orders", "", "main", "orders"))
+	assert.True(t, Match("orders", "", "", "orders"))
+	assert.False(t, Match("orders", "", "tenant_2", "orders"))
+	assert.True(t, Match("orders", "test", "test", "orders"))
+	assert.False(t, Match("orders", "test", "public", "orders"))
+	assert.False(t, Match("orders", "", "public", "notes"))
+}
@@ -0,0 +1,164 @@
+package datamanager
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/logger"
+)
+
+// 每个订阅一个有界队列以及投递的goroutine，慢的回调地址(包括重试)不会阻塞事件循环以及其它订阅
+// 同一订阅的事件按顺序投递，队列满时事件直接写入死信
+
+const defaultQueueSize = 100
+
+var errQueueFull = errors.New("delivery queue full")
+
+// WithQueueSize 每个订阅待投递事件的队列长度，默认为100
+func WithQueueSize(n int) WatcherOption {
+	return func(w *Watcher) {
+		w.queueSize = n
+	}
+}
+
+type delivery struct {
+	table string
+	body  []byte
+	ack   *eventAck
+}
+
+// eventAck 事件的所有投递完成(成功或者写入死信)后调用IAck.Ack
+// 任一投递既没有成功也没有写入死信时不确认，事件在重启之后重新消费
+type eventAck struct {
+	a      IAck
+	n      int32
+	failed int32
+}
+
+// newEventAck 初始计数为1，由NotifyFrom在入队完成后释放，避免入队期间提前确认
+func newEventAck(e interface{}) *eventAck {
+	a, ok := e.(IAck)
+	if !ok {
+		return nil
+	}
+	return &eventAck{a: a, n: 1}
+}
+
+func (e *eventAck) add() {
+	if e != nil {
+		atomic.AddInt32(&e.n, 1)
+	}
+}
+
+func (e *eventAck) done(ok bool) {
+	if e == nil {
+		return
+	}
+	if !ok {
+		atomic.StoreInt32(&e.failed, 1)
+	}
+	if atomic.AddInt32(&e.n, -1) == 0 && atomic.LoadInt32(&e.failed) == 0 {
+		e.a.Ack()
+	}
+}
+
+// dispatcher 一次NotifyFrom使用的队列
+type dispatcher struct {
+	w   *Watcher
+	ctx context.Context
+
+	mu     sync.Mutex
+	queues map[string]chan *delivery // 订阅ID => 队列
+	wg     sync.WaitGroup
+}
+
+func (w *Watcher) newDispatcher(ctx context.Context) *dispatcher {
+	d := &dispatcher{w: w, ctx: ctx, queues: map[string]chan *delivery{}}
+	w.dmu.Lock()
+	w.dispatchers[d] = struct{}{}
+	w.dmu.Unlock()
+	return d
+}
+
+// enqueue 不会阻塞，队列满时写入死信
+func (d *dispatcher) enqueue(cb *Callback, table string, body []byte, ack *eventAck) {
+	ack.add()
+	d.mu.Lock()
+	q, ok := d.queues[cb.ID]
+	if !ok {
+		size := d.w.queueSize
+		if size <= 0 {
+			size = defaultQueueSize
+		}
+		q = make(chan *delivery, size)
+		d.queues[cb.ID] = q
+		d.wg.Add(1)
+		go d.run(cb.ID, q)
+	}
+	select {
+	case q <- &delivery{table: table, body: body, ack: ack}:
+		d.mu.Unlock()
+		return
+	default:
+	}
+	d.mu.Unlock()
+	err := d.w.deadLetter(cb, "", table, body, 0, errQueueFull)
+	logger.DefaultLogger.Error(err.Error())
+	ack.done(!isSaveDeadLetter(err))
+}
+
+// run 使用订阅当前的配置投递，订阅删除后丢弃剩余的事件
+func (d *dispatcher) run(id string, q chan *delivery) {
+	defer d.wg.Done()
+	for item := range q {
+		cb, err := d.w.Subscription(id)
+		if err != nil {
+			d.remove(id, q)
+			item.ack.done(true)
+			continue
+		}
+		err = d.w.deliver(d.ctx, cb, item.table, item.body)
+		if err != nil {
+			logger.DefaultLogger.Error(err.Error())
+		}
+		item.ack.done(!isSaveDeadLetter(err))
+	}
+}
+
+// remove 关闭订阅的队列，q为nil时关闭当前的队列
+func (d *dispatcher) remove(id string, q chan *delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cur, ok := d.queues[id]
+	if !ok || (q != nil && cur != q) {
+		return
+	}
+	delete(d.queues, id)
+	close(cur)
+}
+
+// close 关闭所有队列并等待已经入队的事件投递完成，ctx结束时剩余的事件写入死信
+func (d *dispatcher) close() {
+	d.w.dmu.Lock()
+	delete(d.w.dispatchers, d)
+	d.w.dmu.Unlock()
+
+	d.mu.Lock()
+	for id, q := range d.queues {
+		delete(d.queues, id)
+		close(q)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// removeQueues 订阅删除时关闭所有NotifyFrom中该订阅的队列
+func (w *Watcher) removeQueues(id string) {
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	for d := range w.dispatchers {
+		d.remove(id, nil)
+	}
+}
@@ -42,16 +42,21 @@ func main() {
 	go repo.Notify(ctx)
 
 	// 读取缓存中的数据
-	fmt.Println(repo.GetValueV2("notescount"))
+	fmt.Println(repo.GetValue("notescount"))
 
 	// 修改数据库中的数据
+	v := repo.Version("notescount")
 	if _, err := dialet.Stream().DB().Exec("insert into notes values (default, default, 'here is a sample note')"); err != nil {
 		panic(err)
 	}
 
-	// 读取缓存中的数据判断是否更新
-	time.Sleep(3 * time.Second)
-	fmt.Println(repo.GetValueV2("notescount"))
+	// 等待缓存更新
+	waitCtx, waitCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer waitCancel()
+	if _, err := repo.WaitForVersion(waitCtx, "notescount", v+1); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(repo.GetValue("notescount"))
 }
 
 func monitor(ctx context.Context) chan mydialet.ILogData {
@@ -86,6 +91,11 @@ func monitor(ctx context.Context) chan mydialet.ILogData {
 			l, err := postgres.NewPostgresLog(item)
 			if err != nil {
 				logger.DefaultLogger.Error(err.Error())
+				continue
+			}
+			// 提交标记只用于事务分组
+			if postgres.Operation(l.Op) == postgres.Operation_COMMIT {
+				continue
 			}
 			ch <- l
 		}
@@ -0,0 +1,238 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wwqdrh/datamanager"
+	"github.com/wwqdrh/datamanager/transport/sqlite"
+)
+
+// 基于事件日志的实时推送: sse以及websocket
+// 查询参数:
+//   table: 表名，逗号分隔
+//   op: 操作类型，逗号分隔，insert update delete truncate
+//   field: 发生变化的列，逗号分隔，任意一列变化时推送
+//   where: payload条件，可以重复，例如 where=status = 'paid'
+//   last_event_id: 从该序号之后开始推送，sse也可以通过Last-Event-ID请求头传入，默认只推送新事件
+// 每条事件都携带事件日志的序号作为id，断线重连时携带最后收到的id即可继续
+
+const (
+	defaultHeartbeat = 15 * time.Second
+	writeTimeout     = 10 * time.Second
+)
+
+// Source 事件来源，sqlite.EventLog满足该接口
+type Source interface {
+	Tail(ctx context.Context, from int64) chan *sqlite.Entry
+	LastSeq() (int64, error)
+}
+
+type Handler struct {
+	source    Source
+	heartbeat time.Duration
+	upgrader  websocket.Upgrader
+}
+
+type Option func(*Handler)
+
+// WithHeartbeat 没有事件时发送心跳的间隔
+func WithHeartbeat(d time.Duration) Option {
+	return func(h *Handler) {
+		h.heartbeat = d
+	}
+}
+
+// WithCheckOrigin websocket握手时校验Origin，默认只允许同源
+func WithCheckOrigin(fn func(r *http.Request) bool) Option {
+	return func(h *Handler) {
+		h.upgrader.CheckOrigin = fn
+	}
+}
+
+func New(source Source, opts ...Option) *Handler {
+	h := &Handler{
+		source:    source,
+		heartbeat: defaultHeartbeat,
+	}
+	for _, o := range opts {
+		o(h)
+	}
+	return h
+}
+
+// subscription 一个连接的过滤条件以及起始位置
+type subscription struct {
+	tables map[string]bool
+	filter *datamanager.Filter
+	from   int64
+}
+
+func splitComma(values []string) []string {
+	res := []string{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+	}
+	return res
+}
+
+func (h *Handler) parse(r *http.Request) (*subscription, error) {
+	q := r.URL.Query()
+	filter, err := datamanager.NewFilter(splitComma(q["op"]), splitComma(q["field"]), q["where"])
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{tables: map[string]bool{}, filter: filter}
+	for _, t := range splitComma(q["table"]) {
+		sub.tables[t] = true
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = q.Get("last_event_id")
+	}
+	if lastID != "" {
+		if sub.from, err = strconv.ParseInt(lastID, 10, 64); err != nil || sub.from < 0 {
+			return nil, fmt.Errorf("invalid last event id %q", lastID)
+		}
+		return sub, nil
+	}
+	if sub.from, err = h.source.LastSeq(); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *subscription) match(e *sqlite.Entry) bool {
+	if len(s.tables) > 0 && !s.tables[e.Table] && !s.tables[e.Schema+"."+e.Table] {
+		return false
+	}
+	return s.filter.Match(e)
+}
+
+// ServeSSE text/event-stream，事件类型为change，心跳为注释行
+func (h *Handler) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.parse(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// 告知客户端重连间隔
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	ctx := r.Context()
+	events := h.source.Tail(ctx, sub.from)
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !sub.match(e) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", e.Seq, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Message websocket推送的消息
+type Message struct {
+	Type string        `json:"type"` // change heartbeat
+	ID   int64         `json:"id,omitempty"`
+	Data *sqlite.Entry `json:"data,omitempty"`
+}
+
+// ServeWS websocket，客户端发送的消息会被忽略，关闭连接即取消订阅
+func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.parse(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade已经返回了错误响应
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// 读取客户端消息以便处理close以及pong，连接断开后结束推送
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(m *Message) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(m)
+	}
+
+	events := h.source.Tail(ctx, sub.from)
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := write(&Message{Type: "heartbeat"}); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !sub.match(e) {
+				continue
+			}
+			if err := write(&Message{Type: "change", ID: e.Seq, Data: e}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/transport/sqlite"
+)
+
+func newTestFeed(t *testing.T, opts ...Option) (*sqlite.EventLog, *httptest.Server) {
+	l, err := sqlite.NewEventLog(filepath.Join(t.TempDir(), "eventlog.db"))
+	require.Nil(t, err)
+	h := New(l, opts...)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream/sse", h.ServeSSE)
+	mux.HandleFunc("/stream/ws", h.ServeWS)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		l.Close()
+	})
+	return l, srv
+}
+
+func appendEntry(t *testing.T, l *sqlite.EventLog, table, label string, payload map[string]interface{}) {
+	_, err := l.Append(&sqlite.Entry{Schema: "public", Table: table, Label: label, Time: time.Now(), Payload: payload})
+	require.Nil(t, err)
+}
+
+// sseEvent 读取下一个sse事件，返回id以及data，心跳返回空id以及":"开头的注释
+func readSSE(t *testing.T, r *bufio.Reader) (string, string) {
+	var id, data string
+	for {
+		line, err := r.ReadString('\n')
+		require.Nil(t, err)
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if id != "" || data != "" {
+				return id, data
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case strings.HasPrefix(line, ":"):
+			data = line
+		}
+	}
+}
+
+func openSSE(t *testing.T, srv *httptest.Server, query url.Values, lastID string) *bufio.Reader {
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/stream/sse?"+query.Encode(), nil)
+	require.Nil(t, err)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+}
+
+func TestSSEFilterAndResume(t *testing.T) {
+	l, srv := newTestFeed(t)
+	appendEntry(t, l, "orders", "insert", map[string]interface{}{"status": "new"})
+
+	// 默认只推送新事件
+	query := url.Values{"table": {"orders"}, "op": {"insert,update"}, "where": {"status = 'paid'"}}
+	r := openSSE(t, srv, query, "")
+	appendEntry(t, l, "users", "insert", map[string]interface{}{"status": "paid"})
+	appendEntry(t, l, "orders", "delete", map[string]interface{}{"status": "paid"})
+	appendEntry(t, l, "orders", "update", map[string]interface{}{"status": "paid"})
+
+	id, data := readSSE(t, r)
+	assert.Equal(t, "4", id)
+	var e sqlite.Entry
+	require.Nil(t, json.Unmarshal([]byte(data), &e))
+	assert.Equal(t, "orders", e.Table)
+	assert.Equal(t, "update", e.Label)
+
+	// 断线重连，从Last-Event-ID之后继续
+	r = openSSE(t, srv, url.Values{}, "2")
+	id, _ = readSSE(t, r)
+	assert.Equal(t, "3", id)
+	id, _ = readSSE(t, r)
+	assert.Equal(t, "4", id)
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	_, srv := newTestFeed(t, WithHeartbeat(10*time.Millisecond))
+	r := openSSE(t, srv, url.Values{}, "")
+	id, data := readSSE(t, r)
+	assert.Empty(t, id)
+	assert.Equal(t, ": heartbeat", data)
+}
+
+func TestSSEInvalidQuery(t *testing.T) {
+	_, srv := newTestFeed(t)
+	for _, q := range []string{"where=status", "last_event_id=abc"} {
+		resp, err := http.Get(srv.URL + "/stream/sse?" + q)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, q)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	l, srv := newTestFeed(t, WithHeartbeat(50*time.Millisecond))
+	appendEntry(t, l, "notes", "insert", map[string]interface{}{"note": "a"})
+	appendEntry(t, l, "notes", "insert", map[string]interface{}{"note": "b"})
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/stream/ws?table=public.notes&last_event_id=1"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	var m Message
+	require.Nil(t, conn.ReadJSON(&m))
+	assert.Equal(t, "change", m.Type)
+	assert.Equal(t, int64(2), m.ID)
+	assert.Equal(t, "b", m.Data.Payload["note"])
+
+	require.Nil(t, conn.ReadJSON(&m))
+	assert.Equal(t, "heartbeat", m.Type)
+}
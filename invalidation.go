@@ -0,0 +1,134 @@
+package datamanager
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wwqdrh/logger"
+)
+
+// 多实例之间的缓存失效通知
+// 收到事件的实例更新缓存后在redis频道中发布受影响的key，其它实例删除本地缓存中的这些key，下次GetValue时从redis(二级缓存)或者数据库中读取
+// 消息中带有实例id，忽略自己发布的消息
+
+const defaultInvalidationChannel = "datamanager:invalidate"
+
+// WithInvalidation 通过redis的channel与其它实例同步缓存失效，channel为空时使用默认的频道
+func WithInvalidation(client *redis.Client, channel string) RepoOption {
+	return func(r *Repo) {
+		if channel == "" {
+			channel = defaultInvalidationChannel
+		}
+		r.pubsub = client
+		r.channel = channel
+	}
+}
+
+// WithInstanceID 默认为随机的uuid
+func WithInstanceID(id string) RepoOption {
+	return func(r *Repo) {
+		r.instanceID = id
+	}
+}
+
+type invalidationMessage struct {
+	Instance string   `json:"instance"`
+	Keys     []string `json:"keys"`
+}
+
+// InstanceID 当前实例的id
+func (r *Repo) InstanceID() string {
+	return r.instanceID
+}
+
+// publish 通知其它实例keys已经修改
+func (r *Repo) publish(keys ...string) {
+	if r.pubsub == nil || len(keys) == 0 {
+		return
+	}
+	data, err := json.Marshal(&invalidationMessage{Instance: r.instanceID, Keys: keys})
+	if err != nil {
+		logger.DefaultLogger.Error(err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	if err := r.pubsub.Publish(ctx, r.channel, data).Err(); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
+}
+
+// publishAfter 后台计算完成后再通知，避免其它实例读到旧值
+func (r *Repo) publishAfter(f *flight, key string) {
+	<-f.done
+	r.publish(key)
+}
+
+// subscribe 接收其它实例的失效通知，ctx结束时退出
+func (r *Repo) subscribe(ctx context.Context) {
+	sub := r.pubsub.Subscribe(ctx, r.channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+		return
+	}
+	ch := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			r.handleInvalidation(msg.Payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Repo) handleInvalidation(payload string) {
+	var msg invalidationMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+		return
+	}
+	if msg.Instance == r.instanceID {
+		return
+	}
+	for _, key := range msg.Keys {
+		r.evict(key)
+	}
+}
+
+// evict 删除本地缓存中的key，redis等共享的缓存已经由发布的实例更新
+func (r *Repo) evict(key string) {
+	local := localBackend(r.backend)
+	if local == nil {
+		return
+	}
+	r.flightMu.Lock()
+	if f, ok := r.flights[key]; ok {
+		f.dirty = true
+	}
+	r.flightMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	if err := local.Delete(ctx, key); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
+	cancel()
+	r.ValueMap.Delete(key)
+	// TieredBackend中key仍然在redis中
+	r.wake(key, local != r.backend, r.stamp())
+}
+
+// localBackend 只属于当前实例的缓存，RedisBackend以及自定义的backend作为共享的缓存，返回nil
+func localBackend(b CacheBackend) CacheBackend {
+	switch b := b.(type) {
+	case *MemoryBackend:
+		return b
+	case *TieredBackend:
+		return localBackend(b.local)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package datamanager
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestReplica 本地缓存加共享redis的实例
+func newTestReplica(t *testing.T, mr *miniredis.Miniredis, count *int32) (*Repo, *MemoryBackend) {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	local := NewMemoryBackend(0)
+	r := NewRepo(nil,
+		WithBackend(NewTieredBackend(local, NewRedisBackend(client, JSONCodec), 0)),
+		WithInvalidation(client, ""),
+	)
+	r.Register(&Policy{
+		Key:   "notescount",
+		Table: "notes",
+		Field: "*",
+		Call: func() interface{} {
+			return float64(atomic.LoadInt32(count))
+		},
+	})
+	return r, local
+}
+
+func TestRepoInvalidation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var count int32 = 1
+	a, localA := newTestReplica(t, mr, &count)
+	b, localB := newTestReplica(t, mr, &count)
+	require.NotEqual(t, a.InstanceID(), b.InstanceID())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Notify(ctx)
+	go b.Notify(ctx)
+	require.Eventually(t, func() bool {
+		return mr.PubSubNumSub(defaultInvalidationChannel)[defaultInvalidationChannel] == 2
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, float64(1), a.GetValue("notescount"))
+	assert.Equal(t, float64(1), b.GetValue("notescount"))
+
+	// 只有a收到事件
+	atomic.StoreInt32(&count, 2)
+	a.Trigger(&testLog{table: "notes"})
+	require.Eventually(t, func() bool {
+		_, ok, _ := localB.Get(context.Background(), "notescount", nil)
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, float64(2), b.GetValue("notescount"))
+
+	// 忽略自己发布的消息
+	v, ok, _ := localA.Get(context.Background(), "notescount", nil)
+	require.True(t, ok)
+	assert.Equal(t, float64(2), v)
+}
+
+func TestRepoInvalidationSelfEcho(t *testing.T) {
+	r := NewRepo(nil, WithInstanceID("a"))
+	r.Register(&Policy{Key: "k", Table: "t", Field: "*", Call: func() interface{} { return 1 }})
+	assert.Equal(t, 1, r.GetValue("k"))
+
+	r.handleInvalidation(`{"instance":"a","keys":["k"]}`)
+	_, ok := r.load("k", nil)
+	assert.True(t, ok)
+
+	r.handleInvalidation(`{"instance":"b","keys":["k"]}`)
+	_, ok = r.load("k", nil)
+	assert.False(t, ok)
+
+	// redis为共享的缓存，由发布的实例更新
+	_, client := newTestRedis(t)
+	r = NewRepo(nil, WithInstanceID("a"), WithBackend(NewRedisBackend(client, nil)))
+	r.Register(&Policy{Key: "k", Table: "t", Field: "*", Call: func() interface{} { return 1 }})
+	r.GetValue("k")
+	r.handleInvalidation(`{"instance":"b","keys":["k"]}`)
+	_, ok = r.load("k", nil)
+	assert.True(t, ok)
+}
@@ -0,0 +1,127 @@
+package datamanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 缓存key模板: 例如 note:{id}、user:{user_id}:notes，{}中为数据表的字段
+// 事件触发时从payload(update时还有修改前的值)中解析出受影响的key，只更新这些key
+
+type keyTemplate struct {
+	literals []string // 比fields多一个，与fields交替组成key
+	fields   []string
+	re       *regexp.Regexp
+}
+
+func parseKeyTemplate(s string) *keyTemplate {
+	t := &keyTemplate{}
+	lit := ""
+	for {
+		i := strings.Index(s, "{")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i:], "}")
+		if j < 0 {
+			break
+		}
+		// {}不是字段
+		if j == 1 {
+			lit += s[:i+2]
+			s = s[i+2:]
+			continue
+		}
+		t.literals = append(t.literals, lit+s[:i])
+		t.fields = append(t.fields, s[i+1:i+j])
+		lit = ""
+		s = s[i+j+1:]
+	}
+	t.literals = append(t.literals, lit+s)
+
+	pattern := regexp.QuoteMeta(t.literals[0])
+	for _, l := range t.literals[1:] {
+		pattern += "(.*)" + regexp.QuoteMeta(l)
+	}
+	t.re = regexp.MustCompile("^" + pattern + "$")
+	return t
+}
+
+// static 没有字段的key
+func (t *keyTemplate) static() bool {
+	return len(t.fields) == 0
+}
+
+func (t *keyTemplate) format(params map[string]string) string {
+	var b strings.Builder
+	for i, f := range t.fields {
+		b.WriteString(t.literals[i])
+		b.WriteString(params[f])
+	}
+	b.WriteString(t.literals[len(t.fields)])
+	return b.String()
+}
+
+// args GetValue的参数，按照字段在模板中的顺序
+func (t *keyTemplate) args(args []interface{}) (map[string]string, bool) {
+	if len(args) != len(t.fields) {
+		return nil, false
+	}
+	params := make(map[string]string, len(args))
+	for i, f := range t.fields {
+		v, ok := keyString(args[i])
+		if !ok {
+			return nil, false
+		}
+		params[f] = v
+	}
+	return params, true
+}
+
+// params 从行数据中获取字段，缺少字段或者为null时返回false
+func (t *keyTemplate) params(row map[string]interface{}) (map[string]string, bool) {
+	params := make(map[string]string, len(t.fields))
+	for _, f := range t.fields {
+		v, ok := keyString(row[f])
+		if !ok {
+			return nil, false
+		}
+		params[f] = v
+	}
+	return params, true
+}
+
+// glob 匹配该模板的所有key，用于CacheBackend.Keys
+func (t *keyTemplate) glob() string {
+	var b strings.Builder
+	for i := range t.fields {
+		b.WriteString(globEscape(t.literals[i]))
+		b.WriteString("*")
+	}
+	b.WriteString(globEscape(t.literals[len(t.fields)]))
+	return b.String()
+}
+
+func (t *keyTemplate) match(key string) bool {
+	return t.re.MatchString(key)
+}
+
+// keyString json中的数字为float64，按照整数的格式输出，避免1e+06
+func keyString(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return val, true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32), true
+	case json.Number:
+		return val.String(), true
+	}
+	return fmt.Sprint(v), true
+}
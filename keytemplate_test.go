@@ -0,0 +1,36 @@
+package datamanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	tpl := parseKeyTemplate("user:{user_id}:notes:{id}")
+	assert.False(t, tpl.static())
+	assert.Equal(t, []string{"user_id", "id"}, tpl.fields)
+
+	params, ok := tpl.params(map[string]interface{}{"user_id": float64(12345678), "id": "a", "note": "n"})
+	assert.True(t, ok)
+	assert.Equal(t, "user:12345678:notes:a", tpl.format(params))
+	_, ok = tpl.params(map[string]interface{}{"user_id": nil, "id": "a"})
+	assert.False(t, ok)
+
+	params, ok = tpl.args([]interface{}{42, "b"})
+	assert.True(t, ok)
+	assert.Equal(t, "user:42:notes:b", tpl.format(params))
+	_, ok = tpl.args([]interface{}{42})
+	assert.False(t, ok)
+
+	assert.True(t, tpl.match("user:42:notes:b"))
+	assert.False(t, tpl.match("user:42:notes"))
+	assert.False(t, tpl.match("note:42"))
+
+	for _, key := range []string{"cacheA", "a{}b", "a{b"} {
+		tpl := parseKeyTemplate(key)
+		assert.True(t, tpl.static(), key)
+		assert.Equal(t, key, tpl.format(nil))
+		assert.True(t, tpl.match(key))
+	}
+}
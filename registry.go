@@ -0,0 +1,322 @@
+package datamanager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet"
+)
+
+// 持久化的注册信息: 监听的表、回调订阅以及脱敏规则，重启后重新加载
+// db可以通过transport/sqlite的SqliteDriver获取
+// 回调的secret默认明文保存，能读取数据库文件的用户可以伪造签名，需要限制文件权限(0600)或者通过WithSecretKey加密
+
+var (
+	registryCreate = `
+	CREATE TABLE IF NOT EXISTS registry_tables (
+		name       TEXT PRIMARY KEY,
+		created_at INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS registry_callbacks (
+		id         TEXT PRIMARY KEY,
+		tbl        TEXT,
+		url        TEXT,
+		timeout    INTEGER,
+		secret     TEXT,
+		filter     TEXT,
+		created_at INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS registry_redactions (
+		schema TEXT,
+		tbl    TEXT,
+		fields TEXT,
+		PRIMARY KEY (schema, tbl)
+	);
+	`
+
+	registryAddTable    = `INSERT OR IGNORE INTO registry_tables (name, created_at) values (?, ?)`
+	registryRemoveTable = `DELETE FROM registry_tables WHERE name = ?`
+	registryTables      = `SELECT name FROM registry_tables ORDER BY created_at, name`
+
+	registrySaveCallback = `
+	INSERT OR REPLACE INTO registry_callbacks (id, tbl, url, timeout, secret, filter, created_at) values (?, ?, ?, ?, ?, ?, ?)
+	`
+	registryDeleteCallback = `DELETE FROM registry_callbacks WHERE id = ?`
+	registryCallbacks      = `SELECT id, tbl, url, timeout, secret, filter, created_at FROM registry_callbacks ORDER BY created_at`
+
+	registrySaveRedaction   = `INSERT OR REPLACE INTO registry_redactions (schema, tbl, fields) values (?, ?, ?)`
+	registryDeleteRedaction = `DELETE FROM registry_redactions WHERE schema = ? AND tbl = ?`
+	registryRedactions      = `SELECT schema, tbl, fields FROM registry_redactions`
+
+	registryPlainSecrets = `SELECT id, secret FROM registry_callbacks WHERE secret != '' AND secret NOT LIKE 'enc:%'`
+	registryUpdateSecret = `UPDATE registry_callbacks SET secret = ? WHERE id = ?`
+)
+
+// 加密后的secret: enc:base64(nonce+密文)
+const encryptedSecretPrefix = "enc:"
+
+var ErrSecretKeyRequired = errors.New("registry secret is encrypted but no secret key configured")
+
+// Redactions schema => table => 需要脱敏的字段，与postgres.FieldRedactions结构相同
+type Redactions map[string]map[string][]string
+
+type Registry struct {
+	db   *sql.DB
+	aead cipher.AEAD // 非空时加密回调的secret
+}
+
+type RegistryOption func(*Registry) error
+
+// WithSecretKey 使用key(任意长度，sha256后作为AES-256的密钥)加密回调的secret，已有的明文secret在NewRegistry时加密
+// key需要通过配置(例如环境变量)提供，不能与数据库文件保存在一起
+func WithSecretKey(key []byte) RegistryOption {
+	return func(r *Registry) error {
+		if len(key) == 0 {
+			return nil
+		}
+		sum := sha256.Sum256(key)
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return err
+		}
+		r.aead, err = cipher.NewGCM(block)
+		return err
+	}
+}
+
+func NewRegistry(db *sql.DB, opts ...RegistryOption) (*Registry, error) {
+	if _, err := db.Exec(registryCreate); err != nil {
+		return nil, err
+	}
+	r := &Registry{db: db}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.encryptSecrets(); err != nil {
+		return nil, errors.Wrap(err, "encrypt secrets")
+	}
+	return r, nil
+}
+
+// encryptSecrets 配置了密钥时加密之前明文保存的secret
+func (r *Registry) encryptSecrets() error {
+	if r.aead == nil {
+		return nil
+	}
+	rows, err := r.db.Query(registryPlainSecrets)
+	if err != nil {
+		return err
+	}
+	plain := map[string]string{}
+	for rows.Next() {
+		var id, secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			rows.Close()
+			return err
+		}
+		plain[id] = secret
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, secret := range plain {
+		enc, err := r.sealSecret(secret)
+		if err != nil {
+			return err
+		}
+		if _, err := r.db.Exec(registryUpdateSecret, enc, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealSecret 没有配置密钥时返回明文
+func (r *Registry) sealSecret(secret string) (string, error) {
+	if r.aead == nil || secret == "" {
+		return secret, nil
+	}
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	data := r.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// openSecret 兼容之前明文保存的secret
+func (r *Registry) openSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedSecretPrefix) {
+		return stored, nil
+	}
+	if r.aead == nil {
+		return "", ErrSecretKeyRequired
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	size := r.aead.NonceSize()
+	if len(data) < size {
+		return "", errors.New("invalid encrypted secret")
+	}
+	secret, err := r.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// AddTable 记录监听的表
+func (r *Registry) AddTable(table string) error {
+	_, err := r.db.Exec(registryAddTable, table, time.Now().UnixNano())
+	return err
+}
+
+func (r *Registry) RemoveTable(table string) error {
+	_, err := r.db.Exec(registryRemoveTable, table)
+	return err
+}
+
+// Tables 按注册顺序返回监听的表
+func (r *Registry) Tables() ([]string, error) {
+	rows, err := r.db.Query(registryTables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
+
+// SaveCallback 保存回调订阅，已存在时覆盖
+func (r *Registry) SaveCallback(cb *Callback) error {
+	filter, err := json.Marshal(cb.Filter)
+	if err != nil {
+		return err
+	}
+	secret, err := r.sealSecret(cb.Secret)
+	if err != nil {
+		return errors.Wrap(err, "encrypt secret")
+	}
+	_, err = r.db.Exec(registrySaveCallback,
+		cb.ID, cb.Table, cb.URL, int64(cb.Timeout), secret, string(filter), cb.CreatedAt.UnixNano(),
+	)
+	return err
+}
+
+func (r *Registry) DeleteCallback(id string) error {
+	_, err := r.db.Exec(registryDeleteCallback, id)
+	return err
+}
+
+// Callbacks 所有回调订阅，过滤条件已经编译
+func (r *Registry) Callbacks() ([]*Callback, error) {
+	rows, err := r.db.Query(registryCallbacks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*Callback{}
+	for rows.Next() {
+		var (
+			cb                 Callback
+			timeout, createdAt int64
+			filter, secret     string
+		)
+		if err := rows.Scan(&cb.ID, &cb.Table, &cb.URL, &timeout, &secret, &filter, &createdAt); err != nil {
+			return nil, err
+		}
+		if cb.Secret, err = r.openSecret(secret); err != nil {
+			return nil, errors.Wrapf(err, "decrypt secret of %s", cb.ID)
+		}
+		cb.Timeout = time.Duration(timeout)
+		cb.CreatedAt = time.Unix(0, createdAt)
+		if err := json.Unmarshal([]byte(filter), &cb.Filter); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal filter of %s", cb.ID)
+		}
+		if err := cb.Filter.compile(); err != nil {
+			return nil, errors.Wrapf(err, "compile filter of %s", cb.ID)
+		}
+		res = append(res, &cb)
+	}
+	return res, rows.Err()
+}
+
+// SetRedaction 设置表需要脱敏的字段，fields为空时删除该规则
+func (r *Registry) SetRedaction(schema, table string, fields []string) error {
+	if len(fields) == 0 {
+		_, err := r.db.Exec(registryDeleteRedaction, schema, table)
+		return err
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(registrySaveRedaction, schema, table, string(data))
+	return err
+}
+
+func (r *Registry) Redactions() (Redactions, error) {
+	rows, err := r.db.Query(registryRedactions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := Redactions{}
+	for rows.Next() {
+		var schema, table, fields string
+		if err := rows.Scan(&schema, &table, &fields); err != nil {
+			return nil, err
+		}
+		var f []string
+		if err := json.Unmarshal([]byte(fields), &f); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal redaction of %s.%s", schema, table)
+		}
+		if res[schema] == nil {
+			res[schema] = map[string][]string{}
+		}
+		res[schema][table] = f
+	}
+	return res, rows.Err()
+}
+
+// Reconcile 将记录的表重新注册到dialet(例如重新安装缺失的触发器)，单个表失败不影响其它表
+func (r *Registry) Reconcile(dial dialet.IRegister) error {
+	tables, err := r.Tables()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, table := range tables {
+		if err := dial.Register(table); err != nil {
+			errs = append(errs, table+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("reconcile tables: %v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package datamanager
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet"
+	"github.com/wwqdrh/datamanager/transport/sqlite"
+)
+
+func newTestRegistry(t *testing.T, path string, opts ...RegistryOption) *Registry {
+	driver, err := sqlite.NewDriver(path)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		driver.DB().Close()
+	})
+	r, err := NewRegistry(driver.DB(), opts...)
+	require.Nil(t, err)
+	return r
+}
+
+// 配置密钥后secret加密保存，之前的明文secret在打开时加密
+func TestRegistrySecretKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+	plain := newTestRegistry(t, path)
+	require.Nil(t, plain.SaveCallback(&Callback{ID: "a", Table: "notes", URL: "http://localhost/a", Secret: "s3cret"}))
+
+	stored := func(r *Registry) string {
+		var secret string
+		require.Nil(t, r.db.QueryRow(`SELECT secret FROM registry_callbacks WHERE id = 'a'`).Scan(&secret))
+		return secret
+	}
+	assert.Equal(t, "s3cret", stored(plain))
+
+	r := newTestRegistry(t, path, WithSecretKey([]byte("key")))
+	assert.True(t, strings.HasPrefix(stored(r), encryptedSecretPrefix))
+	assert.NotContains(t, stored(r), "s3cret")
+	cbs, err := r.Callbacks()
+	require.Nil(t, err)
+	require.Len(t, cbs, 1)
+	assert.Equal(t, "s3cret", cbs[0].Secret)
+
+	// 没有密钥或者密钥错误时不能读取
+	_, err = plain.Callbacks()
+	assert.ErrorIs(t, err, ErrSecretKeyRequired)
+	_, err = newTestRegistry(t, path, WithSecretKey([]byte("wrong"))).Callbacks()
+	assert.NotNil(t, err)
+}
+
+func TestRegistryTablesAndRedactions(t *testing.T) {
+	r := newTestRegistry(t, filepath.Join(t.TempDir(), "registry.db"))
+
+	require.Nil(t, r.AddTable("notes"))
+	require.Nil(t, r.AddTable("users"))
+	require.Nil(t, r.AddTable("notes"))
+	require.Nil(t, r.RemoveTable("users"))
+	tables, err := r.Tables()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"notes"}, tables)
+
+	require.Nil(t, r.SetRedaction("public", "users", []string{"password", "email"}))
+	require.Nil(t, r.SetRedaction("public", "notes", []string{"secret"}))
+	require.Nil(t, r.SetRedaction("public", "notes", nil))
+	redactions, err := r.Redactions()
+	require.Nil(t, err)
+	assert.Equal(t, Redactions{"public": {"users": {"password", "email"}}}, redactions)
+}
+
+// 订阅写入registry，重启后恢复
+func TestRegistryRestoreSubscriptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+	w := NewWatcher(nil, WithRegistry(newTestRegistry(t, path)))
+
+	a, err := w.Subscribe("orders", "http://localhost/a",
+		WithSecret("s3cret"), WithTimeout(time.Second), WithOperations("update"), WithWhere("status = 'paid'"))
+	require.Nil(t, err)
+	b, err := w.Subscribe("orders", "http://localhost/b")
+	require.Nil(t, err)
+	c, err := w.Subscribe("notes", "http://localhost/c")
+	require.Nil(t, err)
+	require.Nil(t, w.Update(b, "orders", "http://localhost/b2", WithColumns("amount")))
+	require.Nil(t, w.Unsubscribe(c))
+	before := w.Subscriptions("")
+
+	restored := NewWatcher(nil, WithRegistry(newTestRegistry(t, path)))
+	require.Nil(t, restored.Restore())
+	after := restored.Subscriptions("")
+	require.Len(t, after, 2)
+	for i := range before {
+		assert.Equal(t, before[i].ID, after[i].ID)
+		assert.Equal(t, before[i].URL, after[i].URL)
+		assert.Equal(t, before[i].Timeout, after[i].Timeout)
+		assert.Equal(t, before[i].Secret, after[i].Secret)
+		assert.Equal(t, before[i].Filter, after[i].Filter)
+		assert.True(t, before[i].CreatedAt.Equal(after[i].CreatedAt))
+	}
+	assert.Equal(t, a, after[0].ID)
+	assert.Equal(t, []string{"amount"}, after[1].Filter.Columns)
+	_, err = restored.Subscription(c)
+	assert.Equal(t, ErrSubscriptionNotFound, err)
+}
+
+// Reconcile 重新注册记录的表，重复注册不报错
+func TestRegistryReconcile(t *testing.T) {
+	r := newTestRegistry(t, filepath.Join(t.TempDir(), "registry.db"))
+	dial := newSqliteDialet(t)
+	require.Nil(t, r.AddTable("notes"))
+	require.Nil(t, r.AddTable("users"))
+
+	require.Nil(t, r.Reconcile(dial))
+	require.Nil(t, r.Reconcile(dial))
+	require.Nil(t, dial.Exec(`create table users (id integer primary key, name text)`))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	ch := dial.Watch(ctx)
+	require.Nil(t, dial.Exec(`insert into users (name) values ('a')`))
+	select {
+	case e := <-ch:
+		assert.Equal(t, "users", e.(dialet.ILogData).GetTable())
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait event timeout")
+	}
+}
@@ -0,0 +1,225 @@
+package datamanager
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wwqdrh/datamanager/dialet"
+)
+
+// 订阅过滤: 操作类型、发生变化的列以及payload上的条件，各项为空时不过滤，全部满足才投递
+
+// Filter 订阅的过滤条件
+type Filter struct {
+	Operations []string `json:"operations,omitempty"` // insert update delete truncate
+	Columns    []string `json:"columns,omitempty"`    // 任意一列发生变化时匹配
+	Where      []string `json:"where,omitempty"`      // 例如 status = 'paid'，全部满足时匹配
+
+	predicates []*Predicate
+}
+
+// WithOperations 只投递指定操作类型的事件
+func WithOperations(ops ...string) CallbackOption {
+	return func(c *Callback) {
+		c.Filter.Operations = ops
+	}
+}
+
+// WithColumns 只投递指定列发生变化的事件
+func WithColumns(columns ...string) CallbackOption {
+	return func(c *Callback) {
+		c.Filter.Columns = columns
+	}
+}
+
+// WithWhere 只投递payload满足条件的事件
+func WithWhere(exprs ...string) CallbackOption {
+	return func(c *Callback) {
+		c.Filter.Where = exprs
+	}
+}
+
+// NewFilter 编译过滤条件，用于回调以外的订阅(例如sse、websocket)
+func NewFilter(ops, columns, where []string) (*Filter, error) {
+	f := &Filter{Operations: ops, Columns: columns, Where: where}
+	if err := f.compile(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Filter) compile() error {
+	f.predicates = make([]*Predicate, 0, len(f.Where))
+	for _, expr := range f.Where {
+		p, err := ParsePredicate(expr)
+		if err != nil {
+			return err
+		}
+		f.predicates = append(f.predicates, p)
+	}
+	return nil
+}
+
+// Match 事件是否满足过滤条件
+func (f *Filter) Match(log dialet.ILogData) bool {
+	if len(f.Operations) > 0 && !containsFold(f.Operations, log.GetLabel()) {
+		return false
+	}
+	// truncate影响所有的行以及列，没有payload可以判断
+	if strings.EqualFold(log.GetLabel(), "truncate") {
+		return true
+	}
+	if len(f.Columns) > 0 && !changedAny(log, f.Columns) {
+		return false
+	}
+	for _, p := range f.predicates {
+		if !p.Match(log.GetPaylod()) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(items []string, s string) bool {
+	for _, item := range items {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedAny 与缓存失效相同，见changedColumns
+func changedAny(log dialet.ILogData, columns []string) bool {
+	for _, changed := range changedColumns(log) {
+		for _, col := range columns {
+			if changed == col {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Predicate payload上的比较条件
+type Predicate struct {
+	Field string
+	Op    string // = != > >= < <=
+	Value interface{}
+}
+
+var predicateRe = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*(=|==|!=|<>|>=|<=|>|<)\s*(.+?)\s*$`)
+
+// ParsePredicate 解析 field op value，value支持'字符串'、数字、true/false以及null
+func ParsePredicate(expr string) (*Predicate, error) {
+	m := predicateRe.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf("invalid predicate %q", expr)
+	}
+	p := &Predicate{Field: m[1], Op: m[2]}
+	switch p.Op {
+	case "==":
+		p.Op = "="
+	case "<>":
+		p.Op = "!="
+	}
+
+	raw := m[3]
+	switch {
+	case len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'':
+		p.Value = strings.ReplaceAll(raw[1:len(raw)-1], "''", "'")
+	case strings.EqualFold(raw, "null"):
+		p.Value = nil
+	case strings.EqualFold(raw, "true"), strings.EqualFold(raw, "false"):
+		p.Value = strings.EqualFold(raw, "true")
+	default:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in predicate %q", expr)
+		}
+		p.Value = f
+	}
+	if (p.Value == nil || isBool(p.Value)) && p.Op != "=" && p.Op != "!=" {
+		return nil, fmt.Errorf("operator %s not supported for %s in predicate %q", p.Op, raw, expr)
+	}
+	return p, nil
+}
+
+func isBool(v interface{}) bool {
+	_, ok := v.(bool)
+	return ok
+}
+
+func (p *Predicate) Match(payload map[string]interface{}) bool {
+	v := payload[p.Field]
+	if p.Value == nil || v == nil {
+		eq := p.Value == nil && v == nil
+		return eq == (p.Op == "=")
+	}
+
+	var cmp int
+	switch want := p.Value.(type) {
+	case float64:
+		got, ok := toFloat(v)
+		if !ok {
+			return false
+		}
+		switch {
+		case got < want:
+			cmp = -1
+		case got > want:
+			cmp = 1
+		}
+	case bool:
+		got, ok := v.(bool)
+		if !ok {
+			return false
+		}
+		return (got == want) == (p.Op == "=")
+	case string:
+		cmp = strings.Compare(fmt.Sprint(v), want)
+	}
+
+	switch p.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// toFloat 不同的dialet中数字可能为float64(json)、int64(sqlite)或者字符串(numeric)
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,283 @@
+package datamanager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+	"github.com/wwqdrh/datamanager/dialet/postgres"
+	"github.com/wwqdrh/datamanager/transport/sqlite"
+)
+
+func TestParsePredicate(t *testing.T) {
+	p, err := ParsePredicate(`status = 'it''s paid'`)
+	require.Nil(t, err)
+	assert.Equal(t, &Predicate{Field: "status", Op: "=", Value: "it's paid"}, p)
+
+	p, err = ParsePredicate(`amount>=10.5`)
+	require.Nil(t, err)
+	assert.Equal(t, &Predicate{Field: "amount", Op: ">=", Value: 10.5}, p)
+
+	p, err = ParsePredicate(`deleted_at <> null`)
+	require.Nil(t, err)
+	assert.Equal(t, &Predicate{Field: "deleted_at", Op: "!=", Value: nil}, p)
+
+	for _, expr := range []string{`status`, `status = paid`, `active > true`, `= 1`} {
+		_, err := ParsePredicate(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestPredicateMatch(t *testing.T) {
+	payload := map[string]interface{}{
+		"status": "paid",
+		"amount": float64(20),
+		"count":  int64(3),
+		"price":  "9.99",
+		"active": true,
+		"note":   nil,
+	}
+	cases := map[string]bool{
+		`status = 'paid'`:  true,
+		`status != 'paid'`: false,
+		`amount > 10`:      true,
+		`amount <= 10`:     false,
+		`count = 3`:        true,
+		`price < 10`:       true,
+		`active = true`:    true,
+		`active != true`:   false,
+		`note = null`:      true,
+		`missing = null`:   true,
+		`status != null`:   true,
+		`status > 1`:       false,
+	}
+	for expr, want := range cases {
+		p, err := ParsePredicate(expr)
+		require.Nil(t, err, expr)
+		assert.Equal(t, want, p.Match(payload), expr)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	update := &sqlite.Entry{
+		Table:   "orders",
+		Label:   "update",
+		Payload: map[string]interface{}{"id": float64(1), "status": "paid"},
+		Changes: map[string]interface{}{"status": "paid"},
+		Diff:    []diff.Column{{Name: "status", Old: "new", New: "paid"}},
+	}
+	insert := &sqlite.Entry{
+		Table:   "orders",
+		Label:   "insert",
+		Payload: map[string]interface{}{"id": float64(2), "status": "new"},
+	}
+
+	match := func(opts ...CallbackOption) []bool {
+		cb, err := newCallback("id", "orders", "http://localhost", opts...)
+		require.Nil(t, err)
+		return []bool{cb.Filter.Match(update), cb.Filter.Match(insert)}
+	}
+	assert.Equal(t, []bool{true, true}, match())
+	assert.Equal(t, []bool{true, false}, match(WithOperations("UPDATE", "delete")))
+	assert.Equal(t, []bool{true, true}, match(WithColumns("status")))
+	assert.Equal(t, []bool{false, true}, match(WithColumns("id")))
+	assert.Equal(t, []bool{true, false}, match(WithWhere("status = 'paid'")))
+	assert.Equal(t, []bool{false, false}, match(WithWhere("status = 'paid'", "id > 1")))
+
+	// 没有修改前的数据时Changes为空，视为payload中的所有列都发生了变化
+	update = &sqlite.Entry{
+		Table:   "orders",
+		Label:   "update",
+		Payload: map[string]interface{}{"id": float64(1), "status": "paid"},
+	}
+	assert.Equal(t, []bool{true, true}, match(WithColumns("status")))
+	assert.Equal(t, []bool{false, false}, match(WithColumns("total")))
+
+	_, err := newCallback("id", "orders", "http://localhost", WithWhere("status ="))
+	assert.NotNil(t, err)
+
+	// truncate没有payload，只按操作类型过滤
+	truncate := &sqlite.Entry{Table: "orders", Label: "truncate"}
+	for _, opts := range [][]CallbackOption{
+		nil, {WithColumns("status")}, {WithWhere("status = 'paid'")}, {WithOperations("truncate")},
+	} {
+		cb, err := newCallback("id", "orders", "http://localhost", opts...)
+		require.Nil(t, err)
+		assert.True(t, cb.Filter.Match(truncate))
+	}
+	cb, err := newCallback("id", "orders", "http://localhost", WithOperations("insert", "update"))
+	require.Nil(t, err)
+	assert.False(t, cb.Filter.Match(truncate))
+}
+
+func TestWatcherSubscriptions(t *testing.T) {
+	w := NewWatcher(nil)
+	a, err := w.Subscribe("notes", "http://localhost/a")
+	require.Nil(t, err)
+	b, err := w.Subscribe("notes", "http://localhost/b", WithOperations("delete"))
+	require.Nil(t, err)
+	_, err = w.Subscribe("users", "http://localhost/c")
+	require.Nil(t, err)
+	assert.NotEqual(t, a, b)
+
+	assert.Len(t, w.Subscriptions(""), 3)
+	assert.Len(t, w.Subscriptions("notes"), 2)
+
+	require.Nil(t, w.Update(b, "notes", "http://localhost/b2"))
+	cb, err := w.Subscription(b)
+	require.Nil(t, err)
+	assert.Equal(t, "http://localhost/b2", cb.URL)
+	assert.Empty(t, cb.Filter.Operations)
+
+	require.Nil(t, w.Unsubscribe(a))
+	assert.Equal(t, ErrSubscriptionNotFound, w.Unsubscribe(a))
+	assert.Equal(t, ErrSubscriptionNotFound, w.Update(a, "notes", "http://localhost/a"))
+	_, err = w.Subscribe("", "http://localhost/a")
+	assert.NotNil(t, err)
+}
+
+// 订阅的表名带schema时只匹配该schema，不带schema时只匹配默认schema
+func TestWatcherCallbacksSchema(t *testing.T) {
+	w := NewWatcher(nil)
+	tenant, err := w.Subscribe("tenant_1.orders", "http://localhost/tenant")
+	require.Nil(t, err)
+	public, err := w.Subscribe("orders", "http://localhost/public")
+	require.Nil(t, err)
+	dotted, err := w.Subscribe(`"tenant.2".orders`, "http://localhost/dotted")
+	require.Nil(t, err)
+
+	ids := func(schema string) []string {
+		var res []string
+		for _, cb := range w.callbacks(&testLog{schema: schema, table: "orders"}) {
+			res = append(res, cb.ID)
+		}
+		return res
+	}
+	assert.Equal(t, []string{tenant}, ids("tenant_1"))
+	assert.Equal(t, []string{public}, ids("public"))
+	assert.Equal(t, []string{dotted}, ids("tenant.2"))
+	assert.Empty(t, ids("tenant_3"))
+
+	// mysql的默认schema为dsn中的数据库
+	w.defaultSchema = "shop"
+	assert.Equal(t, []string{public}, ids("shop"))
+	assert.Empty(t, ids("public"))
+}
+
+// 同一个表的多个订阅按各自的过滤条件接收事件
+func TestWatcherFilteredCallbacks(t *testing.T) {
+	dial := newSqliteDialet(t)
+
+	var (
+		mu       sync.Mutex
+		received = map[string][]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Payload map[string]interface{} `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], body.Payload["note"].(string))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	watcher := NewWatcher(dial)
+	for path, opts := range map[string][]CallbackOption{
+		"/all":    nil,
+		"/update": {WithOperations("update")},
+		"/paid":   {WithWhere("note = 'paid'")},
+	} {
+		_, err := watcher.Subscribe("notes", srv.URL+path, opts...)
+		require.Nil(t, err)
+	}
+	go watcher.Notify(ctx)
+
+	// sqlite dialet在提交后查询数据，等待插入投递完成后再修改
+	delivered := func(n int) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			total := 0
+			for _, notes := range received {
+				total += len(notes)
+			}
+			return total == n
+		}
+	}
+	require.Nil(t, dial.Exec(`insert into notes (id, note) values (1, 'new')`))
+	require.Eventually(t, delivered(1), 3*time.Second, 10*time.Millisecond)
+	require.Nil(t, dial.Exec(`update notes set note = 'paid' where id = 1`))
+	require.Eventually(t, delivered(4), 3*time.Second, 10*time.Millisecond)
+
+	want := map[string][]string{
+		"/all":    {"new", "paid"},
+		"/update": {"paid"},
+		"/paid":   {"paid"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for path := range received {
+		sort.Strings(received[path])
+	}
+	assert.Equal(t, want, received)
+}
+
+// 按事务投递时每个订阅只收到一次回调，包含事务中匹配的事件
+func TestWatcherTransactions(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received = map[string][]int{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Txid   int64                    `json:"txid"`
+			Events []map[string]interface{} `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], len(body.Events))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	watcher := NewWatcher(nil, WithTransactions())
+	for path, opts := range map[string][]CallbackOption{
+		"/all":    nil,
+		"/update": {WithOperations("update")},
+		"/delete": {WithOperations("delete")},
+	} {
+		_, err := watcher.Subscribe("orders", srv.URL+path, opts...)
+		require.Nil(t, err)
+	}
+
+	ch := make(chan interface{}, 1)
+	ch <- &postgres.Transaction{Txid: 731, Events: []interface{}{
+		&sqlite.Entry{Table: "orders", Label: "insert", Payload: map[string]interface{}{"id": float64(1)}},
+		&sqlite.Entry{Table: "orders", Label: "update", Payload: map[string]interface{}{"id": float64(2)}},
+		&sqlite.Entry{Table: "users", Label: "update", Payload: map[string]interface{}{"id": float64(3)}},
+	}}
+	close(ch)
+	watcher.NotifyFrom(context.TODO(), ch)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]int{"/all": {2}, "/update": {1}}, received)
+}
@@ -20,3 +20,7 @@ func NewDriver(dbName string) (*SqliteDriver, error) {
 		db: db,
 	}, nil
 }
+
+func (d *SqliteDriver) DB() *sql.DB {
+	return d.db
+}
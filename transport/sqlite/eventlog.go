@@ -0,0 +1,500 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+// 持久化的事件日志，每条变更分配单调递增的序号
+// 消费者按名称记录已确认的位置(offset)，重启后从offset之后开始重放
+
+var (
+	eventLogCreate = `
+	CREATE TABLE IF NOT EXISTS eventlog (
+		seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+		schema  TEXT,
+		tbl     TEXT,
+		type    TEXT,
+		label   TEXT,
+		time    INTEGER,
+		payload TEXT,
+		changes TEXT,
+		diff    TEXT
+	);
+	CREATE TABLE IF NOT EXISTS eventlog_consumers (
+		name       TEXT PRIMARY KEY,
+		seq        INTEGER NOT NULL,
+		updated_at INTEGER
+	);
+	`
+
+	eventLogInsert = `
+	INSERT INTO eventlog (schema, tbl, type, label, time, payload, changes, diff) values (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	eventLogRead = `
+	SELECT seq, schema, tbl, type, label, time, payload, changes, diff FROM eventlog WHERE seq > ? ORDER BY seq LIMIT ?
+	`
+
+	// 之前版本创建的eventlog没有diff列
+	eventLogColumns = `SELECT name FROM pragma_table_info('eventlog')`
+	eventLogAddDiff = `ALTER TABLE eventlog ADD COLUMN diff TEXT`
+
+	eventLogLastSeq = `SELECT COALESCE(MAX(seq), 0) FROM eventlog`
+
+	// commit只前进，rewind可以设置为任意位置
+	consumerCommit = `
+	INSERT INTO eventlog_consumers (name, seq, updated_at) values (?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET seq = excluded.seq, updated_at = excluded.updated_at WHERE excluded.seq > eventlog_consumers.seq
+	`
+
+	consumerRewind = `
+	INSERT INTO eventlog_consumers (name, seq, updated_at) values (?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET seq = excluded.seq, updated_at = excluded.updated_at
+	`
+
+	consumerOffset = `SELECT seq FROM eventlog_consumers WHERE name = ?`
+
+	consumerList = `SELECT name, seq, updated_at FROM eventlog_consumers ORDER BY name`
+)
+
+const (
+	eventLogBatch        = 100
+	eventLogPollInterval = time.Second
+)
+
+// Entry 事件日志中的一条记录，实现ILogData
+type Entry struct {
+	Seq     int64                  `json:"seq"`
+	Schema  string                 `json:"schema"`
+	Table   string                 `json:"table"`
+	Type    string                 `json:"type"`
+	Label   string                 `json:"label"`
+	Time    time.Time              `json:"time"`
+	Payload map[string]interface{} `json:"payload"`
+	Changes map[string]interface{} `json:"changes"`
+	Diff    []diff.Column          `json:"diff"`
+
+	ack func() // ConsumeAck设置
+}
+
+func (e *Entry) GetSchema() string {
+	return e.Schema
+}
+
+func (e *Entry) GetTable() string {
+	return e.Table
+}
+
+func (e *Entry) GetType() string {
+	return e.Type
+}
+
+func (e *Entry) GetLabel() string {
+	return e.Label
+}
+
+func (e *Entry) GetTime() time.Time {
+	return e.Time
+}
+
+func (e *Entry) GetPaylod() map[string]interface{} {
+	return e.Payload
+}
+
+func (e *Entry) GetChange() map[string]interface{} {
+	return e.Changes
+}
+
+func (e *Entry) GetDiff() []diff.Column {
+	return e.Diff
+}
+
+// Ack 确认事件已经处理完成，只对ConsumeAck返回的事件有效
+func (e *Entry) Ack() {
+	if e.ack != nil {
+		e.ack()
+	}
+}
+
+// ConsumerOffset 消费者已确认的位置
+type ConsumerOffset struct {
+	Name      string    `json:"name"`
+	Offset    int64     `json:"offset"`
+	Lag       int64     `json:"lag"` // 尚未确认的事件数
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type EventLog struct {
+	driver *SqliteDriver
+
+	mu       sync.Mutex
+	appended chan struct{}    // 有新事件时关闭并重建，用于唤醒消费者
+	rewound  map[string]int64 // 消费者的rewind版本号，Consume发现变化后重新读取offset
+}
+
+func NewEventLog(dbName string) (*EventLog, error) {
+	driver, err := NewDriver(dbName)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite只允许单个写者，避免database is locked
+	driver.db.SetMaxOpenConns(1)
+	if _, err := driver.db.Exec(eventLogCreate); err != nil {
+		return nil, err
+	}
+	if err := migrateEventLog(driver.db); err != nil {
+		return nil, err
+	}
+	return &EventLog{
+		driver:   driver,
+		appended: make(chan struct{}),
+		rewound:  map[string]int64{},
+	}, nil
+}
+
+// migrateEventLog 为之前版本创建的eventlog添加diff列
+func migrateEventLog(db *sql.DB) error {
+	rows, err := db.Query(eventLogColumns)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == "diff" {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(eventLogAddDiff)
+	return err
+}
+
+func (l *EventLog) Close() error {
+	return l.driver.db.Close()
+}
+
+// Append 追加事件，返回分配的序号
+func (l *EventLog) Append(log ILogData) (int64, error) {
+	payload, err := json.Marshal(log.GetPaylod())
+	if err != nil {
+		return 0, err
+	}
+	changes, err := json.Marshal(log.GetChange())
+	if err != nil {
+		return 0, err
+	}
+	var d []diff.Column
+	if v, ok := log.(IDiff); ok {
+		d = v.GetDiff()
+	}
+	columns, err := json.Marshal(d)
+	if err != nil {
+		return 0, err
+	}
+	res, err := l.driver.db.Exec(eventLogInsert,
+		log.GetSchema(), log.GetTable(), log.GetType(), log.GetLabel(), log.GetTime().UnixNano(),
+		string(payload), string(changes), string(columns),
+	)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+	l.mu.Unlock()
+	return seq, nil
+}
+
+// Read 读取序号大于from的最多limit条事件
+func (l *EventLog) Read(from int64, limit int) ([]*Entry, error) {
+	rows, err := l.driver.db.Query(eventLogRead, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*Entry{}
+	for rows.Next() {
+		var (
+			e                Entry
+			t                int64
+			payload, changes string
+			columns          sql.NullString
+		)
+		if err := rows.Scan(&e.Seq, &e.Schema, &e.Table, &e.Type, &e.Label, &t, &payload, &changes, &columns); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, t)
+		if err := json.Unmarshal([]byte(payload), &e.Payload); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal payload of %d", e.Seq)
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal changes of %d", e.Seq)
+		}
+		if columns.Valid {
+			if err := json.Unmarshal([]byte(columns.String), &e.Diff); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal diff of %d", e.Seq)
+			}
+		}
+		res = append(res, &e)
+	}
+	return res, rows.Err()
+}
+
+// LastSeq 最新事件的序号，没有事件时为0
+func (l *EventLog) LastSeq() (int64, error) {
+	var seq int64
+	err := l.driver.db.QueryRow(eventLogLastSeq).Scan(&seq)
+	return seq, err
+}
+
+// Commit 确认consumer已处理到seq，只会前进
+func (l *EventLog) Commit(consumer string, seq int64) error {
+	_, err := l.driver.db.Exec(consumerCommit, consumer, seq, time.Now().UnixNano())
+	return err
+}
+
+// Rewind 将consumer的位置设置为seq，之后的事件会被重新消费
+func (l *EventLog) Rewind(consumer string, seq int64) error {
+	if seq < 0 {
+		return errors.New("seq must not be negative")
+	}
+	// 与Consume中的提交互斥，避免rewind之后被旧的位置覆盖
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.driver.db.Exec(consumerRewind, consumer, seq, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	l.rewound[consumer]++
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return nil
+}
+
+// Offset consumer已确认的位置，未提交过为0
+func (l *EventLog) Offset(consumer string) (int64, error) {
+	var seq int64
+	err := l.driver.db.QueryRow(consumerOffset, consumer).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Consumers 所有消费者的位置
+func (l *EventLog) Consumers() ([]*ConsumerOffset, error) {
+	last, err := l.LastSeq()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := l.driver.db.Query(consumerList)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*ConsumerOffset{}
+	for rows.Next() {
+		var (
+			c         ConsumerOffset
+			updatedAt int64
+		)
+		if err := rows.Scan(&c.Name, &c.Offset, &updatedAt); err != nil {
+			return nil, err
+		}
+		c.UpdatedAt = time.Unix(0, updatedAt)
+		if c.Lag = last - c.Offset; c.Lag < 0 {
+			c.Lag = 0
+		}
+		res = append(res, &c)
+	}
+	return res, rows.Err()
+}
+
+// Consume 从consumer的offset之后开始重放并持续获取新事件，ctx结束后channel被关闭
+// channel无缓冲，接收到第n条事件即表示第n-1条已经处理完成并提交，因此是至少一次的语义
+func (l *EventLog) Consume(ctx context.Context, consumer string) chan interface{} {
+	return l.consume(ctx, consumer, false)
+}
+
+// ConsumeAck 与Consume相同，但是事件在调用Entry.Ack之后才提交，用于异步处理事件的消费者
+// 事件可以乱序确认，offset只前进到连续确认的最后一条事件
+func (l *EventLog) ConsumeAck(ctx context.Context, consumer string) chan interface{} {
+	return l.consume(ctx, consumer, true)
+}
+
+func (l *EventLog) consume(ctx context.Context, consumer string, explicit bool) chan interface{} {
+	res := make(chan interface{})
+
+	go func() {
+		defer close(res)
+
+		var (
+			cursor  int64 = -1
+			version int64 = -1
+			pending int64 // 已发送未提交
+			acks    *ackTracker
+		)
+		for {
+			l.mu.Lock()
+			wakeup := l.appended
+			if v := l.rewound[consumer]; v != version {
+				version, cursor, pending = v, -1, 0
+				if explicit {
+					acks = &ackTracker{l: l, consumer: consumer, version: version, done: map[int64]bool{}}
+				}
+			}
+			l.mu.Unlock()
+
+			if cursor < 0 {
+				offset, err := l.Offset(consumer)
+				if err != nil {
+					return
+				}
+				cursor = offset
+			}
+
+			entries, err := l.Read(cursor, eventLogBatch)
+			if err == nil && len(entries) > 0 {
+				for _, e := range entries {
+					if acks != nil {
+						acks.add(e)
+					}
+					select {
+					case res <- e:
+					case <-ctx.Done():
+						return
+					}
+					if acks != nil {
+						if l.isRewound(consumer, version) {
+							break
+						}
+					} else if !l.ack(consumer, version, pending) {
+						break
+					}
+					pending, cursor = e.Seq, e.Seq
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-wakeup:
+			case <-time.After(eventLogPollInterval):
+			}
+		}
+	}()
+	return res
+}
+
+// ackTracker 记录ConsumeAck已发送的事件，按顺序提交连续确认的事件
+type ackTracker struct {
+	l        *EventLog
+	consumer string
+	version  int64
+
+	mu   sync.Mutex
+	sent []int64 // 已发送未提交的序号
+	done map[int64]bool
+}
+
+func (t *ackTracker) add(e *Entry) {
+	t.mu.Lock()
+	t.sent = append(t.sent, e.Seq)
+	t.mu.Unlock()
+	seq := e.Seq
+	e.ack = func() { t.ack(seq) }
+}
+
+func (t *ackTracker) ack(seq int64) {
+	t.mu.Lock()
+	t.done[seq] = true
+	var commit int64
+	for len(t.sent) > 0 && t.done[t.sent[0]] {
+		commit = t.sent[0]
+		delete(t.done, commit)
+		t.sent = t.sent[1:]
+	}
+	t.mu.Unlock()
+	// rewind之后的确认不提交，Commit只前进，并发的提交不会回退
+	if commit > 0 {
+		t.l.ack(t.consumer, t.version, commit)
+	}
+}
+
+// Tail 从序号大于from的事件开始持续读取，不记录offset，ctx结束后channel被关闭
+// 用于推送给临时的订阅者(例如浏览器)，断线后由订阅者携带最后的序号重新订阅
+func (l *EventLog) Tail(ctx context.Context, from int64) chan *Entry {
+	res := make(chan *Entry)
+
+	go func() {
+		defer close(res)
+
+		cursor := from
+		for {
+			l.mu.Lock()
+			wakeup := l.appended
+			l.mu.Unlock()
+
+			entries, err := l.Read(cursor, eventLogBatch)
+			if err == nil && len(entries) > 0 {
+				for _, e := range entries {
+					select {
+					case res <- e:
+					case <-ctx.Done():
+						return
+					}
+					cursor = e.Seq
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-wakeup:
+			case <-time.After(eventLogPollInterval):
+			}
+		}
+	}()
+	return res
+}
+
+// isRewound consumer在version之后是否被rewind
+func (l *EventLog) isRewound(consumer string, version int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rewound[consumer] != version
+}
+
+// ack 提交seq，consumer在此期间被rewind时不提交并返回false
+func (l *EventLog) ack(consumer string, version, seq int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rewound[consumer] != version {
+		return false
+	}
+	if seq > 0 {
+		_ = l.Commit(consumer, seq)
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet/diff"
+)
+
+type testLog struct {
+	table   string
+	payload map[string]interface{}
+	diff    []diff.Column
+}
+
+func (t *testLog) GetSchema() string                 { return "public" }
+func (t *testLog) GetTable() string                  { return t.table }
+func (t *testLog) GetType() string                   { return "dml" }
+func (t *testLog) GetLabel() string                  { return "insert" }
+func (t *testLog) GetTime() time.Time                { return time.Unix(1660000000, 0) }
+func (t *testLog) GetPaylod() map[string]interface{} { return t.payload }
+func (t *testLog) GetChange() map[string]interface{} { return nil }
+func (t *testLog) GetDiff() []diff.Column            { return t.diff }
+
+func appendN(t *testing.T, l *EventLog, n int) {
+	for i := 0; i < n; i++ {
+		_, err := l.Append(&testLog{table: "notes", payload: map[string]interface{}{"id": float64(i + 1)}})
+		require.Nil(t, err)
+	}
+}
+
+func receiveEntry(t *testing.T, ch chan interface{}) *Entry {
+	select {
+	case item := <-ch:
+		return item.(*Entry)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait entry timeout")
+	}
+	return nil
+}
+
+func TestEventLogAppendRead(t *testing.T) {
+	l, err := NewEventLog(filepath.Join(t.TempDir(), "eventlog.db"))
+	require.Nil(t, err)
+	defer l.Close()
+
+	appendN(t, l, 3)
+	last, err := l.LastSeq()
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), last)
+
+	entries, err := l.Read(1, 10)
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, int64(2), entries[0].Seq)
+	assert.Equal(t, "notes", entries[0].GetTable())
+	assert.Equal(t, float64(2), entries[0].GetPaylod()["id"])
+	assert.Equal(t, time.Unix(1660000000, 0), entries[0].GetTime())
+	assert.Nil(t, entries[0].GetDiff())
+
+	_, err = l.Append(&testLog{table: "notes", diff: []diff.Column{{Name: "note", Old: "a", New: nil}}})
+	require.Nil(t, err)
+	entries, err = l.Read(3, 10)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, []diff.Column{{Name: "note", Old: "a"}}, entries[0].GetDiff())
+}
+
+// 之前版本创建的eventlog没有diff列
+func TestEventLogMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eventlog.db")
+	d, err := NewDriver(path)
+	require.Nil(t, err)
+	_, err = d.db.Exec(`CREATE TABLE eventlog (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT, schema TEXT, tbl TEXT, type TEXT, label TEXT, time INTEGER, payload TEXT, changes TEXT
+	)`)
+	require.Nil(t, err)
+	_, err = d.db.Exec(`INSERT INTO eventlog (schema, tbl, type, label, time, payload, changes) values ('public', 'notes', 'dml', 'insert', 0, '{}', 'null')`)
+	require.Nil(t, err)
+	require.Nil(t, d.db.Close())
+
+	l, err := NewEventLog(path)
+	require.Nil(t, err)
+	defer l.Close()
+	appendN(t, l, 1)
+	entries, err := l.Read(0, 10)
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+	assert.Nil(t, entries[0].GetDiff())
+}
+
+func TestEventLogOffsets(t *testing.T) {
+	l, err := NewEventLog(filepath.Join(t.TempDir(), "eventlog.db"))
+	require.Nil(t, err)
+	defer l.Close()
+	appendN(t, l, 5)
+
+	offset, err := l.Offset("watcher")
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), offset)
+
+	require.Nil(t, l.Commit("watcher", 3))
+	require.Nil(t, l.Commit("watcher", 2)) // commit只前进
+	offset, err = l.Offset("watcher")
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), offset)
+
+	require.Nil(t, l.Rewind("watcher", 1))
+	offset, err = l.Offset("watcher")
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), offset)
+	assert.NotNil(t, l.Rewind("watcher", -1))
+
+	consumers, err := l.Consumers()
+	require.Nil(t, err)
+	require.Len(t, consumers, 1)
+	assert.Equal(t, "watcher", consumers[0].Name)
+	assert.Equal(t, int64(4), consumers[0].Lag)
+}
+
+// 重启后从已确认的位置重放
+func TestEventLogConsumeResume(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "eventlog.db")
+	l, err := NewEventLog(dbName)
+	require.Nil(t, err)
+	appendN(t, l, 3)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	ch := l.Consume(ctx, "watcher")
+	assert.Equal(t, int64(1), receiveEntry(t, ch).Seq)
+	assert.Equal(t, int64(2), receiveEntry(t, ch).Seq) // 确认1
+	require.Eventually(t, func() bool {
+		offset, err := l.Offset("watcher")
+		return err == nil && offset == 1
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	require.Nil(t, l.Close())
+
+	l, err = NewEventLog(dbName)
+	require.Nil(t, err)
+	defer l.Close()
+	offset, err := l.Offset("watcher")
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), offset)
+
+	ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+	ch = l.Consume(ctx, "watcher")
+	assert.Equal(t, int64(2), receiveEntry(t, ch).Seq) // 2未确认，重新投递
+	assert.Equal(t, int64(3), receiveEntry(t, ch).Seq)
+
+	// 持续获取新事件
+	appendN(t, l, 1)
+	assert.Equal(t, int64(4), receiveEntry(t, ch).Seq)
+
+	// rewind之后从指定位置重新消费
+	require.Nil(t, l.Rewind("watcher", 0))
+	assert.Equal(t, int64(1), receiveEntry(t, ch).Seq)
+}
+
+// ConsumeAck 只提交连续确认的事件，未确认的事件在重启后重新投递
+func TestEventLogConsumeAck(t *testing.T) {
+	l, err := NewEventLog(filepath.Join(t.TempDir(), "eventlog.db"))
+	require.Nil(t, err)
+	defer l.Close()
+	appendN(t, l, 3)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	ch := l.ConsumeAck(ctx, "watcher")
+	e1, e2, e3 := receiveEntry(t, ch), receiveEntry(t, ch), receiveEntry(t, ch)
+	offset := func() int64 {
+		offset, err := l.Offset("watcher")
+		require.Nil(t, err)
+		return offset
+	}
+	// 接收之后没有确认
+	assert.Equal(t, int64(0), offset())
+
+	e2.Ack()
+	assert.Equal(t, int64(0), offset())
+	e1.Ack()
+	assert.Equal(t, int64(2), offset())
+	cancel()
+
+	// 3未确认，重新投递
+	ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+	ch = l.ConsumeAck(ctx, "watcher")
+	assert.Equal(t, int64(3), receiveEntry(t, ch).Seq)
+
+	// rewind之前发送的事件确认之后不提交
+	require.Nil(t, l.Rewind("watcher", 0))
+	e3.Ack()
+	assert.Equal(t, int64(0), offset())
+}
+
+// Tail 不记录offset，从指定序号之后读取并等待新事件
+func TestEventLogTail(t *testing.T) {
+	l, err := NewEventLog(filepath.Join(t.TempDir(), "eventlog.db"))
+	require.Nil(t, err)
+	defer l.Close()
+	appendN(t, l, 2)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	ch := l.Tail(ctx, 1)
+	next := func() *Entry {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait entry timeout")
+		}
+		return nil
+	}
+	assert.Equal(t, int64(2), next().Seq)
+	appendN(t, l, 1)
+	assert.Equal(t, int64(3), next().Seq)
+
+	consumers, err := l.Consumers()
+	require.Nil(t, err)
+	assert.Empty(t, consumers)
+
+	cancel()
+	for range ch {
+	}
+}
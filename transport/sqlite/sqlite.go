@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"regexp"
 	"time"
+
+	"github.com/wwqdrh/datamanager/dialet/diff"
 )
 
 type ILogData interface {
@@ -18,6 +20,11 @@ type ILogData interface {
 	GetChange() map[string]interface{} // 获取具体的负载对象
 }
 
+// IDiff 能够提供修改前数据的ILogData
+type IDiff interface {
+	GetDiff() []diff.Column // update中每一列修改前后的值
+}
+
 var (
 	escape = regexp.MustCompile(`"`)
 	// create table `schema.table``
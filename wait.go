@@ -0,0 +1,153 @@
+package datamanager
+
+import (
+	"context"
+	"sync"
+)
+
+// 等待缓存更新
+// 版本号为Repo内递增的序号(clock)，每次计算开始以及删除缓存时取一个新的序号，key的版本号为已经完成的计算中最大的序号，
+// 调用方可以先读取版本号再修改数据库，然后等待版本号增加(read-your-writes)，读取版本号之前开始的计算不会满足等待
+// 版本号只在当前实例中有效，其它实例的失效通知同样会增加版本号
+// 只保留缓存中的key、有调用方等待的key以及读取过版本号的key(直到下一次更新或者等待结束)的记录，
+// key被删除(invalidate、MemoryBackend淘汰或者过期)后清理，之后创建的记录从已清理的版本号中最大的值开始，不会小于该key之前的版本号
+
+// keyVersion changed在版本号增加时关闭并替换
+type keyVersion struct {
+	version uint64
+	changed chan struct{}
+	waiters int  // 正在等待的调用方
+	pinned  bool // 调用方读取了版本号，下一次更新或者等待结束前保留，避免其它key的清理提高该key的版本号
+	cached  bool // key在backend中
+}
+
+// keyVersion 调用方持有r.lock
+func (r *Repo) keyVersion(key string) *keyVersion {
+	kv, ok := r.versions[key]
+	if !ok {
+		kv = &keyVersion{version: r.floor, changed: make(chan struct{})}
+		r.versions[key] = kv
+	}
+	return kv
+}
+
+// release key不在缓存中并且没有调用方等待时清理，调用方持有r.lock
+func (r *Repo) release(key string, kv *keyVersion) {
+	if kv.cached || kv.waiters > 0 || kv.pinned || r.versions[key] != kv {
+		return
+	}
+	if kv.version > r.floor {
+		r.floor = kv.version
+	}
+	delete(r.versions, key)
+}
+
+// Version key当前的版本号，key为缓存中的key(模板key需要填入字段，例如 note:1)
+// 返回当前的序号，等待比它大的版本号时只有之后开始的计算以及删除能够满足
+func (r *Repo) Version(key string) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keyVersion(key).pinned = true
+	return r.clock
+}
+
+// stamp 计算开始或者删除缓存时的序号
+func (r *Repo) stamp() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.clock++
+	return r.clock
+}
+
+// wake 将版本号提高到stamp并唤醒等待的调用方，cached为key当前是否在backend中
+// 开始得更早的计算较晚完成时不会降低版本号
+func (r *Repo) wake(key string, cached bool, stamp uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kv := r.keyVersion(key)
+	if stamp > kv.version {
+		kv.version = stamp
+		close(kv.changed)
+		kv.changed = make(chan struct{})
+	}
+	kv.cached = cached
+	kv.pinned = false
+	r.release(key, kv)
+	if c, ok := r.WaitMap[key]; ok {
+		c.L.Lock()
+		c.Broadcast()
+		c.L.Unlock()
+	}
+}
+
+// forget backend淘汰了key，没有调用方等待时清理版本号
+func (r *Repo) forget(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if kv, ok := r.versions[key]; ok {
+		kv.cached = false
+		r.release(key, kv)
+	}
+}
+
+// WaitForVersion 等待key的版本号不小于minVersion，返回当前的版本号，ctx结束时返回ctx.Err()
+func (r *Repo) WaitForVersion(ctx context.Context, key string, minVersion uint64) (uint64, error) {
+	r.lock.Lock()
+	kv := r.keyVersion(key)
+	kv.waiters++
+	r.lock.Unlock()
+	return r.waitVersion(ctx, key, kv, minVersion)
+}
+
+// waitVersion 调用方已经增加了kv.waiters
+func (r *Repo) waitVersion(ctx context.Context, key string, kv *keyVersion, minVersion uint64) (uint64, error) {
+	defer func() {
+		r.lock.Lock()
+		kv.waiters--
+		kv.pinned = false
+		r.release(key, kv)
+		r.lock.Unlock()
+	}()
+	for {
+		r.lock.Lock()
+		version, changed := kv.version, kv.changed
+		r.lock.Unlock()
+		if version >= minVersion {
+			return version, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return version, ctx.Err()
+		}
+	}
+}
+
+// WaitContext 等待key的下一次更新，调用之前的更新不会被等待到，需要时使用Version以及WaitForVersion
+func (r *Repo) WaitContext(ctx context.Context, key string) error {
+	r.lock.Lock()
+	kv := r.keyVersion(key)
+	kv.waiters++
+	minVersion := r.clock + 1
+	r.lock.Unlock()
+	_, err := r.waitVersion(ctx, key, kv, minVersion)
+	return err
+}
+
+// Wait 等待key的下一次更新
+//
+// Deprecated: 无法取消，使用WaitContext或者WaitForVersion
+func (r *Repo) Wait(key string) {
+	_ = r.WaitContext(context.Background(), key)
+}
+
+// GenInstance 为key创建WaitMap中的条件变量
+//
+// Deprecated: WaitMap中的key不会清理，使用WaitContext或者WaitForVersion
+func (r *Repo) GenInstance(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.WaitMap[key]; !ok {
+		r.WaitMap[key] = sync.NewCond(&sync.Mutex{})
+	}
+}
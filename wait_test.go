@@ -0,0 +1,234 @@
+package datamanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/datamanager/dialet"
+)
+
+func TestWaitContextTimeout(t *testing.T) {
+	r := NewRepo(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, r.WaitContext(ctx, "cacheA"), context.DeadlineExceeded)
+
+	v, err := r.WaitForVersion(ctx, "cacheA", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, uint64(0), v)
+}
+
+// 修改数据库之前读取版本号，事件在等待之前已经处理也不会错过
+func TestWaitForVersion(t *testing.T) {
+	var value int32 = 1
+	ch := make(chan dialet.ILogData, 1)
+	r := NewRepo(ch)
+	r.Register(&Policy{
+		Key:   "cacheA",
+		Table: "table1",
+		Field: "*",
+		Call: func() interface{} {
+			return atomic.LoadInt32(&value)
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go r.Notify(ctx)
+
+	assert.Equal(t, int32(1), r.GetValue("cacheA"))
+	v := r.Version("cacheA")
+	assert.Equal(t, uint64(1), v)
+
+	atomic.StoreInt32(&value, 2)
+	ch <- &testLog{table: "table1"}
+	got, err := r.WaitForVersion(ctx, "cacheA", v+1)
+	require.NoError(t, err)
+	assert.Equal(t, v+1, got)
+	assert.Equal(t, int32(2), r.GetValue("cacheA"))
+
+	// 已经达到的版本号直接返回
+	got, err = r.WaitForVersion(ctx, "cacheA", v)
+	require.NoError(t, err)
+	assert.Equal(t, v+1, got)
+
+	// 删除缓存同样增加版本号
+	r.Register(&Policy{Key: "cacheB", Table: "table1", Field: "*", Mode: ModeInvalidate, Call: func() interface{} { return 0 }})
+	v = r.Version("cacheB")
+	r.Trigger(&testLog{table: "table1"})
+	_, err = r.WaitForVersion(ctx, "cacheB", v+1)
+	require.NoError(t, err)
+}
+
+func TestWaitConcurrent(t *testing.T) {
+	var value int32
+	r := NewRepo(nil)
+	r.Register(&Policy{
+		Key:   "cacheA",
+		Table: "table1",
+		Field: "*",
+		Call: func() interface{} {
+			return atomic.AddInt32(&value, 1)
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	short, cancelShort := context.WithCancel(context.Background())
+	cancelShort()
+	assert.ErrorIs(t, r.WaitContext(short, "cacheA"), context.Canceled)
+
+	done := make(chan struct{})
+	var triggers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		triggers.Add(1)
+		go func() {
+			defer triggers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					r.Trigger(&testLog{table: "table1"})
+				}
+			}
+		}()
+	}
+
+	var waiters sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		waiters.Add(1)
+		go func(i int) {
+			defer waiters.Done()
+			if i%2 == 0 {
+				assert.NoError(t, r.WaitContext(ctx, "cacheA"))
+				return
+			}
+			v := r.Version("cacheA")
+			got, err := r.WaitForVersion(ctx, "cacheA", v+3)
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, got, v+3)
+			assert.NotNil(t, r.GetValue("cacheA"))
+		}(i)
+	}
+	waiters.Wait()
+	close(done)
+	triggers.Wait()
+}
+
+// 版本号只保留缓存中的key以及正在等待的key，清理后的版本号不会变小
+func TestWaitVersionsBounded(t *testing.T) {
+	r := NewRepo(nil, WithBackend(NewMemoryBackend(2)))
+	r.Register(&Policy{
+		Key:   "note:{id}",
+		Table: "note",
+		Field: "*",
+		Load: func(params map[string]string) interface{} {
+			return params["id"]
+		},
+	})
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, fmt.Sprint(i), r.GetValue("note:{id}", i))
+	}
+	r.lock.Lock()
+	assert.Len(t, r.versions, 2)
+	r.lock.Unlock()
+
+	// note:0已经被淘汰，读取版本号后保留记录直到下一次更新
+	v := r.Version("note:99")
+	r.invalidate("note:99")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := r.WaitForVersion(ctx, "note:99", v+1)
+	require.NoError(t, err)
+	assert.Greater(t, got, v)
+
+	v = r.Version("note:0")
+	done := make(chan uint64)
+	go func() {
+		got, err := r.WaitForVersion(ctx, "note:0", v+1)
+		assert.NoError(t, err)
+		done <- got
+	}()
+	require.Eventually(t, func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		kv, ok := r.versions["note:0"]
+		return ok && kv.waiters == 1
+	}, time.Second, time.Millisecond)
+	r.invalidate("note:0")
+	assert.Greater(t, <-done, v)
+
+	// 只剩缓存中的note:98
+	r.lock.Lock()
+	assert.Len(t, r.versions, 1)
+	r.lock.Unlock()
+}
+
+// 读取版本号之后其它key的清理以及之前开始的计算不会满足等待
+func TestWaitVersionPinned(t *testing.T) {
+	var value int32 = 1
+	started, release := make(chan struct{}), make(chan struct{})
+	r := NewRepo(nil)
+	r.Register(&Policy{Key: "cacheA", Table: "table1", Field: "*", Mode: ModeInvalidate, Call: func() interface{} { return 0 }})
+	r.Register(&Policy{
+		Key:   "cacheB",
+		Table: "table2",
+		Field: "*",
+		Call: func() interface{} {
+			v := atomic.LoadInt32(&value)
+			if v == 1 {
+				close(started)
+				<-release
+			}
+			return v
+		},
+	})
+
+	// 计算在读取版本号之前开始，读到修改之前的数据
+	stale := make(chan interface{})
+	go func() { stale <- r.GetValue("cacheB") }()
+	<-started
+	v := r.Version("cacheB")
+	atomic.StoreInt32(&value, 2)
+
+	// 其它key的删除提高floor
+	for i := 0; i < 3; i++ {
+		r.Trigger(&testLog{table: "table1"})
+	}
+	close(release)
+	assert.Equal(t, int32(1), <-stale)
+
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := r.WaitForVersion(short, "cacheB", v+1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v = r.Version("cacheB")
+	go r.Trigger(&testLog{table: "table2"})
+	_, err = r.WaitForVersion(ctx, "cacheB", v+1)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), r.GetValue("cacheB"))
+}
+
+// 兼容之前通过GenInstance以及WaitMap等待的代码
+func TestWaitMap(t *testing.T) {
+	r := NewRepo(nil)
+	r.Register(&Policy{Key: "cacheA", Table: "table1", Field: "*", Call: func() interface{} { return 1 }})
+	r.GenInstance("cacheA")
+	c := r.WaitMap["cacheA"]
+	require.NotNil(t, c)
+
+	c.L.Lock()
+	go r.Trigger(&testLog{table: "table1"})
+	c.Wait()
+	c.L.Unlock()
+	assert.Equal(t, 1, r.GetValue("cacheA"))
+}
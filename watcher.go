@@ -1,13 +1,19 @@
 package datamanager
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/wwqdrh/datamanager/dialet"
+	"github.com/wwqdrh/datamanager/dialet/tablename"
+	"github.com/wwqdrh/logger"
 )
 
 // 提供基于http的远程调用，用户能够进行注册
@@ -25,63 +31,275 @@ type Event struct {
 
 type Watcher struct {
 	dial dialet.IDialet
-	cb   map[string]string
+
+	mu sync.RWMutex
+	cb map[string]*Callback
+
+	client      *http.Client
+	timeout     time.Duration
+	maxRetries  int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	deadLetters DeadLetterStore
+	registry    *Registry // 非空时订阅的修改会持久化
+
+	transactions bool // 按事务投递，见WithTransactions
+
+	queueSize   int // 每个订阅的投递队列长度，见dispatch.go
+	dmu         sync.Mutex
+	dispatchers map[*dispatcher]struct{}
+
+	defaultSchema string // 订阅的表名不带schema时匹配的schema，见dialet.IDefaultSchema
 }
 
-func NewWatcher(dial dialet.IDialet) *Watcher {
-	return &Watcher{
-		dial: dial,
-		cb:   map[string]string{},
+func NewWatcher(dial dialet.IDialet, opts ...WatcherOption) *Watcher {
+	w := &Watcher{
+		dial:        dial,
+		cb:          map[string]*Callback{},
+		client:      &http.Client{},
+		timeout:     defaultTimeout,
+		maxRetries:  defaultMaxRetries,
+		backoff:     defaultBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		deadLetters: NewMemoryDeadLetters(),
+		queueSize:   defaultQueueSize,
+		dispatchers: map[*dispatcher]struct{}{},
+	}
+	if d, ok := dial.(dialet.IDefaultSchema); ok {
+		w.defaultSchema = d.DefaultSchema()
 	}
+	for _, o := range opts {
+		o(w)
+	}
+	return w
 }
 
-// now just a table event
-// a get url callback
+// Register 为table添加一个回调订阅，失败时只记录日志
+//
+// Deprecated: 使用Subscribe，返回订阅ID以及错误
 func (w *Watcher) Register(table string, url string) {
-	w.cb[table] = url
+	if _, err := w.Subscribe(table, url); err != nil {
+		logger.DefaultLogger.Error(err.Error())
+	}
+}
+
+// Subscribe 为table添加一个回调订阅，返回订阅ID，同一个表可以有多个订阅
+func (w *Watcher) Subscribe(table string, url string, opts ...CallbackOption) (string, error) {
+	cb, err := newCallback(uuid.NewString(), table, url, opts...)
+	if err != nil {
+		return "", err
+	}
+	if err := w.persist(cb); err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cb[cb.ID] = cb
+	return cb.ID, nil
+}
+
+// Update 使用新的配置替换订阅
+func (w *Watcher) Update(id, table, url string, opts ...CallbackOption) error {
+	cb, err := newCallback(id, table, url, opts...)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old, ok := w.cb[id]
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	cb.CreatedAt = old.CreatedAt
+	if err := w.persist(cb); err != nil {
+		return err
+	}
+	w.cb[id] = cb
+	return nil
+}
+
+// Unsubscribe 删除订阅
+func (w *Watcher) Unsubscribe(id string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.cb[id]; !ok {
+		return ErrSubscriptionNotFound
+	}
+	if w.registry != nil {
+		if err := w.registry.DeleteCallback(id); err != nil {
+			return errors.Wrap(err, "delete subscription")
+		}
+	}
+	delete(w.cb, id)
+	w.removeQueues(id)
+	return nil
+}
+
+func (w *Watcher) persist(cb *Callback) error {
+	if w.registry == nil {
+		return nil
+	}
+	return errors.Wrap(w.registry.SaveCallback(cb), "save subscription")
+}
+
+// Restore 从registry加载之前持久化的订阅
+func (w *Watcher) Restore() error {
+	if w.registry == nil {
+		return nil
+	}
+	cbs, err := w.registry.Callbacks()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, cb := range cbs {
+		w.cb[cb.ID] = cb
+	}
+	return nil
+}
+
+// Subscription 获取指定订阅
+func (w *Watcher) Subscription(id string) (*Callback, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	cb, ok := w.cb[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	return cb, nil
+}
+
+// Subscriptions table为空时返回所有订阅
+func (w *Watcher) Subscriptions(table string) []*Callback {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	res := []*Callback{}
+	for _, cb := range w.cb {
+		if table == "" || cb.Table == table {
+			res = append(res, cb)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res
+}
+
+// callbacks 事件匹配的所有订阅，订阅的表名为[schema.]table，不带schema时只匹配默认schema中的表
+func (w *Watcher) callbacks(log dialet.ILogData) []*Callback {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	res := []*Callback{}
+	for _, cb := range w.cb {
+		if tablename.Match(cb.Table, w.defaultSchema, log.GetSchema(), log.GetTable()) && cb.Filter.Match(log) {
+			res = append(res, cb)
+		}
+	}
+	return res
 }
 
 func (w *Watcher) Notify(ctx context.Context) {
-	eventChan := w.dial.Watch(ctx)
+	if td, ok := w.dial.(dialet.ITransactionWatcher); ok && w.transactions {
+		w.NotifyFrom(ctx, td.WatchTransactions(ctx))
+		return
+	}
+	w.NotifyFrom(ctx, w.dial.Watch(ctx))
+}
+
+// IAck 由NotifyFrom的事件实现，事件的所有投递成功或者写入死信后调用Ack，例如确认事件日志的offset
+type IAck interface {
+	Ack()
+}
+
+// NotifyFrom 从指定的事件channel获取变更，例如持久化事件日志的消费者
+// 每个订阅的回调按事件顺序投递，不同订阅之间互不阻塞，失败的投递在重试耗尽后写入死信
+// channel关闭或者ctx结束后等待已经入队的投递完成再返回
+// channel中的事件为ILogData或者ITransaction，实现IAck的事件在投递完成后确认
+func (w *Watcher) NotifyFrom(ctx context.Context, eventChan chan interface{}) {
+	d := w.newDispatcher(ctx)
+	defer d.close()
 	for {
 		select {
-		case e := <-eventChan:
-			if val, ok := e.(dialet.ILogData); !ok {
+		case e, ok := <-eventChan:
+			if !ok {
+				return
+			}
+			ack := newEventAck(e)
+			switch val := e.(type) {
+			case dialet.ILogData:
+				w.notifyLog(d, val, ack)
+			case dialet.ITransaction:
+				w.notifyTransaction(d, val, ack)
+			default:
 				fmt.Println("数据错误")
-			} else if url, ok := w.cb[val.GetTable()]; ok {
-				err := w.HTTPPost(url, map[string]interface{}{
-					"table":   val.GetTable(),
-					"payload": val.GetPaylod(),
-				})
-				if err != nil {
-					fmt.Println(err)
-				}
-			} else {
-				fmt.Println("未注册")
 			}
+			ack.done(true)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// send data to url, the method is post
-func (w *Watcher) HTTPPost(url string, data interface{}) error {
-	body, err := json.Marshal(data)
+func (w *Watcher) notifyLog(d *dispatcher, val dialet.ILogData, ack *eventAck) {
+	cbs := w.callbacks(val)
+	if len(cbs) == 0 {
+		return
+	}
+	body, err := json.Marshal(eventBody(val))
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return
 	}
+	for _, cb := range cbs {
+		d.enqueue(cb, val.GetTable(), body, ack)
+	}
+}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-	req.Close = true
-	if err != nil {
-		return err
+// notifyTransaction 每个订阅只收到事务中匹配的事件，没有匹配的事件时不投递
+func (w *Watcher) notifyTransaction(d *dispatcher, tx dialet.ITransaction, ack *eventAck) {
+	matched := map[*Callback][]interface{}{}
+	for _, e := range tx.GetEvents() {
+		val, ok := e.(dialet.ILogData)
+		if !ok {
+			continue
+		}
+		for _, cb := range w.callbacks(val) {
+			matched[cb] = append(matched[cb], eventBody(val))
+		}
+	}
+
+	for cb, events := range matched {
+		body, err := json.Marshal(map[string]interface{}{
+			"txid":   tx.GetTxid(),
+			"time":   tx.GetTime(),
+			"events": events,
+		})
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		d.enqueue(cb, cb.Table, body, ack)
+	}
+}
+
+func eventBody(val dialet.ILogData) map[string]interface{} {
+	return map[string]interface{}{
+		"table":   val.GetTable(),
+		"op":      val.GetLabel(),
+		"payload": val.GetPaylod(),
 	}
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// send data to url, the method is post
+// 非2xx的响应视为失败
+func (w *Watcher) HTTPPost(url string, data interface{}) error {
+	body, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
-	return nil
+	return w.post(context.Background(), &Callback{URL: url}, uuid.NewString(), body)
 }
@@ -2,23 +2,31 @@ package datamanager
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/wwqdrh/datamanager/dialet/postgres"
+	"github.com/wwqdrh/datamanager/dialet/sqlite"
 )
 
 var (
 	testDropTable   = `drop table if exists notes`
 	testDatabaseDDL = `create table notes (id serial, created_at timestamp, note text)`
 	insertTemplate  = "insert into notes values (default, default, 'here is a sample note')"
+
+	testSqliteDDL    = `create table notes (id integer primary key, created_at timestamp, note text)`
+	testSqliteInsert = `insert into notes (note) values ('here is a sample note')`
 )
 
 type WatcherSuite struct {
@@ -101,3 +109,46 @@ func (s *WatcherSuite) TestWatcherCallback() {
 	cancel()
 	time.Sleep(1 * time.Second)
 }
+
+// 基于sqlite dialet的端到端测试，不依赖postgres
+func newSqliteDialet(t *testing.T) *sqlite.SqliteDialet {
+	dial, err := sqlite.NewSqliteDialet(filepath.Join(t.TempDir(), "notes.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, dial.Close())
+	})
+	require.Nil(t, dial.Exec(testSqliteDDL))
+	require.Nil(t, dial.Register("notes"))
+	return dial
+}
+
+func TestWatcherCallbackWithSqlite(t *testing.T) {
+	dial := newSqliteDialet(t)
+
+	received := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- body
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	watcher := NewWatcher(dial)
+	_, err := watcher.Subscribe("notes", srv.URL)
+	require.Nil(t, err)
+	go watcher.Notify(ctx)
+
+	require.Nil(t, dial.Exec(testSqliteInsert))
+	select {
+	case body := <-received:
+		assert.Equal(t, "notes", body["table"])
+		assert.Equal(t, "here is a sample note", body["payload"].(map[string]interface{})["note"])
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait callback timeout")
+	}
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 回调签名: 发送方对 timestamp.eventID.body 计算HMAC-SHA256，接收方校验签名、时间窗口并拒绝重放的事件
+
+const (
+	HeaderEventID   = "X-Dbnotify-Event-Id"
+	HeaderTimestamp = "X-Dbnotify-Timestamp"
+	HeaderSignature = "X-Dbnotify-Signature"
+
+	signaturePrefix  = "v1="
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrMissingHeader    = errors.New("webhook: missing signature header")
+	ErrInvalidTimestamp = errors.New("webhook: invalid timestamp")
+	ErrExpired          = errors.New("webhook: timestamp outside tolerance")
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrReplayed         = errors.New("webhook: event already received")
+)
+
+// Sign 返回签名头的值
+func Sign(secret string, timestamp int64, eventID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s.", timestamp, eventID)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetHeaders 为请求设置事件ID、时间戳以及签名(secret为空时不签名)
+func SetHeaders(h http.Header, secret string, now time.Time, eventID string, body []byte) {
+	h.Set(HeaderEventID, eventID)
+	h.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	if secret != "" {
+		h.Set(HeaderSignature, Sign(secret, now.Unix(), eventID, body))
+	}
+}
+
+// Verify 校验签名以及时间窗口，不检查重放
+func Verify(secret string, h http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	eventID, ts, sig := h.Get(HeaderEventID), h.Get(HeaderTimestamp), h.Get(HeaderSignature)
+	if eventID == "" || ts == "" || sig == "" {
+		return ErrMissingHeader
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if d := now.Sub(time.Unix(timestamp, 0)); d > tolerance || d < -tolerance {
+		return ErrExpired
+	}
+	if !strings.HasPrefix(sig, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(Sign(secret, timestamp, eventID, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Verifier 校验签名并在时间窗口内拒绝重复的事件ID
+type Verifier struct {
+	secret    string
+	tolerance time.Duration
+	now       func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time // eventID => 收到的时间
+}
+
+func NewVerifier(secret string, tolerance time.Duration) *Verifier {
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	return &Verifier{
+		secret:    secret,
+		tolerance: tolerance,
+		now:       time.Now,
+		seen:      map[string]time.Time{},
+	}
+}
+
+// Verify 读取并校验请求体，校验通过后返回请求体，r.Body会被重置以便再次读取
+func (v *Verifier) Verify(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	now := v.now()
+	if err := Verify(v.secret, r.Header, body, now, v.tolerance); err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// 超出时间窗口的事件已经会被拒绝，无需继续记录
+	for id, t := range v.seen {
+		if now.Sub(t) > 2*v.tolerance {
+			delete(v.seen, id)
+		}
+	}
+	eventID := r.Header.Get(HeaderEventID)
+	if _, ok := v.seen[eventID]; ok {
+		return nil, ErrReplayed
+	}
+	v.seen[eventID] = now
+	return body, nil
+}
+
+// Middleware 校验失败时返回401
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
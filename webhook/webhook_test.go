@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedRequest(secret string, now time.Time, eventID, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+	SetHeaders(r.Header, secret, now, eventID, []byte(body))
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"table":"notes"}`)
+	h := http.Header{}
+	SetHeaders(h, "secret", now, "evt-1", body)
+
+	assert.Nil(t, Verify("secret", h, body, now.Add(time.Minute), DefaultTolerance))
+	assert.Equal(t, ErrInvalidSignature, Verify("other", h, body, now, DefaultTolerance))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", h, []byte(`{}`), now, DefaultTolerance))
+	assert.Equal(t, ErrExpired, Verify("secret", h, body, now.Add(time.Hour), DefaultTolerance))
+
+	// 未配置secret时不签名
+	unsigned := http.Header{}
+	SetHeaders(unsigned, "", now, "evt-1", body)
+	assert.Equal(t, ErrMissingHeader, Verify("secret", unsigned, body, now, DefaultTolerance))
+
+	h.Set(HeaderTimestamp, "abc")
+	assert.Equal(t, ErrInvalidTimestamp, Verify("secret", h, body, now, DefaultTolerance))
+}
+
+func TestVerifierReplay(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier("secret", time.Minute)
+
+	body, err := v.Verify(signedRequest("secret", now, "evt-1", "hello"))
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	_, err = v.Verify(signedRequest("secret", now, "evt-1", "hello"))
+	assert.Equal(t, ErrReplayed, err)
+	_, err = v.Verify(signedRequest("secret", now, "evt-2", "hello"))
+	assert.Nil(t, err)
+
+	// 过期的记录被清理
+	v.now = func() time.Time { return now.Add(3 * time.Minute) }
+	_, err = v.Verify(signedRequest("secret", now.Add(3*time.Minute), "evt-3", "hello"))
+	assert.Nil(t, err)
+	assert.Len(t, v.seen, 1)
+}
+
+func TestMiddleware(t *testing.T) {
+	v := NewVerifier("secret", time.Minute)
+	h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, signedRequest("secret", time.Now(), "evt-1", "hello"))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, signedRequest("other", time.Now(), "evt-2", "hello"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}